@@ -0,0 +1,63 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	configv1alpha1 "k8s.io/component-base/config/v1alpha1"
+	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+)
+
+//+kubebuilder:object:root=true
+
+// ManagerConfig is the configuration file of the controller manager, loaded with --config.
+// Flags given on the command line override the values it sets.
+type ManagerConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ControllerManagerConfigurationSpec configures the metrics and health probe addresses,
+	// leader election, a single watched namespace and per-controller concurrency, the latter
+	// keyed by "DynamicAuthorizationPolicy.peerauth.aweis.io" and "Pod".
+	cfg.ControllerManagerConfigurationSpec `json:",inline"`
+
+	// WatchNamespaces restricts the pods and DynamicAuthorizationPolicies the controller
+	// caches to these namespaces, in addition to those matching WatchNamespaceSelector.
+	WatchNamespaces []string `json:"watchNamespaces,omitempty"`
+	// WatchNamespaceSelector restricts the controller to the namespaces whose labels match it
+	// when the manager starts.
+	WatchNamespaceSelector *metav1.LabelSelector `json:"watchNamespaceSelector,omitempty"`
+	// DefaultTrustDomain is used in the principals of policies that do not set a trust domain.
+	DefaultTrustDomain string `json:"defaultTrustDomain,omitempty"`
+	// DryRun puts every DynamicAuthorizationPolicy in DryRun mode regardless of its spec.
+	DryRun bool `json:"dryRun,omitempty"`
+	// FeatureGates enables or disables optional controller features by name.
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+}
+
+// Complete returns the controller-runtime configuration, defaulting the sections the manager
+// expects to be set.
+func (c *ManagerConfig) Complete() (cfg.ControllerManagerConfigurationSpec, error) {
+	spec := c.ControllerManagerConfigurationSpec
+	if spec.LeaderElection == nil {
+		spec.LeaderElection = &configv1alpha1.LeaderElectionConfiguration{}
+	}
+	return spec, nil
+}
+
+func init() {
+	SchemeBuilder.Register(&ManagerConfig{})
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestLoadManagerConfig(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		file    string
+		options ctrl.Options
+		check   func(t *testing.T, options ctrl.Options, config ManagerConfig)
+	}{
+		"repo config": {
+			file: "../../../config/manager/controller_manager_config.yaml",
+			check: func(t *testing.T, options ctrl.Options, config ManagerConfig) {
+				if options.MetricsBindAddress != "127.0.0.1:8080" || options.HealthProbeBindAddress != ":8081" {
+					t.Errorf("addresses = %q, %q", options.MetricsBindAddress, options.HealthProbeBindAddress)
+				}
+				if !options.LeaderElection || options.LeaderElectionID != "ff937905.aweis.io" {
+					t.Errorf("leader election = %t, %q", options.LeaderElection, options.LeaderElectionID)
+				}
+				if got := options.Controller.GroupKindConcurrency["DynamicAuthorizationPolicy.peerauth.aweis.io"]; got != 1 {
+					t.Errorf("DynamicAuthorizationPolicy concurrency = %d, want 1", got)
+				}
+				if config.DefaultTrustDomain != "cluster.local" || !config.FeatureGates["PrincipalIndex"] {
+					t.Errorf("config = %+v", config)
+				}
+			},
+		},
+		"without leader election": {
+			file: "apiVersion: config.peerauth.aweis.io/v1alpha1\nkind: ManagerConfig\ncacheNamespace: team-a\ndryRun: true\n",
+			check: func(t *testing.T, options ctrl.Options, config ManagerConfig) {
+				if options.Namespace != "team-a" || options.LeaderElection || !config.DryRun {
+					t.Errorf("options namespace %q, leader election %t, dryRun %t",
+						options.Namespace, options.LeaderElection, config.DryRun)
+				}
+			},
+		},
+		"options already set are kept": {
+			file:    "apiVersion: config.peerauth.aweis.io/v1alpha1\nkind: ManagerConfig\nmetrics:\n  bindAddress: :9000\n",
+			options: ctrl.Options{MetricsBindAddress: ":8080"},
+			check: func(t *testing.T, options ctrl.Options, config ManagerConfig) {
+				if options.MetricsBindAddress != ":8080" {
+					t.Errorf("metrics address = %q, want the flag's :8080", options.MetricsBindAddress)
+				}
+			},
+		},
+	}
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			path := tt.file
+			if _, err := os.Stat(path); err != nil {
+				path = filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			scheme := runtime.NewScheme()
+			if err := AddToScheme(scheme); err != nil {
+				t.Fatal(err)
+			}
+			tt.options.Scheme = scheme
+			config := ManagerConfig{}
+			options, err := tt.options.AndFrom(ctrl.ConfigFile().AtPath(path).OfKind(&config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, options, config)
+		})
+	}
+}
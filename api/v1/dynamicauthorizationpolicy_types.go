@@ -24,24 +24,199 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// Mode controls whether the controller writes the resources generated for a DAP.
+// +kubebuilder:validation:Enum=Enforce;DryRun
+type Mode string
+
+const (
+	// ModeEnforce creates, updates and deletes generated resources.
+	ModeEnforce Mode = "Enforce"
+	// ModeDryRun computes generated resources and records the intended changes in status
+	// and Events without writing them.
+	ModeDryRun Mode = "DryRun"
+)
+
+// Backend generates the objects enforcing a DAP's principals.
+// +kubebuilder:validation:Enum=Istio;Linkerd;NetworkPolicy
+type Backend string
+
+const (
+	// BackendIstio generates security.istio.io AuthorizationPolicies.
+	BackendIstio Backend = "Istio"
+	// BackendLinkerd generates policy.linkerd.io AuthorizationPolicies and
+	// MeshTLSAuthentications.
+	BackendLinkerd Backend = "Linkerd"
+	// BackendNetworkPolicy generates networking.k8s.io NetworkPolicies. It enforces at L3/L4
+	// rather than by identity, so it is meant to be selected alongside a mesh backend.
+	BackendNetworkPolicy Backend = "NetworkPolicy"
+)
+
 // DynamicAuthorizationPolicySpec defines the desired state of DynamicAuthorizationPolicy
 type DynamicAuthorizationPolicySpec struct {
 	// Important: Run "make" to regenerate code after modifying this file
 	DynamicPolicies []DynamicPolicy `json:"dynamicPolicies"`
+	// +kubebuilder:default:="Enforce"
+	// +kubebuilder:validation:Optional
+	Mode Mode `json:"mode,omitempty"`
+	// Backends generate the objects enforcing the DAP's principals. Defaults to Istio.
+	// PeerAuthentication, SidecarEgress and AuthorizationPolicyRule require the Istio backend.
+	// +kubebuilder:validation:Optional
+	// +listType=set
+	Backends []Backend `json:"backends,omitempty"`
+	// PeerAuthentication, when set, makes the controller ensure a STRICT mutual TLS
+	// PeerAuthentication exists for the workloads protected by each policy, since
+	// AuthorizationPolicy principals are only authenticated over mutual TLS.
+	// +kubebuilder:validation:Optional
+	PeerAuthentication *PeerAuthentication `json:"peerAuthentication,omitempty"`
+	// SidecarEgress, when set, makes the controller generate a Sidecar in each granted caller's
+	// namespace limiting the callers' egress to their own namespace, the protected services and
+	// Hosts, keeping their Envoy configuration small on large meshes. A caller's Sidecar is shared
+	// by every DAP granting it egress, and is only generated in namespaces the tenancy policy
+	// lets the DAP select pods from.
+	// +kubebuilder:validation:Optional
+	SidecarEgress *SidecarEgress `json:"sidecarEgress,omitempty"`
+}
+
+// SidecarEgress configures the Sidecars generated for a DAP's callers. Sidecars select callers
+// by PodSelectors alone, so they are not generated for policies with PodSelectorExpressions or
+// without PodSelectors, which would also scope the egress of pods that are not callers. Hosts
+// of the namespace-wide Sidecar in a caller's namespace stay reachable, while callers selected
+// by a user-authored Sidecar or another DAP's generated one get no generated one. Sidecars are
+// only generated when the controller's SidecarEgress feature gate is enabled.
+type SidecarEgress struct {
+	// Hosts are further egress hosts, in Istio's namespace/dnsName form, the callers need
+	// besides the Services in the DAP's namespace selecting the protected workloads.
+	// +kubebuilder:validation:Optional
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// MTLSMode is an Istio mutual TLS mode.
+// +kubebuilder:validation:Enum=STRICT;PERMISSIVE;DISABLE
+type MTLSMode string
+
+const (
+	MTLSStrict     MTLSMode = "STRICT"
+	MTLSPermissive MTLSMode = "PERMISSIVE"
+	MTLSDisable    MTLSMode = "DISABLE"
+)
+
+// PeerAuthentication configures the PeerAuthentications generated for a DAP's workloads.
+type PeerAuthentication struct {
+	// PortLevelMTLS overrides the STRICT mode for individual workload ports.
+	// +kubebuilder:validation:Optional
+	PortLevelMTLS []PortMTLS `json:"portLevelMtls,omitempty"`
+}
+
+// PortMTLS is the mutual TLS mode of a workload port.
+type PortMTLS struct {
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32    `json:"port"`
+	Mode MTLSMode `json:"mode"`
 }
 
 type DynamicPolicy struct {
 	Name         string     `json:"name"`
 	PodSelectors labels.Set `json:"podSelectors"`
-	// +kubebuilder:default:="cluster.local"
-	TrustDomain string `json:"trustDomain"`
+	// PodSelectorExpressions are further requirements on the labels of selected pods.
+	// +kubebuilder:validation:Optional
+	PodSelectorExpressions []metav1.LabelSelectorRequirement `json:"podSelectorExpressions,omitempty"`
+	// Namespaces limits the pods selected by PodSelectors to these namespaces. When empty, pods
+	// are selected from every namespace the controller's tenancy policy allows for the DAP.
+	// +kubebuilder:validation:Optional
+	Namespaces []string `json:"namespaces,omitempty"`
+	// TrustDomain of the principals granted by the policy. Defaults to the controller's
+	// default trust domain.
+	// +kubebuilder:validation:Optional
+	TrustDomain string `json:"trustDomain,omitempty"`
+	// WorkloadSelector selects the workloads in the DAP's namespace protected by the generated
+	// AuthorizationPolicy. When empty the policy applies to every workload in the namespace, and
+	// its AuthorizationPolicy is only generated once it grants principals, as one granting none
+	// would deny every request to the namespace.
+	// +kubebuilder:validation:Optional
+	WorkloadSelector labels.Set `json:"workloadSelector,omitempty"`
+	// RequireApproval holds newly discovered principals in status.pendingPrincipals until they
+	// are listed in ApprovedPrincipals. Principals whose pods disappear are revoked immediately.
+	// +kubebuilder:validation:Optional
+	RequireApproval bool `json:"requireApproval,omitempty"`
+	// ApprovedPrincipals may be granted when RequireApproval is set.
+	// +kubebuilder:validation:Optional
+	ApprovedPrincipals []string `json:"approvedPrincipals,omitempty"`
+	// MaxPrincipals caps the number of principals the policy may grant, overriding the
+	// controller's default. When exceeded the previously granted principals are kept.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Optional
+	MaxPrincipals *int32 `json:"maxPrincipals,omitempty"`
+	// AuthorizationPolicyRule, when set, merges the policy's principals into a rule of an
+	// existing AuthorizationPolicy in the DAP's namespace instead of generating one.
+	// +kubebuilder:validation:Optional
+	AuthorizationPolicyRule *AuthorizationPolicyRuleRef `json:"authorizationPolicyRule,omitempty"`
+	// Server names the policy.linkerd.io Server in the DAP's namespace the Linkerd backend
+	// authorizes the policy's principals for. When empty the Linkerd backend authorizes them for
+	// the whole namespace, which requires an empty WorkloadSelector.
+	// +kubebuilder:validation:Optional
+	Server string `json:"server,omitempty"`
+}
+
+// AuthorizationPolicyRuleLabelsAnnotation lists, comma-separated and in rule order, labels
+// naming the rules of a user-authored AuthorizationPolicy, so they can be referenced by Label.
+const AuthorizationPolicyRuleLabelsAnnotation = "peerauth.aweis.io/rule-labels"
+
+// AuthorizationPolicyRuleRef references a rule of a user-authored AuthorizationPolicy whose
+// first source's principals are managed by the controller. The rest of the policy is left
+// untouched. Exactly one of Index and Label must be set.
+type AuthorizationPolicyRuleRef struct {
+	// Name of the AuthorizationPolicy in the DAP's namespace.
+	Name string `json:"name"`
+	// Index of the rule in spec.rules.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Optional
+	Index *int32 `json:"index,omitempty"`
+	// Label of the rule in the policy's peerauth.aweis.io/rule-labels annotation.
+	// +kubebuilder:validation:Optional
+	Label string `json:"label,omitempty"`
+}
+
+// Selector returns the selector combining PodSelectors and PodSelectorExpressions.
+func (dp DynamicPolicy) Selector() (labels.Selector, error) {
+	return metav1.LabelSelectorAsSelector(&metav1.LabelSelector{
+		MatchLabels:      dp.PodSelectors,
+		MatchExpressions: dp.PodSelectorExpressions,
+	})
 }
 
-func (dp DynamicPolicy) ListPods(ctx context.Context, c client.Client, pl *corev1.PodList) error {
-	return c.List(ctx, pl, client.MatchingLabels(dp.PodSelectors))
+func (dp DynamicPolicy) ListPods(ctx context.Context, c client.Reader, pl *corev1.PodList) error {
+	selector, err := dp.Selector()
+	if err != nil {
+		return err
+	}
+	if len(dp.Namespaces) == 0 {
+		return c.List(ctx, pl, client.MatchingLabelsSelector{Selector: selector})
+	}
+	for _, ns := range dp.Namespaces {
+		pods := corev1.PodList{}
+		if err := c.List(ctx, &pods, client.MatchingLabelsSelector{Selector: selector}, client.InNamespace(ns)); err != nil {
+			return err
+		}
+		pl.Items = append(pl.Items, pods.Items...)
+	}
+	return nil
+}
+
+// DefaultTrustDomain is used in the principals of policies that do not set a trust domain.
+var DefaultTrustDomain = "cluster.local" // nolint:gochecknoglobals
+
+// Principal returns the Istio principal the pod's service account is granted under this policy.
+func (dp DynamicPolicy) Principal(pod corev1.Pod) string {
+	trustDomain := dp.TrustDomain
+	if trustDomain == "" {
+		trustDomain = DefaultTrustDomain
+	}
+	return fmt.Sprintf("%s/ns/%s/sa/%s", trustDomain, pod.GetNamespace(), pod.Spec.ServiceAccountName)
 }
 
 // DynamicAuthorizationPolicyStatus defines the observed state of DynamicAuthorizationPolicy
@@ -49,6 +224,96 @@ type DynamicAuthorizationPolicyStatus struct {
 	// +kubebuilder:validation:Optional
 	ServiceAccountPolicyMapping ServiceAccountPolicyMapping `json:"serviceAccountPolicyMapping"`
 	// ServiceAccountPolicyMapping ServiceAccountPolicyMappingType `json:"serviceAccountPolicyMapping"`
+
+	// PendingPrincipals lists, per policy, the selected principals awaiting approval.
+	// +kubebuilder:validation:Optional
+	PendingPrincipals map[string][]string `json:"pendingPrincipals,omitempty"`
+
+	// Conditions describe the latest observations of the DAP's state.
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// IntendedChanges lists the writes the controller would make to generated resources.
+	// It is only populated while the DAP is in DryRun mode.
+	// +kubebuilder:validation:Optional
+	IntendedChanges []IntendedChange `json:"intendedChanges,omitempty"`
+
+	// Backends lists the backends whose objects the controller last wrote.
+	// +kubebuilder:validation:Optional
+	// +listType=set
+	Backends []Backend `json:"backends,omitempty"`
+
+	// MergedRules lists the user-authored AuthorizationPolicy rules the controller last merged
+	// principals into, so rules no longer referenced can be released.
+	// +kubebuilder:validation:Optional
+	MergedRules []AuthorizationPolicyRuleRef `json:"mergedRules,omitempty"`
+}
+
+// Condition types reported in DynamicAuthorizationPolicyStatus.Conditions.
+const (
+	// ConditionNamespacesAllowed is False when a policy selects pods from namespaces the
+	// controller's tenancy policy does not allow for the DAP's namespace.
+	ConditionNamespacesAllowed = "NamespacesAllowed"
+	// ConditionNamespacesWatched is False when a policy selects pods from namespaces the
+	// controller does not watch, so their pods are never granted.
+	ConditionNamespacesWatched = "NamespacesWatched"
+	// ConditionDegraded is True when a policy selects more principals than it may grant and
+	// the controller keeps its last-known-good principals instead.
+	ConditionDegraded = "Degraded"
+	// ConditionStrictMTLS is False when a PeerAuthentication the DAP does not own makes mutual
+	// TLS permissive for workloads the DAP's generated PeerAuthentications make STRICT. It is
+	// only reported when spec.peerAuthentication is set.
+	ConditionStrictMTLS = "StrictMTLS"
+	// ConditionObjectsOwned is False when an object the DAP would generate already exists
+	// without being labelled for and controlled by it. Such objects are left untouched rather
+	// than adopted.
+	ConditionObjectsOwned = "ObjectsOwned"
+	// ConditionSidecarEgress is False when user-authored Sidecars, or Sidecars generated for
+	// other DAPs' callers, select callers the DAP grants egress, which get no generated Sidecar
+	// so as not to overlap them, or when the controller does not generate Sidecars. It is only
+	// reported when spec.sidecarEgress is set and the Istio backend selected.
+	ConditionSidecarEgress = "SidecarEgress"
+)
+
+// ChangeAction is the write the controller would make to a generated resource.
+type ChangeAction string
+
+const (
+	ChangeCreate ChangeAction = "Create"
+	ChangeUpdate ChangeAction = "Update"
+	ChangeDelete ChangeAction = "Delete"
+)
+
+// IntendedChange describes a write to a generated resource and the principals it would
+// grant or revoke compared to the resource that currently exists.
+type IntendedChange struct {
+	// APIVersion of the resource, telling apart kinds of different backends with the same name.
+	// +kubebuilder:validation:Optional
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	// Namespace is only set for resources generated outside the DAP's namespace.
+	// +kubebuilder:validation:Optional
+	Namespace string       `json:"namespace,omitempty"`
+	Action    ChangeAction `json:"action"`
+	// +kubebuilder:validation:Optional
+	AddedPrincipals []string `json:"addedPrincipals,omitempty"`
+	// +kubebuilder:validation:Optional
+	RemovedPrincipals []string `json:"removedPrincipals,omitempty"`
+}
+
+// Object names the resource the change writes as Kind.group [namespace/]name.
+func (c IntendedChange) Object() string {
+	kind := c.Kind
+	if group := schema.FromAPIVersionAndKind(c.APIVersion, c.Kind).Group; group != "" {
+		kind += "." + group
+	}
+	if c.Namespace != "" {
+		return fmt.Sprintf("%s %s/%s", kind, c.Namespace, c.Name)
+	}
+	return fmt.Sprintf("%s %s", kind, c.Name)
 }
 
 type ServiceAccountPolicyMapping map[string]HashSet
@@ -70,13 +335,13 @@ type ServiceAccountPolicyMapping map[string]HashSet
 // }
 
 func (sapm *ServiceAccountPolicyMapping) Map(policy DynamicPolicy, pod corev1.Pod) {
-	sa := pod.Spec.ServiceAccountName
-	principle := fmt.Sprintf("%s/ns/%s/sa/%s", policy.TrustDomain, pod.GetNamespace(), sa)
+	principle := policy.Principal(pod)
 	// log.Info("adding principle", "principle", principle)
-	sapm.add(policy.Name, principle)
+	sapm.Add(policy.Name, principle)
 }
 
-func (sapm *ServiceAccountPolicyMapping) add(key, val string) {
+// Add maps principal val to policy key.
+func (sapm *ServiceAccountPolicyMapping) Add(key, val string) {
 	if *sapm == nil {
 		*sapm = ServiceAccountPolicyMapping{}
 	}
@@ -151,6 +416,18 @@ func (hs *HashSet) Add(val string) {
 	(*hs)[val] = true
 }
 
+// Difference returns the sorted values in hs that are not in other.
+func (hs HashSet) Difference(other HashSet) []string {
+	diff := []string{}
+	for k := range hs {
+		if !other.Get(k) {
+			diff = append(diff, k)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
 func (hs HashSet) Slice() []string {
 	keys := []string{}
 	for k := range hs {
@@ -161,6 +438,7 @@ func (hs HashSet) Slice() []string {
 }
 
 //+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
 
 // DynamicAuthorizationPolicy is the Schema for the dynamicauthorizationpolicies API
 type DynamicAuthorizationPolicy struct {
@@ -175,6 +453,29 @@ func (dap *DynamicAuthorizationPolicy) GetPolicies() []DynamicPolicy {
 	return dap.Spec.DynamicPolicies
 }
 
+// GetBackends returns the backends generating the DAP's objects, Istio when none are set.
+func (dap *DynamicAuthorizationPolicy) GetBackends() []Backend {
+	if len(dap.Spec.Backends) == 0 {
+		return []Backend{BackendIstio}
+	}
+	return dap.Spec.Backends
+}
+
+// HasBackend reports whether backend generates the DAP's objects.
+func (dap *DynamicAuthorizationPolicy) HasBackend(backend Backend) bool {
+	for _, b := range dap.GetBackends() {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDryRun reports whether generated resources must be left untouched for this DAP.
+func (dap *DynamicAuthorizationPolicy) IsDryRun() bool {
+	return dap.Spec.Mode == ModeDryRun
+}
+
 // func (dap *DynamicAuthorizationPolicy) AddPolicyMapping(policyName, serviceAccountNamespace, serviceAccount string) {
 // 	if dap.Status.ServiceAccountPolicyMapping == nil {
 // 		dap.Status.ServiceAccountPolicyMapping = make(map[string][]string)
@@ -22,10 +22,31 @@ limitations under the License.
 package v1
 
 import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AuthorizationPolicyRuleRef) DeepCopyInto(out *AuthorizationPolicyRuleRef) {
+	*out = *in
+	if in.Index != nil {
+		in, out := &in.Index, &out.Index
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AuthorizationPolicyRuleRef.
+func (in *AuthorizationPolicyRuleRef) DeepCopy() *AuthorizationPolicyRuleRef {
+	if in == nil {
+		return nil
+	}
+	out := new(AuthorizationPolicyRuleRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DynamicAuthorizationPolicy) DeepCopyInto(out *DynamicAuthorizationPolicy) {
 	*out = *in
@@ -95,6 +116,21 @@ func (in *DynamicAuthorizationPolicySpec) DeepCopyInto(out *DynamicAuthorization
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Backends != nil {
+		in, out := &in.Backends, &out.Backends
+		*out = make([]Backend, len(*in))
+		copy(*out, *in)
+	}
+	if in.PeerAuthentication != nil {
+		in, out := &in.PeerAuthentication, &out.PeerAuthentication
+		*out = new(PeerAuthentication)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SidecarEgress != nil {
+		in, out := &in.SidecarEgress, &out.SidecarEgress
+		*out = new(SidecarEgress)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DynamicAuthorizationPolicySpec.
@@ -127,6 +163,47 @@ func (in *DynamicAuthorizationPolicyStatus) DeepCopyInto(out *DynamicAuthorizati
 			(*out)[key] = outVal
 		}
 	}
+	if in.PendingPrincipals != nil {
+		in, out := &in.PendingPrincipals, &out.PendingPrincipals
+		*out = make(map[string][]string, len(*in))
+		for key, val := range *in {
+			var outVal []string
+			if val == nil {
+				(*out)[key] = nil
+			} else {
+				in, out := &val, &outVal
+				*out = make([]string, len(*in))
+				copy(*out, *in)
+			}
+			(*out)[key] = outVal
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.IntendedChanges != nil {
+		in, out := &in.IntendedChanges, &out.IntendedChanges
+		*out = make([]IntendedChange, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Backends != nil {
+		in, out := &in.Backends, &out.Backends
+		*out = make([]Backend, len(*in))
+		copy(*out, *in)
+	}
+	if in.MergedRules != nil {
+		in, out := &in.MergedRules, &out.MergedRules
+		*out = make([]AuthorizationPolicyRuleRef, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DynamicAuthorizationPolicyStatus.
@@ -149,6 +226,40 @@ func (in *DynamicPolicy) DeepCopyInto(out *DynamicPolicy) {
 			(*out)[key] = val
 		}
 	}
+	if in.PodSelectorExpressions != nil {
+		in, out := &in.PodSelectorExpressions, &out.PodSelectorExpressions
+		*out = make([]metav1.LabelSelectorRequirement, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.WorkloadSelector != nil {
+		in, out := &in.WorkloadSelector, &out.WorkloadSelector
+		*out = make(labels.Set, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.ApprovedPrincipals != nil {
+		in, out := &in.ApprovedPrincipals, &out.ApprovedPrincipals
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.MaxPrincipals != nil {
+		in, out := &in.MaxPrincipals, &out.MaxPrincipals
+		*out = new(int32)
+		**out = **in
+	}
+	if in.AuthorizationPolicyRule != nil {
+		in, out := &in.AuthorizationPolicyRule, &out.AuthorizationPolicyRule
+		*out = new(AuthorizationPolicyRuleRef)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DynamicPolicy.
@@ -182,6 +293,66 @@ func (in HashSet) DeepCopy() HashSet {
 	return *out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IntendedChange) DeepCopyInto(out *IntendedChange) {
+	*out = *in
+	if in.AddedPrincipals != nil {
+		in, out := &in.AddedPrincipals, &out.AddedPrincipals
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RemovedPrincipals != nil {
+		in, out := &in.RemovedPrincipals, &out.RemovedPrincipals
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IntendedChange.
+func (in *IntendedChange) DeepCopy() *IntendedChange {
+	if in == nil {
+		return nil
+	}
+	out := new(IntendedChange)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PeerAuthentication) DeepCopyInto(out *PeerAuthentication) {
+	*out = *in
+	if in.PortLevelMTLS != nil {
+		in, out := &in.PortLevelMTLS, &out.PortLevelMTLS
+		*out = make([]PortMTLS, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PeerAuthentication.
+func (in *PeerAuthentication) DeepCopy() *PeerAuthentication {
+	if in == nil {
+		return nil
+	}
+	out := new(PeerAuthentication)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PortMTLS) DeepCopyInto(out *PortMTLS) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PortMTLS.
+func (in *PortMTLS) DeepCopy() *PortMTLS {
+	if in == nil {
+		return nil
+	}
+	out := new(PortMTLS)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in ServiceAccountPolicyMapping) DeepCopyInto(out *ServiceAccountPolicyMapping) {
 	{
@@ -212,3 +383,23 @@ func (in ServiceAccountPolicyMapping) DeepCopy() ServiceAccountPolicyMapping {
 	in.DeepCopyInto(out)
 	return *out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SidecarEgress) DeepCopyInto(out *SidecarEgress) {
+	*out = *in
+	if in.Hosts != nil {
+		in, out := &in.Hosts, &out.Hosts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SidecarEgress.
+func (in *SidecarEgress) DeepCopy() *SidecarEgress {
+	if in == nil {
+		return nil
+	}
+	out := new(SidecarEgress)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/aweis89/istio-dynamic-principles/controllers"
+)
+
+// diff plans the edited DAP spec against the live cluster as the controller would if the edit
+// were applied, printing each object it would write with the principals it would gain or lose.
+func diff(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	namespace := fs.String("n", "default", "namespace for manifests that do not set one")
+	file := fs.String("f", "", "manifest containing the edited DynamicAuthorizationPolicy")
+	maxPrincipals := fs.Int("max-principals", 0, "principals a policy may grant unless it sets maxPrincipals; zero means unlimited")
+	sidecarEgress := fs.Bool("sidecar-egress", false, "plan Sidecars, as a controller with the SidecarEgress feature gate does")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	edited, err := readDAP(*file, *namespace)
+	if err != nil {
+		return err
+	}
+
+	k8sClient, err := c.newClient()
+	if err != nil {
+		return err
+	}
+	live := peerauthv1.DynamicAuthorizationPolicy{}
+	err = k8sClient.Get(ctx, client.ObjectKeyFromObject(edited), &live)
+	switch {
+	case kerrors.IsNotFound(err):
+	case err != nil:
+		return errors.Wrapf(err, "unable to get DynamicAuthorizationPolicy %s", client.ObjectKeyFromObject(edited))
+	default:
+		// The edit replaces the live spec, so the objects the live DAP owns and its status are
+		// planned against as they would be on the next reconcile.
+		live.Spec = edited.Spec
+		edited = &live
+	}
+
+	r := &controllers.DynamicAuthorizationPolicyReconciler{
+		Client: k8sClient, Scheme: scheme, MaxPrincipals: *maxPrincipals, SidecarEgress: *sidecarEgress,
+	}
+	planned, err := r.Plan(ctx, edited)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(writeDiff(c.out, planned), "unable to write output")
+}
+
+// writeDiff prints each planned write with the principals removed and added by it.
+func writeDiff(out io.Writer, planned []controllers.PlannedChange) error {
+	if len(planned) == 0 {
+		_, err := fmt.Fprintln(out, "no changes")
+		return err
+	}
+	for _, change := range planned {
+		if _, err := fmt.Fprintf(out, "%s %s\n", strings.ToLower(string(change.Action)), change.IntendedChange.Object()); err != nil {
+			return err
+		}
+		for _, principal := range change.RemovedPrincipals {
+			if _, err := fmt.Fprintf(out, "- %s\n", principal); err != nil {
+				return err
+			}
+		}
+		for _, principal := range change.AddedPrincipals {
+			if _, err := fmt.Fprintf(out, "+ %s\n", principal); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/aweis89/istio-dynamic-principles/controllers"
+)
+
+func explain(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	namespace := fs.String("n", "default", "namespace of the DynamicAuthorizationPolicy")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("explain requires exactly one DynamicAuthorizationPolicy name")
+	}
+
+	k8sClient, err := c.newClient()
+	if err != nil {
+		return err
+	}
+	dap := peerauthv1.DynamicAuthorizationPolicy{}
+	key := types.NamespacedName{Namespace: *namespace, Name: positional[0]}
+	if err := k8sClient.Get(ctx, key, &dap); err != nil {
+		return errors.Wrapf(err, "unable to get DynamicAuthorizationPolicy %s", key)
+	}
+
+	res, err := controllers.Resolve(ctx, k8sClient, &dap, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "DynamicAuthorizationPolicy %s\n\n", key)
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POLICY\tPRINCIPAL\tPODS")
+	for _, policy := range dap.GetPolicies() {
+		principals := res.Mapping[policy.Name].Slice()
+		if len(principals) == 0 {
+			fmt.Fprintf(w, "%s\t<none>\t\n", policy.Name)
+			continue
+		}
+		for _, principal := range principals {
+			pods := []string{}
+			for _, pod := range res.Contributors.Pods(policy.Name, principal) {
+				pods = append(pods, pod.String())
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", policy.Name, principal, strings.Join(pods, ","))
+		}
+	}
+	return errors.Wrap(w.Flush(), "unable to write output")
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-dap is a kubectl plugin for inspecting and simulating DynamicAuthorizationPolicies.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(peerauthv1.AddToScheme(scheme))
+}
+
+// cli carries the dependencies shared by all subcommands.
+type cli struct {
+	out       io.Writer
+	newClient func() (client.Client, error)
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *cli, args []string) error
+}
+
+var commands = map[string]command{ // nolint:gochecknoglobals
+	"explain": {
+		usage: "explain <dap> [-n namespace]: show each policy's principals and the pods contributing them",
+		run:   explain,
+	},
+	"who-can-call": {
+		usage: "who-can-call [kind/]<workload> [-n namespace]: list the principals granted by policies protecting a workload",
+		run:   whoCanCall,
+	},
+	"diff": {
+		usage: "diff -f dap.yaml: show the objects an edited DAP spec would write and the principals each would gain or lose",
+		run:   diff,
+	},
+	"simulate": {
+		usage: "simulate -f dap.yaml: compute the status mapping for a DAP without applying it",
+		run:   simulate,
+	},
+	"render": {
+		usage: "render -f daps.yaml -s snapshot.yaml: render DAP status and the objects the controller would write offline",
+		run:   render,
+	},
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	c := &cli{
+		out: os.Stdout,
+		newClient: func() (client.Client, error) {
+			cfg, err := ctrl.GetConfig()
+			if err != nil {
+				return nil, errors.Wrap(err, "unable to load kubeconfig")
+			}
+			k8sClient, err := client.New(cfg, client.Options{Scheme: scheme})
+			return k8sClient, errors.Wrap(err, "unable to create client")
+		},
+	}
+	if err := cmd.run(context.Background(), c, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: kubectl dap [--kubeconfig path] <command> [flags]\n\nCommands:\n")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s\n", commands[name].usage)
+	}
+}
+
+// parseFlags parses subcommand flags, allowing them to appear before or after positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse %s flags", fs.Name())
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// readDAPs decodes every DynamicAuthorizationPolicy in a multi-document YAML or JSON file.
+// A path of "-" reads from stdin.
+func readDAPs(path, namespace string) ([]peerauthv1.DynamicAuthorizationPolicy, error) {
+	if path == "" {
+		return nil, errors.New("a manifest must be provided with -f")
+	}
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to open %s", path)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	daps := []peerauthv1.DynamicAuthorizationPolicy{}
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		dap := peerauthv1.DynamicAuthorizationPolicy{}
+		if err := decoder.Decode(&dap); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, errors.Wrapf(err, "unable to decode %s", path)
+		}
+		if dap.GetName() == "" {
+			continue
+		}
+		if dap.GetNamespace() == "" {
+			dap.SetNamespace(namespace)
+		}
+		daps = append(daps, dap)
+	}
+	return daps, nil
+}
+
+// readDAP decodes a manifest that must contain exactly one DynamicAuthorizationPolicy.
+func readDAP(path, namespace string) (*peerauthv1.DynamicAuthorizationPolicy, error) {
+	daps, err := readDAPs(path, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if len(daps) != 1 {
+		return nil, errors.Errorf("expected one DynamicAuthorizationPolicy in %s, found %d", path, len(daps))
+	}
+	return &daps[0], nil
+}
@@ -0,0 +1,327 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/yaml"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/aweis89/istio-dynamic-principles/controllers"
+)
+
+const editedDAP = `
+apiVersion: peerauth.aweis.io/v1
+kind: DynamicAuthorizationPolicy
+metadata:
+  name: dap
+spec:
+  dynamicPolicies:
+  - name: foo
+    trustDomain: cluster.local
+    podSelectors:
+      app: b
+`
+
+func testPod(name, sa string, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels},
+		Spec:       corev1.PodSpec{ServiceAccountName: sa},
+	}
+}
+
+func testCLI(t *testing.T, objs ...client.Object) (*cli, *bytes.Buffer) {
+	t.Helper()
+	out := &bytes.Buffer{}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	return &cli{
+		out:       out,
+		newClient: func() (client.Client, error) { return k8sClient, nil },
+	}, out
+}
+
+func TestCommands(t *testing.T) {
+	t.Parallel()
+	manifest := filepath.Join(t.TempDir(), "dap.yaml")
+	if err := os.WriteFile(manifest, []byte(editedDAP), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	objs := func() []client.Object {
+		dap := &peerauthv1.DynamicAuthorizationPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "default", UID: "dap-uid"},
+			Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+				DynamicPolicies: []peerauthv1.DynamicPolicy{
+					{
+						Name:             "foo",
+						TrustDomain:      "cluster.local",
+						PodSelectors:     map[string]string{"app": "a"},
+						WorkloadSelector: map[string]string{"app": "api"},
+					},
+				},
+			},
+			Status: peerauthv1.DynamicAuthorizationPolicyStatus{
+				ServiceAccountPolicyMapping: peerauthv1.ServiceAccountPolicyMapping{
+					"foo": peerauthv1.FromSlice([]string{"cluster.local/ns/default/sa/sa-a"}),
+				},
+			},
+		}
+		// The AuthorizationPolicy the controller generated for the live DAP.
+		ap := controllers.AuthorizationPolicies(dap, dap.Status.ServiceAccountPolicyMapping)[0]
+		if err := controllerutil.SetControllerReference(dap, ap, scheme); err != nil {
+			t.Fatal(err)
+		}
+		return []client.Object{
+			dap,
+			ap,
+			testPod("pod-a", "sa-a", map[string]string{"app": "a"}),
+			testPod("pod-b", "sa-b", map[string]string{"app": "b"}),
+			testPod("api-1", "api", map[string]string{"app": "api"}),
+			&appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+				Spec:       appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}}},
+			},
+		}
+	}
+
+	tests := map[string]struct {
+		cmd  string
+		args []string
+		want string
+	}{
+		"diff against live spec": {
+			cmd:  "diff",
+			args: []string{"-f", manifest},
+			want: "update AuthorizationPolicy.security.istio.io foo\n- cluster.local/ns/default/sa/sa-a\n+ cluster.local/ns/default/sa/sa-b\n",
+		},
+		"simulate edited spec": {
+			cmd:  "simulate",
+			args: []string{"-f", manifest},
+			want: "serviceAccountPolicyMapping:\n  foo:\n    cluster.local/ns/default/sa/sa-b: true\n",
+		},
+		"explain live dap": {
+			cmd:  "explain",
+			args: []string{"dap"},
+			want: "DynamicAuthorizationPolicy default/dap\n\n" +
+				"POLICY  PRINCIPAL                         PODS\n" +
+				"foo     cluster.local/ns/default/sa/sa-a  default/pod-a\n",
+		},
+		"who-can-call deployment": {
+			cmd:  "who-can-call",
+			args: []string{"api"},
+			want: "DAP          POLICY  PRINCIPAL\n" +
+				"default/dap  foo     cluster.local/ns/default/sa/sa-a\n",
+		},
+		"who-can-call pod": {
+			cmd:  "who-can-call",
+			args: []string{"pod/api-1"},
+			want: "DAP          POLICY  PRINCIPAL\n" +
+				"default/dap  foo     cluster.local/ns/default/sa/sa-a\n",
+		},
+	}
+	for name, tt := range tests {
+		name, tt := name, tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, out := testCLI(t, objs()...)
+			if err := commands[tt.cmd].run(context.Background(), c, tt.args); err != nil {
+				t.Fatalf("%s returned error: %v", tt.cmd, err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("%s output = %q, want %q", tt.cmd, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWhoCanCallUnprotectedWorkload(t *testing.T) {
+	t.Parallel()
+	c, _ := testCLI(t,
+		&peerauthv1.DynamicAuthorizationPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "default"},
+			Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+				DynamicPolicies: []peerauthv1.DynamicPolicy{
+					{Name: "web", PodSelectors: map[string]string{"app": "a"}, WorkloadSelector: map[string]string{"app": "web"}},
+				},
+			},
+		},
+		testPod("web", "web", map[string]string{"app": "api"}),
+	)
+	if err := whoCanCall(context.Background(), c, []string{"pod/web"}); err == nil {
+		t.Error("a policy named after the workload matched although its WorkloadSelector does not")
+	}
+}
+
+const snapshot = `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: pod-b
+    labels:
+      app: b
+  spec:
+    serviceAccountName: sa-b
+    containers: []
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: pod-c
+    namespace: other
+    labels:
+      app: b
+  spec:
+    serviceAccountName: sa-c
+    containers: []
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: other
+`
+
+const rendered = `apiVersion: peerauth.aweis.io/v1
+kind: DynamicAuthorizationPolicy
+metadata:
+  creationTimestamp: null
+  name: dap
+  namespace: default
+spec:
+  dynamicPolicies:
+  - name: foo
+    podSelectors:
+      app: b
+    trustDomain: cluster.local
+status:
+  serviceAccountPolicyMapping:
+    foo:
+      cluster.local/ns/default/sa/sa-b: true
+      cluster.local/ns/other/sa/sa-c: true
+---
+apiVersion: security.istio.io/v1beta1
+kind: AuthorizationPolicy
+metadata:
+  labels:
+    peerauth.aweis.io/dynamic-authorization-policy: dap
+  name: foo
+  namespace: default
+spec:
+  action: ALLOW
+  rules:
+  - from:
+    - source:
+        principals:
+        - cluster.local/ns/default/sa/sa-b
+        - cluster.local/ns/other/sa/sa-c
+`
+
+func TestRender(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "dap.yaml")
+	if err := os.WriteFile(manifest, []byte(editedDAP), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	snapshotFile := filepath.Join(dir, "snapshot.yaml")
+	if err := os.WriteFile(snapshotFile, []byte(snapshot), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	c := &cli{
+		out: out,
+		newClient: func() (client.Client, error) {
+			t.Fatal("render must not contact a cluster")
+			return nil, nil
+		},
+	}
+	if err := render(context.Background(), c, []string{"-f", manifest, "-s", snapshotFile}); err != nil {
+		t.Fatalf("render returned error: %v", err)
+	}
+	if got := out.String(); got != rendered {
+		t.Errorf("render output = %s, want %s", got, rendered)
+	}
+}
+
+const linkerdDAP = `
+apiVersion: peerauth.aweis.io/v1
+kind: DynamicAuthorizationPolicy
+metadata:
+  name: dap
+spec:
+  backends:
+  - Linkerd
+  dynamicPolicies:
+  - name: foo
+    trustDomain: cluster.local
+    maxPrincipals: 1
+    podSelectors:
+      app: b
+`
+
+func TestRenderBackendsAndLimits(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "dap.yaml")
+	if err := os.WriteFile(manifest, []byte(linkerdDAP), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	snapshotFile := filepath.Join(dir, "snapshot.yaml")
+	if err := os.WriteFile(snapshotFile, []byte(snapshot), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := render(context.Background(), &cli{out: out}, []string{"-f", manifest, "-s", snapshotFile}); err != nil {
+		t.Fatalf("render returned error: %v", err)
+	}
+	kinds := []string{}
+	for _, doc := range strings.Split(out.String(), "---\n") {
+		u := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(doc), &u); err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, fmt.Sprintf("%s %s", u["apiVersion"], u["kind"]))
+	}
+	want := []string{
+		"peerauth.aweis.io/v1 DynamicAuthorizationPolicy",
+		"policy.linkerd.io/v1alpha1 MeshTLSAuthentication",
+		"policy.linkerd.io/v1alpha1 AuthorizationPolicy",
+	}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("rendered %v, want %v", kinds, want)
+	}
+	// Selecting two principals exceeds the limit, so the policy keeps granting none.
+	if strings.Contains(out.String(), "sa-b") || strings.Contains(out.String(), "sa-c") {
+		t.Errorf("render ignored maxPrincipals: %s", out.String())
+	}
+}
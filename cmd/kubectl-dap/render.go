@@ -0,0 +1,178 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+
+	"github.com/aweis89/istio-dynamic-principles/controllers"
+)
+
+// render plans DAP manifests against a snapshot of cluster objects without contacting a
+// cluster, printing each DAP with its computed status followed by the objects the controller
+// would create or update for it. Output is sorted so it can be diffed between revisions in CI.
+func render(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	namespace := fs.String("n", "default", "namespace for manifests that do not set one")
+	file := fs.String("f", "", "manifest containing the DynamicAuthorizationPolicies to render")
+	snapshot := fs.String("s", "", "manifest containing the Pods, Services, Namespaces and mesh objects to plan against")
+	maxPrincipals := fs.Int("max-principals", 0, "principals a policy may grant unless it sets maxPrincipals; zero means unlimited")
+	sidecarEgress := fs.Bool("sidecar-egress", false, "plan Sidecars, as a controller with the SidecarEgress feature gate does")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	daps, err := readDAPs(*file, *namespace)
+	if err != nil {
+		return err
+	}
+	objs, err := readSnapshot(*snapshot, *namespace)
+	if err != nil {
+		return err
+	}
+	r := &controllers.DynamicAuthorizationPolicyReconciler{
+		Client:        fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		Scheme:        scheme,
+		MaxPrincipals: *maxPrincipals,
+		SidecarEgress: *sidecarEgress,
+	}
+
+	sort.Slice(daps, func(i, j int) bool {
+		return client.ObjectKeyFromObject(&daps[i]).String() < client.ObjectKeyFromObject(&daps[j]).String()
+	})
+	docs := []interface{}{}
+	for i := range daps {
+		dap := &daps[i]
+		planned, err := r.Plan(ctx, dap)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, dap)
+		for _, change := range planned {
+			if change.Object != nil {
+				docs = append(docs, change.Object.Object)
+			}
+		}
+	}
+	return writeDocuments(c.out, docs)
+}
+
+// readSnapshot decodes every object in a multi-document YAML or JSON file, expanding lists
+// such as the output of "kubectl get -o yaml".
+func readSnapshot(path, namespace string) ([]client.Object, error) {
+	if path == "" {
+		return nil, errors.New("a snapshot must be provided with -s")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open %s", path)
+	}
+	defer f.Close()
+
+	objs := []client.Object{}
+	decoder := utilyaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		u := &unstructured.Unstructured{}
+		if err := decoder.Decode(&u.Object); err != nil {
+			if errors.Is(err, io.EOF) {
+				return objs, nil
+			}
+			return nil, errors.Wrapf(err, "unable to decode %s", path)
+		}
+		if len(u.Object) == 0 {
+			continue
+		}
+		items := []*unstructured.Unstructured{u}
+		if u.IsList() {
+			items = items[:0]
+			err := u.EachListItem(func(obj runtime.Object) error {
+				items = append(items, obj.(*unstructured.Unstructured)) // nolint:forcetypeassert
+				return nil
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to read list in %s", path)
+			}
+		}
+		for _, item := range items {
+			obj, err := typedObject(item, namespace)
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, obj)
+		}
+	}
+}
+
+// typedObject converts a snapshot object to its Go type. Kinds outside the scheme, such as the
+// mesh's Sidecars and AuthorizationPolicies, are kept unstructured, as the controller reads them.
+func typedObject(u *unstructured.Unstructured, namespace string) (client.Object, error) {
+	gvk := u.GroupVersionKind()
+	if gvk.Kind == "" {
+		return nil, errors.Errorf("snapshot object %s has no kind", u.GetName())
+	}
+	if !scheme.Recognizes(gvk) {
+		if u.GetNamespace() == "" {
+			u.SetNamespace(namespace)
+		}
+		return u, nil
+	}
+	typed, err := scheme.New(gvk)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unsupported snapshot object %s", gvk)
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, typed); err != nil {
+		return nil, errors.Wrapf(err, "unable to convert %s %s", gvk.Kind, u.GetName())
+	}
+	obj, ok := typed.(client.Object)
+	if !ok {
+		return nil, errors.Errorf("snapshot object %s is not a Kubernetes object", gvk)
+	}
+	if obj.GetNamespace() == "" && gvk.Kind != "Namespace" {
+		obj.SetNamespace(namespace)
+	}
+	return obj, nil
+}
+
+func writeDocuments(out io.Writer, docs []interface{}) error {
+	for i, doc := range docs {
+		b, err := yaml.Marshal(doc)
+		if err != nil {
+			return errors.Wrap(err, "unable to marshal output")
+		}
+		if i > 0 {
+			if _, err := io.WriteString(out, "---\n"); err != nil {
+				return errors.Wrap(err, "unable to write output")
+			}
+		}
+		if _, err := out.Write(b); err != nil {
+			return errors.Wrap(err, "unable to write output")
+		}
+	}
+	return nil
+}
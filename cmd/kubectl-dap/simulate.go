@@ -0,0 +1,59 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+
+	"github.com/aweis89/istio-dynamic-principles/controllers"
+)
+
+// simulate prints the status the controller would write for a DAP manifest without applying it.
+func simulate(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	namespace := fs.String("n", "default", "namespace for manifests that do not set one")
+	file := fs.String("f", "", "manifest containing the DynamicAuthorizationPolicy to simulate")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	dap, err := readDAP(*file, *namespace)
+	if err != nil {
+		return err
+	}
+
+	k8sClient, err := c.newClient()
+	if err != nil {
+		return err
+	}
+	res, err := controllers.Resolve(ctx, k8sClient, dap, nil)
+	if err != nil {
+		return err
+	}
+	dap.Status.ServiceAccountPolicyMapping = res.Mapping
+
+	out, err := yaml.Marshal(dap.Status)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal status")
+	}
+	_, err = c.out.Write(out)
+	return errors.Wrap(err, "unable to write output")
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+)
+
+// whoCanCall lists the principals currently granted by every policy protecting the pods of a
+// workload. AuthorizationPolicies only apply in their own namespace, so the DAPs in the
+// workload's namespace are searched and each policy's WorkloadSelector is matched against the
+// workload's pods.
+func whoCanCall(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("who-can-call", flag.ContinueOnError)
+	namespace := fs.String("n", "default", "namespace of the workload")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("who-can-call requires exactly one workload")
+	}
+
+	k8sClient, err := c.newClient()
+	if err != nil {
+		return err
+	}
+	pods, err := workloadPods(ctx, k8sClient, *namespace, positional[0])
+	if err != nil {
+		return err
+	}
+	daps := peerauthv1.DynamicAuthorizationPolicyList{}
+	if err := k8sClient.List(ctx, &daps, client.InNamespace(*namespace)); err != nil {
+		return errors.Wrap(err, "unable to list DynamicAuthorizationPolicies")
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DAP\tPOLICY\tPRINCIPAL")
+	found := false
+	for _, dap := range daps.Items {
+		for _, policy := range dap.GetPolicies() {
+			if !protects(policy, pods) {
+				continue
+			}
+			found = true
+			for _, principal := range dap.Status.ServiceAccountPolicyMapping[policy.Name].Slice() {
+				fmt.Fprintf(w, "%s/%s\t%s\t%s\n", dap.Namespace, dap.Name, policy.Name, principal)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "unable to write output")
+	}
+	if !found {
+		return errors.Errorf("no DynamicAuthorizationPolicy in namespace %s protects %s", *namespace, positional[0])
+	}
+	return nil
+}
+
+// protects reports whether the policy's WorkloadSelector selects any of the pods. An empty
+// WorkloadSelector protects every workload in the namespace.
+func protects(policy peerauthv1.DynamicPolicy, pods []corev1.Pod) bool {
+	selector := labels.SelectorFromSet(policy.WorkloadSelector)
+	for _, pod := range pods {
+		if selector.Matches(labels.Set(pod.Labels)) {
+			return true
+		}
+	}
+	return false
+}
+
+// workloadPods returns the pods of a workload given as [kind/]name, where kind is deployment
+// (the default), statefulset, daemonset or pod.
+func workloadPods(ctx context.Context, c client.Client, namespace, workload string) ([]corev1.Pod, error) {
+	kind, name := "deployment", workload
+	if i := strings.Index(workload, "/"); i >= 0 {
+		kind, name = strings.ToLower(workload[:i]), workload[i+1:]
+	}
+	key := client.ObjectKey{Namespace: namespace, Name: name}
+
+	var selector *metav1.LabelSelector
+	switch kind {
+	case "pod", "pods", "po":
+		pod := corev1.Pod{}
+		if err := c.Get(ctx, key, &pod); err != nil {
+			return nil, errors.Wrapf(err, "unable to get pod %s", key)
+		}
+		return []corev1.Pod{pod}, nil
+	case "deployment", "deployments", "deploy":
+		deployment := appsv1.Deployment{}
+		if err := c.Get(ctx, key, &deployment); err != nil {
+			return nil, errors.Wrapf(err, "unable to get deployment %s", key)
+		}
+		selector = deployment.Spec.Selector
+	case "statefulset", "statefulsets", "sts":
+		statefulSet := appsv1.StatefulSet{}
+		if err := c.Get(ctx, key, &statefulSet); err != nil {
+			return nil, errors.Wrapf(err, "unable to get statefulset %s", key)
+		}
+		selector = statefulSet.Spec.Selector
+	case "daemonset", "daemonsets", "ds":
+		daemonSet := appsv1.DaemonSet{}
+		if err := c.Get(ctx, key, &daemonSet); err != nil {
+			return nil, errors.Wrapf(err, "unable to get daemonset %s", key)
+		}
+		selector = daemonSet.Spec.Selector
+	default:
+		return nil, errors.Errorf("unsupported workload kind %q", kind)
+	}
+
+	podSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid selector of %s", workload)
+	}
+	pods := corev1.PodList{}
+	err = c.List(ctx, &pods, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: podSelector})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list pods of %s", workload)
+	}
+	if len(pods.Items) == 0 {
+		return nil, errors.Errorf("%s has no pods", workload)
+	}
+	return pods.Items, nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// fieldManager is the field manager the controller applies the objects it writes with, so other
+// managers can co-own their fields and changes to the controller's fields are reverted.
+const fieldManager = "dynamic-authorization-policy-controller"
+
+// apply server-side applies obj, which must hold only the fields manager owns, forcing
+// ownership of any of them changed by another manager.
+func (r *DynamicAuthorizationPolicyReconciler) apply(ctx context.Context, obj client.Object, manager string) error {
+	return r.Patch(ctx, obj, client.Apply, client.FieldOwner(manager), client.ForceOwnership)
+}
+
+// applyGenerated applies an object generated for a DAP, annotated with its generated hash.
+func (r *DynamicAuthorizationPolicyReconciler) applyGenerated(ctx context.Context, obj *unstructured.Unstructured) error {
+	obj = obj.DeepCopy()
+	setGeneratedHash(obj)
+	return r.apply(ctx, obj, fieldManager)
+}
+
+// applyOwned applies a generated object controlled by the DAP.
+func (r *DynamicAuthorizationPolicyReconciler) applyOwned(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy, obj *unstructured.Unstructured) error {
+	obj = obj.DeepCopy()
+	if err := controllerutil.SetControllerReference(dap, obj, r.Scheme); err != nil {
+		return errors.Wrapf(err, "unable to set %s owner", obj.GetKind())
+	}
+	return r.applyGenerated(ctx, obj)
+}
+
+// applyStatus applies the DAP's status through its status subresource, which only the
+// controller may write, so granted principals cannot be forged by editing the DAP. The DAP's
+// resourceVersion is applied as a precondition, so a status computed from a stale DAP conflicts
+// and a deleted DAP is not recreated.
+func (r *DynamicAuthorizationPolicyReconciler) applyStatus(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy) error {
+	status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&dap.Status)
+	if err != nil {
+		return errors.Wrap(err, "unable to convert status")
+	}
+	for field, value := range status {
+		if value == nil {
+			delete(status, field)
+		}
+	}
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"status": status}}
+	obj.SetGroupVersionKind(peerauthv1.GroupVersion.WithKind("DynamicAuthorizationPolicy"))
+	obj.SetName(dap.GetName())
+	obj.SetNamespace(dap.GetNamespace())
+	obj.SetResourceVersion(dap.GetResourceVersion())
+	return r.Status().Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+}
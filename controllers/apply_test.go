@@ -0,0 +1,521 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// applyClient approximates server-side apply, which the fake client does not support, for
+// objects each field of which has a single manager: an apply creates the object or merge
+// patches it, removing the fields the manager applied last time but no longer does.
+type applyClient struct {
+	client.Client
+
+	mu sync.Mutex
+	// applied holds the last configuration each manager applied to each object.
+	applied map[appliedKey]map[string]interface{}
+	// managers holds, in order, the managers each object was applied with.
+	managers map[appliedObject][]string
+}
+
+type appliedObject struct {
+	gvk schema.GroupVersionKind
+	key client.ObjectKey
+}
+
+type appliedKey struct {
+	appliedObject
+	manager string
+}
+
+func newApplyClient(c client.Client) *applyClient {
+	return &applyClient{
+		Client:   c,
+		applied:  map[appliedKey]map[string]interface{}{},
+		managers: map[appliedObject][]string{},
+	}
+}
+
+func (c *applyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch != client.Apply {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+	patchOpts := client.PatchOptions{}
+	patchOpts.ApplyOptions(opts)
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err != nil {
+		return err
+	}
+	config, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	object := appliedObject{gvk: gvk, key: client.ObjectKeyFromObject(obj)}
+	key := appliedKey{appliedObject: object, manager: patchOpts.FieldManager}
+
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(gvk)
+	if err := c.Get(ctx, object.key, existing); kerrors.IsNotFound(err) {
+		if obj.GetResourceVersion() != "" {
+			return err
+		}
+		if err := c.Create(ctx, &unstructured.Unstructured{Object: runtime.DeepCopyJSON(config)}); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		c.mu.Lock()
+		previous := c.applied[key]
+		c.mu.Unlock()
+		data, err := json.Marshal(withRemovals(config, previous))
+		if err != nil {
+			return err
+		}
+		if err := c.Client.Patch(ctx, obj, client.RawPatch(client.Merge.Type(), data)); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.applied[key] = config
+	c.managers[object] = append(c.managers[object], patchOpts.FieldManager)
+	return nil
+}
+
+// Status applies to the status subresource through the same emulation, since the fake client
+// keeps status with the rest of the object.
+func (c *applyClient) Status() client.StatusWriter {
+	return applyStatusWriter{c}
+}
+
+type applyStatusWriter struct {
+	c *applyClient
+}
+
+func (w applyStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return w.c.Client.Status().Update(ctx, obj, opts...)
+}
+
+func (w applyStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch != client.Apply {
+		return w.c.Client.Status().Patch(ctx, obj, patch, opts...)
+	}
+	return w.c.Patch(ctx, obj, patch, opts...)
+}
+
+// withRemovals returns a merge patch of config deleting the fields only in previous.
+func withRemovals(config, previous map[string]interface{}) map[string]interface{} {
+	patch := map[string]interface{}{}
+	for k, v := range config {
+		patch[k] = v
+	}
+	for k, v := range previous {
+		current, ok := config[k]
+		if !ok {
+			patch[k] = nil
+			continue
+		}
+		previousMap, ok := v.(map[string]interface{})
+		currentMap, ok2 := current.(map[string]interface{})
+		if ok && ok2 {
+			patch[k] = withRemovals(currentMap, previousMap)
+		}
+	}
+	return patch
+}
+
+// appliedBy returns the managers obj was applied with, in order.
+func (c *applyClient) appliedBy(obj client.Object) []string {
+	gvk, _ := apiutil.GVKForObject(obj, c.Scheme())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.managers[appliedObject{gvk: gvk, key: client.ObjectKeyFromObject(obj)}]
+}
+
+// applies returns the number of times obj was applied.
+func (c *applyClient) applies(obj client.Object) int {
+	return len(c.appliedBy(obj))
+}
+
+// reconcilerTest runs a DynamicAuthorizationPolicyReconciler against a fake client seeded with
+// objects, applying through applyClient. Tests set the reconciler's options before reconciling.
+type reconcilerTest struct {
+	*DynamicAuthorizationPolicyReconciler
+	t        *testing.T
+	c        *applyClient
+	recorder *record.FakeRecorder
+}
+
+func newReconcilerTest(t *testing.T, objs ...client.Object) *reconcilerTest {
+	t.Helper()
+	c := newApplyClient(fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(objs...).Build())
+	recorder := record.NewFakeRecorder(100)
+	return &reconcilerTest{
+		DynamicAuthorizationPolicyReconciler: &DynamicAuthorizationPolicyReconciler{
+			Client: c, Scheme: c.Scheme(), Recorder: recorder,
+		},
+		t:        t,
+		c:        c,
+		recorder: recorder,
+	}
+}
+
+// reconcileDAP reconciles dap, failing the test on error, and returns the DAP as stored
+// afterwards, or nil once it is gone.
+func (rt *reconcilerTest) reconcileDAP(dap client.Object) *peerauthv1.DynamicAuthorizationPolicy {
+	rt.t.Helper()
+	ctx := context.Background()
+	if _, err := rt.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(dap)}); err != nil {
+		rt.t.Fatal(err)
+	}
+	got := &peerauthv1.DynamicAuthorizationPolicy{}
+	if err := rt.c.Get(ctx, client.ObjectKeyFromObject(dap), got); err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil
+		}
+		rt.t.Fatal(err)
+	}
+	return got
+}
+
+// get reads the object of kind gvk with key.
+func (rt *reconcilerTest) get(gvk schema.GroupVersionKind, key client.ObjectKey) (*unstructured.Unstructured, error) {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	return obj, rt.c.Get(context.Background(), key, obj)
+}
+
+// update applies edit to the stored DAP and writes it back.
+func (rt *reconcilerTest) update(dap client.Object, edit func(*peerauthv1.DynamicAuthorizationPolicy)) {
+	rt.t.Helper()
+	ctx := context.Background()
+	got := &peerauthv1.DynamicAuthorizationPolicy{}
+	if err := rt.c.Get(ctx, client.ObjectKeyFromObject(dap), got); err != nil {
+		rt.t.Fatal(err)
+	}
+	edit(got)
+	if err := rt.c.Update(ctx, got); err != nil {
+		rt.t.Fatal(err)
+	}
+}
+
+func TestReconcileAppliesWithFieldManager(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "default"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:             "policy",
+				TrustDomain:      "cluster.local",
+				PodSelectors:     map[string]string{"app": "caller"},
+				WorkloadSelector: map[string]string{"app": "api"},
+			}},
+		},
+	}
+	rt := newReconcilerTest(t, dap)
+	c := rt.c
+	rt.reconcileDAP(dap)
+
+	ap := &unstructured.Unstructured{}
+	ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+	key := client.ObjectKey{Namespace: "default", Name: "policy"}
+	if err := c.Get(ctx, key, ap); err != nil {
+		t.Fatal(err)
+	}
+	if managers := c.appliedBy(ap); !reflect.DeepEqual(managers, []string{fieldManager}) {
+		t.Errorf("AuthorizationPolicy applied by %v, want %s", managers, fieldManager)
+	}
+	if managers := c.appliedBy(dap); !reflect.DeepEqual(managers, []string{finalizerFieldManager, fieldManager}) {
+		t.Errorf("DAP applied by %v, want the finalizer then status applied by their own managers", managers)
+	}
+
+	// Fields co-owned by other managers are left alone.
+	annotations := ap.GetAnnotations()
+	annotations["argocd.argoproj.io/tracking-id"] = "app"
+	ap.SetAnnotations(annotations)
+	if err := unstructured.SetNestedField(ap.Object, "dry-run", "spec", "provider"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Update(ctx, ap); err != nil {
+		t.Fatal(err)
+	}
+	rt.reconcileDAP(dap)
+	if applies := c.applies(ap); applies != 1 {
+		t.Errorf("AuthorizationPolicy applied %d times, want fields of other managers ignored", applies)
+	}
+
+	// Drift on the controller's fields is reverted.
+	if err := c.Get(ctx, key, ap); err != nil {
+		t.Fatal(err)
+	}
+	if err := unstructured.SetNestedField(ap.Object, "DENY", "spec", "action"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Update(ctx, ap); err != nil {
+		t.Fatal(err)
+	}
+	rt.reconcileDAP(dap)
+	if err := c.Get(ctx, key, ap); err != nil {
+		t.Fatal(err)
+	}
+	if action, _, _ := unstructured.NestedString(ap.Object, "spec", "action"); action != "ALLOW" {
+		t.Errorf("action = %q, want drift reverted to ALLOW", action)
+	}
+	if ap.GetAnnotations()["argocd.argoproj.io/tracking-id"] != "app" {
+		t.Errorf("annotations = %v, want other managers' fields kept", ap.GetAnnotations())
+	}
+}
+
+func TestReconcileRefusesUnownedObjects(t *testing.T) {
+	t.Parallel()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "default", UID: "dap-uid"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{
+				{
+					Name: "handwritten", TrustDomain: "cluster.local",
+					PodSelectors: map[string]string{"app": "caller"}, WorkloadSelector: map[string]string{"app": "api"},
+				},
+				{
+					Name: "other", TrustDomain: "cluster.local",
+					PodSelectors: map[string]string{"app": "caller"}, WorkloadSelector: map[string]string{"app": "api"},
+				},
+			},
+		},
+	}
+	handwritten := &unstructured.Unstructured{}
+	handwritten.SetGroupVersionKind(AuthorizationPolicyGVK)
+	handwritten.SetNamespace("default")
+	handwritten.SetName("handwritten")
+	handwritten.Object["spec"] = map[string]interface{}{"action": "DENY"}
+	controller := true
+	other := handwritten.DeepCopy()
+	other.SetName("other")
+	other.SetLabels(map[string]string{dapLabel: "dap"})
+	other.SetOwnerReferences([]metav1.OwnerReference{{
+		APIVersion: peerauthv1.GroupVersion.String(), Kind: "DynamicAuthorizationPolicy",
+		Name: "dap", UID: "other-dap-uid", Controller: &controller,
+	}})
+	rt := newReconcilerTest(t, dap, handwritten, other)
+	c := rt.c
+	got := rt.reconcileDAP(dap)
+
+	for _, obj := range []*unstructured.Unstructured{handwritten, other} {
+		ap, err := rt.get(AuthorizationPolicyGVK, client.ObjectKeyFromObject(obj))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action, _, _ := unstructured.NestedString(ap.Object, "spec", "action"); action != "DENY" {
+			t.Errorf("AuthorizationPolicy %s action = %q, want it left untouched", ap.GetName(), action)
+		}
+		if c.applies(ap) != 0 {
+			t.Errorf("AuthorizationPolicy %s was applied", ap.GetName())
+		}
+	}
+	if !meta.IsStatusConditionFalse(got.Status.Conditions, peerauthv1.ConditionObjectsOwned) {
+		t.Errorf("conditions = %+v, want ObjectsOwned False", got.Status.Conditions)
+	}
+	found := false
+	for len(rt.recorder.Events) > 0 {
+		found = found || strings.Contains(<-rt.recorder.Events, reasonObjectNotOwned)
+	}
+	if !found {
+		t.Error("no ObjectNotOwned event recorded")
+	}
+}
+
+var _ = Describe("Server-side apply", func() {
+	It("takes back ownership of generated fields another manager applied", func() {
+		if useFakeClient {
+			Skip("field ownership is only tracked by a real API server")
+		}
+		ctx := context.Background()
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "server-side-apply"}}
+		Expect(k8sClient.Create(ctx, namespace)).Should(Succeed())
+		labels := map[string]string{"app": "server-side-apply"}
+		Expect(k8sClient.Create(ctx, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: namespace.Name, Labels: labels},
+			Spec: corev1.PodSpec{
+				Containers:         []corev1.Container{{Image: "image", Name: "container"}},
+				ServiceAccountName: "caller",
+			},
+		})).Should(Succeed())
+		Expect(k8sClient.Create(ctx, &peerauthv1.DynamicAuthorizationPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: namespace.Name},
+			Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+				DynamicPolicies: []peerauthv1.DynamicPolicy{{Name: "policy", TrustDomain: "cluster.local", PodSelectors: labels}},
+			},
+		})).Should(Succeed())
+
+		key := client.ObjectKey{Namespace: namespace.Name, Name: "policy"}
+		granted := "cluster.local/ns/server-side-apply/sa/caller"
+		principals := func(g Gomega) (peerauthv1.HashSet, *unstructured.Unstructured) {
+			ap := &unstructured.Unstructured{}
+			ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+			g.Expect(k8sClient.Get(ctx, key, ap)).To(Succeed())
+			return authorizationPolicyPrincipals(ap), ap
+		}
+		Eventually(func(g Gomega) {
+			got, _ := principals(g)
+			g.Expect(got.Slice()).To(ConsistOf(granted))
+		}, timeout, interval).Should(Succeed())
+
+		intruder := &unstructured.Unstructured{}
+		intruder.SetGroupVersionKind(AuthorizationPolicyGVK)
+		intruder.SetName(key.Name)
+		intruder.SetNamespace(key.Namespace)
+		intruder.Object["spec"] = authorizationPolicySpec(peerauthv1.DynamicPolicy{},
+			peerauthv1.HashSet{"cluster.local/ns/elsewhere/sa/intruder": true})
+		Expect(k8sClient.Patch(ctx, intruder, client.Apply,
+			client.FieldOwner("intruder"), client.ForceOwnership)).Should(Succeed())
+
+		Eventually(func(g Gomega) {
+			got, ap := principals(g)
+			g.Expect(got.Slice()).To(ConsistOf(granted))
+			owners := []string{}
+			for _, entry := range ap.GetManagedFields() {
+				if entry.FieldsV1 != nil && strings.Contains(string(entry.FieldsV1.Raw), `"f:rules"`) {
+					owners = append(owners, entry.Manager)
+				}
+			}
+			g.Expect(owners).To(ConsistOf(fieldManager))
+		}, timeout, interval).Should(Succeed())
+	})
+})
+
+var _ = Describe("Backends", func() {
+	// ownedBy returns the managers that applied the object's spec.
+	ownedBy := func(obj client.Object, subresource string) []string {
+		owners := []string{}
+		for _, entry := range obj.GetManagedFields() {
+			if entry.Operation == metav1.ManagedFieldsOperationApply && entry.Subresource == subresource {
+				owners = append(owners, entry.Manager)
+			}
+		}
+		return owners
+	}
+	createCaller := func(ctx context.Context, namespace string, labels map[string]string) {
+		Expect(k8sClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})).Should(Succeed())
+		Expect(k8sClient.Create(ctx, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: namespace, Labels: labels},
+			Spec: corev1.PodSpec{
+				Containers:         []corev1.Container{{Image: "image", Name: "container"}},
+				ServiceAccountName: "caller",
+			},
+		})).Should(Succeed())
+	}
+
+	It("applies NetworkPolicies and Linkerd objects as the controller's field manager", func() {
+		if useFakeClient {
+			Skip("field ownership is only tracked by a real API server")
+		}
+		ctx := context.Background()
+		namespace := "backends"
+		labels := map[string]string{"app": "backends"}
+		createCaller(ctx, namespace, labels)
+		Expect(k8sClient.Create(ctx, &peerauthv1.DynamicAuthorizationPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: namespace},
+			Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+				Backends:        []peerauthv1.Backend{peerauthv1.BackendNetworkPolicy, peerauthv1.BackendLinkerd},
+				DynamicPolicies: []peerauthv1.DynamicPolicy{{Name: "policy", TrustDomain: "cluster.local", PodSelectors: labels}},
+			},
+		})).Should(Succeed())
+
+		key := client.ObjectKey{Namespace: namespace, Name: "policy"}
+		granted := "cluster.local/ns/backends/sa/caller"
+		for _, check := range []struct {
+			gvk     schema.GroupVersionKind
+			backend Backend
+		}{
+			{NetworkPolicyGVK, networkPolicyBackend{}},
+			{MeshTLSAuthenticationGVK, linkerdBackend{}},
+			{LinkerdAuthorizationPolicyGVK, linkerdBackend{}},
+		} {
+			Eventually(func(g Gomega) {
+				obj := &unstructured.Unstructured{}
+				obj.SetGroupVersionKind(check.gvk)
+				g.Expect(k8sClient.Get(ctx, key, obj)).To(Succeed())
+				g.Expect(ownedBy(obj, "")).To(ConsistOf(fieldManager), check.gvk.Kind)
+				if check.gvk != LinkerdAuthorizationPolicyGVK {
+					g.Expect(check.backend.Principals(obj).Slice()).To(ConsistOf(granted), check.gvk.Kind)
+				}
+			}, timeout, interval).Should(Succeed())
+		}
+	})
+
+	It("writes backends and merged rules through the status subresource", func() {
+		if useFakeClient {
+			Skip("the status subresource is only enforced by a real API server")
+		}
+		ctx := context.Background()
+		namespace := "status-subresource"
+		labels := map[string]string{"app": "status-subresource"}
+		createCaller(ctx, namespace, labels)
+		handwritten := &unstructured.Unstructured{}
+		handwritten.SetGroupVersionKind(AuthorizationPolicyGVK)
+		handwritten.SetName("handwritten")
+		handwritten.SetNamespace(namespace)
+		handwritten.Object["spec"] = map[string]interface{}{"rules": []interface{}{map[string]interface{}{
+			"to": []interface{}{map[string]interface{}{"operation": map[string]interface{}{"methods": []interface{}{"GET"}}}},
+		}}}
+		Expect(k8sClient.Create(ctx, handwritten)).Should(Succeed())
+		index := int32(0)
+		ref := peerauthv1.AuthorizationPolicyRuleRef{Name: handwritten.GetName(), Index: &index}
+		dap := &peerauthv1.DynamicAuthorizationPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: namespace},
+			Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+				DynamicPolicies: []peerauthv1.DynamicPolicy{{
+					Name: "merged", TrustDomain: "cluster.local", PodSelectors: labels, AuthorizationPolicyRule: &ref,
+				}},
+			},
+		}
+		Expect(k8sClient.Create(ctx, dap)).Should(Succeed())
+
+		Eventually(func(g Gomega) {
+			got := &peerauthv1.DynamicAuthorizationPolicy{}
+			g.Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(dap), got)).To(Succeed())
+			g.Expect(got.Status.Backends).To(ConsistOf(peerauthv1.BackendIstio))
+			g.Expect(got.Status.MergedRules).To(ConsistOf(ref))
+			g.Expect(ownedBy(got, "status")).To(ConsistOf(fieldManager))
+			g.Expect(ownedBy(got, "")).NotTo(ContainElement(fieldManager))
+		}, timeout, interval).Should(Succeed())
+	})
+})
@@ -0,0 +1,388 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AuditAction is the access change recorded by an AuditRecord.
+type AuditAction string
+
+const (
+	AuditGrant  AuditAction = "Grant"
+	AuditRevoke AuditAction = "Revoke"
+)
+
+// AuditRecord describes a single principal granted or revoked by a generated policy.
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	DAP    string    `json:"dap"`
+	Policy string    `json:"policy"`
+	// Object is the object granting the principal, as Kind.group name.
+	Object    string      `json:"object"`
+	Principal string      `json:"principal"`
+	Action    AuditAction `json:"action"`
+	// TriggeringPod is a pod contributing the principal for grants, and the most recent pod
+	// change that triggered the reconcile for revocations.
+	TriggeringPod string `json:"triggeringPod,omitempty"`
+	// PreviousSetHash and NextSetHash identify the policy's principal set before and after the change.
+	PreviousSetHash string `json:"previousSetHash"`
+	NextSetHash     string `json:"nextSetHash"`
+	// PreviousRecordHash is the Hash of the record written before this one by the same sink,
+	// chaining records so that editing or dropping one is detectable.
+	PreviousRecordHash string `json:"previousRecordHash"`
+	// Hash covers every other field of the record.
+	Hash string `json:"hash"`
+}
+
+// AuditSink persists audit records.
+type AuditSink interface {
+	Record(ctx context.Context, records []AuditRecord) error
+}
+
+// principalSetHash returns a stable digest of a set of principals.
+func principalSetHash(principals peerauthv1.HashSet) string {
+	sum := sha256.Sum256([]byte(strings.Join(principals.Slice(), "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// auditRecords builds one record per principal granted or revoked by the applied changes.
+func auditRecords(dap *peerauthv1.DynamicAuthorizationPolicy, applied []authorizationPolicyChange,
+	contributors Contributors, trigger types.NamespacedName, now time.Time) []AuditRecord {
+	records := []AuditRecord{}
+	for _, change := range applied {
+		before, after := change.principals()
+		intended := change.intended()
+		record := AuditRecord{
+			Time:            now,
+			DAP:             client.ObjectKeyFromObject(dap).String(),
+			Policy:          intended.Name,
+			Object:          intended.Object(),
+			PreviousSetHash: principalSetHash(before),
+			NextSetHash:     principalSetHash(after),
+		}
+		for _, principal := range intended.AddedPrincipals {
+			record.Principal, record.Action, record.TriggeringPod = principal, AuditGrant, ""
+			if pods := contributors.Pods(intended.Name, principal); len(pods) > 0 {
+				record.TriggeringPod = pods[0].String()
+			}
+			records = append(records, record)
+		}
+		for _, principal := range intended.RemovedPrincipals {
+			record.Principal, record.Action, record.TriggeringPod = principal, AuditRevoke, ""
+			if trigger.Name != "" {
+				record.TriggeringPod = trigger.String()
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// audit sends records for the applied changes to the reconciler's sink. Failures are logged
+// and counted rather than retried, since the changes themselves have already been applied.
+func (r *DynamicAuthorizationPolicyReconciler) audit(ctx context.Context, dap *peerauthv1.DynamicAuthorizationPolicy,
+	applied []authorizationPolicyChange, contributors Contributors) {
+	if r.Audit == nil {
+		return
+	}
+	key := client.ObjectKeyFromObject(dap)
+	records := auditRecords(dap, applied, contributors, pendingPodChanges.lastPod(key), time.Now().UTC())
+	if len(records) == 0 {
+		return
+	}
+	if err := r.Audit.Record(ctx, records); err != nil {
+		observeReconcileError(withReason(errorReasonAudit, err))
+		ctrl.LoggerFrom(ctx).Error(err, "unable to record audit log", "DynamicAuthorizationPolicy", key)
+	}
+}
+
+// hashChain links each record to the one before it.
+type hashChain struct {
+	mu   sync.Mutex
+	last string
+}
+
+// seal sets the chain and record hashes on records, in order, chaining them to the last record
+// that was delivered. The chain only advances once the sealed records are delivered.
+func (c *hashChain) seal(records []AuditRecord) ([]AuditRecord, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sealed := make([]AuditRecord, 0, len(records))
+	last := c.last
+	for _, record := range records {
+		record.PreviousRecordHash = last
+		record.Hash = ""
+		b, err := json.Marshal(record)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to marshal audit record")
+		}
+		sum := sha256.Sum256(b)
+		record.Hash = hex.EncodeToString(sum[:])
+		last = record.Hash
+		sealed = append(sealed, record)
+	}
+	return sealed, nil
+}
+
+// advance records that the sealed records were delivered.
+func (c *hashChain) advance(sealed []AuditRecord) {
+	if len(sealed) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = sealed[len(sealed)-1].Hash
+}
+
+// JSONLinesAuditSink writes each record as a line of JSON.
+type JSONLinesAuditSink struct {
+	chain hashChain
+	mu    sync.Mutex
+	w     io.Writer
+}
+
+func NewJSONLinesAuditSink(w io.Writer) *JSONLinesAuditSink {
+	return &JSONLinesAuditSink{w: w}
+}
+
+// NewFileAuditSink appends records to the file at path, or writes them to stdout when path is "-".
+// Records continue the chain of those already in the file.
+func NewFileAuditSink(path string) (*JSONLinesAuditSink, error) {
+	if path == "-" {
+		return NewJSONLinesAuditSink(os.Stdout), nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open audit log %s", path)
+	}
+	last, err := lastRecordHash(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "unable to read audit log %s", path)
+	}
+	sink := NewJSONLinesAuditSink(f)
+	sink.chain.last = last
+	return sink, nil
+}
+
+// auditTailChunk is how much of an audit log is read at a time when looking for its last record.
+const auditTailChunk = 4096
+
+// lastRecordHash returns the hash of the last record in an audit log, reading it backwards so
+// large logs are not read in full.
+func lastRecordHash(f *os.File) (string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	end := info.Size()
+	tail := []byte{}
+	for end > 0 {
+		start := end - auditTailChunk
+		if start < 0 {
+			start = 0
+		}
+		chunk := make([]byte, end-start)
+		if _, err := f.ReadAt(chunk, start); err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		tail = append(chunk, tail...)
+		end = start
+		trimmed := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 || end == 0 {
+			line := trimmed[i+1:]
+			if len(line) == 0 {
+				return "", nil
+			}
+			record := AuditRecord{}
+			if err := json.Unmarshal(line, &record); err != nil {
+				return "", errors.Wrap(err, "unable to decode last audit record")
+			}
+			return record.Hash, nil
+		}
+	}
+	return "", nil
+}
+
+func (s *JSONLinesAuditSink) Record(ctx context.Context, records []AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sealed, err := s.chain.seal(records)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	for _, record := range sealed {
+		if err := encoder.Encode(record); err != nil {
+			return errors.Wrap(err, "unable to encode audit record")
+		}
+	}
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		return errors.Wrap(err, "unable to write audit records")
+	}
+	s.chain.advance(sealed)
+	return nil
+}
+
+// maxPendingAuditRecords bounds the records a WebhookAuditSink buffers until its endpoint
+// accepts them.
+const maxPendingAuditRecords = 10000
+
+// WebhookAuditSink POSTs records as a JSON array to an HTTP endpoint. Record only queues them,
+// so reconciles never wait on the endpoint: the goroutine Start runs sends queued records as
+// they arrive, and resends batches the endpoint failed to accept, ahead of newer records,
+// every RetryInterval. When the queue is full the oldest records are dropped and counted by
+// dap_audit_records_dropped_total.
+type WebhookAuditSink struct {
+	chain hashChain
+	mu    sync.Mutex
+	// pending holds the queued records, the first of which is the first-th ever recorded.
+	pending []AuditRecord
+	first   int
+	// queued wakes Start when records are queued.
+	queued        chan struct{}
+	URL           string
+	Client        *http.Client
+	RetryInterval time.Duration
+}
+
+func NewWebhookAuditSink(url string) *WebhookAuditSink {
+	return &WebhookAuditSink{
+		URL:           url,
+		Client:        &http.Client{Timeout: 10 * time.Second},
+		RetryInterval: time.Minute,
+		queued:        make(chan struct{}, 1),
+	}
+}
+
+func (s *WebhookAuditSink) Record(ctx context.Context, records []AuditRecord) error {
+	s.mu.Lock()
+	s.pending = append(s.pending, records...)
+	dropped := 0
+	if len(s.pending) > maxPendingAuditRecords {
+		dropped = len(s.pending) - maxPendingAuditRecords
+		s.pending = append([]AuditRecord{}, s.pending[dropped:]...)
+		s.first += dropped
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.queued <- struct{}{}:
+	default:
+	}
+	if dropped > 0 {
+		auditRecordsDropped.Add(float64(dropped))
+		return errors.Errorf("dropped %d audit records the webhook did not accept in time", dropped)
+	}
+	return nil
+}
+
+// Start sends queued records until ctx is done, retrying every RetryInterval while the
+// endpoint fails.
+func (s *WebhookAuditSink) Start(ctx context.Context) error {
+	ticker := time.NewTicker(s.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.queued:
+		case <-ticker.C:
+		}
+		if err := s.flush(ctx); err != nil {
+			ctrl.LoggerFrom(ctx).Error(err, "unable to send audit records")
+		}
+	}
+}
+
+// flush sends the queued records, advancing the chain and forgetting them once the endpoint
+// accepts them. Only Start calls it, so the chain is never sealed concurrently, and the queue
+// is not locked while sending.
+func (s *WebhookAuditSink) flush(ctx context.Context) error {
+	s.mu.Lock()
+	batch, first := append([]AuditRecord{}, s.pending...), s.first
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	sealed, err := s.chain.seal(batch)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(sealed)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal audit records")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "unable to build audit webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "unable to send %d audit records", len(batch))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("audit webhook responded to %d records with %s", len(batch), resp.Status)
+	}
+	s.chain.advance(sealed)
+
+	// Forget the records sent, some of which may have been dropped meanwhile.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sent := first + len(batch) - s.first; sent > 0 {
+		s.pending = s.pending[sent:]
+		s.first += sent
+	}
+	return nil
+}
+
+// MultiAuditSink writes records to every sink, returning the first error.
+type MultiAuditSink []AuditSink
+
+func (m MultiAuditSink) Record(ctx context.Context, records []AuditRecord) error {
+	var firstErr error
+	for _, sink := range m {
+		if err := sink.Record(ctx, records); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
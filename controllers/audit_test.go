@@ -0,0 +1,315 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func testAuditRecords() []AuditRecord {
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "default"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{Name: "foo", TrustDomain: "cluster.local"}},
+		},
+	}
+	existing := AuthorizationPolicies(dap, peerauthv1.ServiceAccountPolicyMapping{
+		"foo": peerauthv1.FromSlice([]string{"old"}),
+	})[0]
+	desired := AuthorizationPolicies(dap, peerauthv1.ServiceAccountPolicyMapping{
+		"foo": peerauthv1.FromSlice([]string{"new"}),
+	})[0]
+	contributors := Contributors{}
+	contributors.add("foo", "new", types.NamespacedName{Namespace: "default", Name: "pod-new"})
+
+	return auditRecords(dap,
+		[]authorizationPolicyChange{{action: peerauthv1.ChangeUpdate, existing: existing, desired: desired}},
+		contributors, types.NamespacedName{Namespace: "default", Name: "pod-old"}, time.Unix(0, 0).UTC())
+}
+
+func verifyChain(t *testing.T, records []AuditRecord) {
+	t.Helper()
+	last := ""
+	for i, record := range records {
+		if record.PreviousRecordHash != last {
+			t.Fatalf("record %d previousRecordHash = %q, want %q", i, record.PreviousRecordHash, last)
+		}
+		hash := record.Hash
+		record.Hash = ""
+		b, err := json.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(b)
+		if got := hex.EncodeToString(sum[:]); got != hash {
+			t.Fatalf("record %d hash = %q, want %q", i, hash, got)
+		}
+		last = hash
+	}
+}
+
+func TestAuditRecords(t *testing.T) {
+	t.Parallel()
+	records := testAuditRecords()
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	grant, revoke := records[0], records[1]
+	if grant.Action != AuditGrant || grant.Principal != "new" || grant.TriggeringPod != "default/pod-new" {
+		t.Errorf("unexpected grant record %+v", grant)
+	}
+	if revoke.Action != AuditRevoke || revoke.Principal != "old" || revoke.TriggeringPod != "default/pod-old" {
+		t.Errorf("unexpected revoke record %+v", revoke)
+	}
+	if grant.PreviousSetHash != principalSetHash(peerauthv1.FromSlice([]string{"old"})) ||
+		grant.NextSetHash != principalSetHash(peerauthv1.FromSlice([]string{"new"})) {
+		t.Errorf("unexpected set hashes %+v", grant)
+	}
+}
+
+func TestJSONLinesAuditSink(t *testing.T) {
+	t.Parallel()
+	buf := &bytes.Buffer{}
+	sink := NewJSONLinesAuditSink(buf)
+	for i := 0; i < 2; i++ {
+		if err := sink.Record(context.Background(), testAuditRecords()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records := []AuditRecord{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		record := AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 4 {
+		t.Fatalf("got %d lines, want 4", len(records))
+	}
+	verifyChain(t, records)
+}
+
+// startWebhookAuditSink runs a WebhookAuditSink for the test, resending every few milliseconds.
+func startWebhookAuditSink(t *testing.T, url string) *WebhookAuditSink {
+	t.Helper()
+	sink := NewWebhookAuditSink(url)
+	sink.RetryInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = sink.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return sink
+}
+
+// webhookReceiver records the batches POSTed to it, failing requests while failing is set.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failing  bool
+	received []AuditRecord
+}
+
+func (w *webhookReceiver) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failing {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	batch := []AuditRecord{}
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.received = append(w.received, batch...)
+}
+
+// await waits for n records to be received, returning them.
+func (w *webhookReceiver) await(t *testing.T, n int) []AuditRecord {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w.mu.Lock()
+		received := append([]AuditRecord{}, w.received...)
+		w.mu.Unlock()
+		if len(received) >= n || time.Now().After(deadline) {
+			if len(received) != n {
+				t.Fatalf("webhook received %d records, want %d", len(received), n)
+			}
+			return received
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookAuditSink(t *testing.T) {
+	t.Parallel()
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	sink := startWebhookAuditSink(t, server.URL)
+	for i := 0; i < 2; i++ {
+		if err := sink.Record(context.Background(), testAuditRecords()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	verifyChain(t, receiver.await(t, 4))
+}
+
+func TestWebhookAuditSinkRetries(t *testing.T) {
+	t.Parallel()
+	receiver := &webhookReceiver{failing: true}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	sink := startWebhookAuditSink(t, server.URL)
+	if err := sink.Record(context.Background(), testAuditRecords()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := sink.Record(context.Background(), testAuditRecords()); err != nil {
+		t.Fatal(err)
+	}
+	receiver.mu.Lock()
+	receiver.failing = false
+	receiver.mu.Unlock()
+	verifyChain(t, receiver.await(t, 4))
+}
+
+func TestWebhookAuditSinkDoesNotBlockRecord(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	sink := startWebhookAuditSink(t, server.URL)
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := sink.Record(context.Background(), testAuditRecords()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Record waited %s on an endpoint that does not respond", elapsed)
+	}
+
+	records := make([]AuditRecord, maxPendingAuditRecords)
+	if err := sink.Record(context.Background(), records); err == nil {
+		t.Error("expected an error reporting the records dropped from a full queue")
+	}
+}
+
+func TestFileAuditSinkContinuesChain(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		sink, err := NewFileAuditSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Record(context.Background(), testAuditRecords()); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.w.(*os.File).Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records := []AuditRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 4 {
+		t.Fatalf("got %d lines, want 4", len(records))
+	}
+	verifyChain(t, records)
+}
+
+func TestLastRecordHash(t *testing.T) {
+	t.Parallel()
+	long := AuditRecord{Policy: strings.Repeat("p", 2*auditTailChunk), Hash: "long"}
+	tests := map[string]struct {
+		records []AuditRecord
+		want    string
+	}{
+		"empty":                   {want: ""},
+		"one record":              {records: []AuditRecord{{Hash: "a"}}, want: "a"},
+		"records":                 {records: []AuditRecord{{Hash: "a"}, {Hash: "b"}}, want: "b"},
+		"record longer than read": {records: []AuditRecord{{Hash: "a"}, long}, want: "long"},
+		"after long record":       {records: []AuditRecord{long, {Hash: "b"}}, want: "b"},
+	}
+	for name, tt := range tests {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		buf := &bytes.Buffer{}
+		for _, record := range tt.records {
+			if err := json.NewEncoder(buf).Encode(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := lastRecordHash(f)
+		f.Close()
+		if err != nil || got != tt.want {
+			t.Errorf("%s: lastRecordHash = %q, %v, want %q", name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// dapLabel is set on every generated resource to the name of the DAP that owns it.
+const dapLabel = "peerauth.aweis.io/dynamic-authorization-policy"
+
+// AuthorizationPolicyGVK is the Istio AuthorizationPolicy kind generated for each DynamicPolicy.
+// It is handled as unstructured so the controller does not depend on Istio's Go API.
+var AuthorizationPolicyGVK = schema.GroupVersionKind{ // nolint:gochecknoglobals
+	Group:   "security.istio.io",
+	Version: "v1beta1",
+	Kind:    "AuthorizationPolicy",
+}
+
+// AuthorizationPolicies builds the AuthorizationPolicy generated for each of the DAP's policies
+// from the given mapping, in spec order. Policies merged into user-authored AuthorizationPolicies
+// generate none, and neither do namespace-wide policies without principals: any ALLOW policy
+// denies what it does not match, so one would cut off every workload in the namespace.
+func AuthorizationPolicies(dap *peerauthv1.DynamicAuthorizationPolicy,
+	sapm peerauthv1.ServiceAccountPolicyMapping) []*unstructured.Unstructured {
+	aps := []*unstructured.Unstructured{}
+	for _, policy := range dap.GetPolicies() {
+		if policy.AuthorizationPolicyRule != nil {
+			continue
+		}
+		if len(policy.WorkloadSelector) == 0 && len(sapm[policy.Name]) == 0 {
+			continue
+		}
+		ap := &unstructured.Unstructured{}
+		ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+		ap.SetName(policy.Name)
+		ap.SetNamespace(dap.GetNamespace())
+		ap.SetLabels(map[string]string{dapLabel: dap.GetName()})
+		ap.Object["spec"] = authorizationPolicySpec(policy, sapm[policy.Name])
+		aps = append(aps, ap)
+	}
+	return aps
+}
+
+// authorizationPolicySpec allows requests from the policy's principals to the workloads it
+// selects. A policy without principals allows the noPrincipals sentinel instead, so it fails
+// closed for those workloads only.
+func authorizationPolicySpec(policy peerauthv1.DynamicPolicy, principals peerauthv1.HashSet) map[string]interface{} {
+	spec := map[string]interface{}{
+		"action": "ALLOW",
+	}
+	if len(policy.WorkloadSelector) > 0 {
+		matchLabels := map[string]interface{}{}
+		for k, v := range policy.WorkloadSelector {
+			matchLabels[k] = v
+		}
+		spec["selector"] = map[string]interface{}{"matchLabels": matchLabels}
+	}
+	sources := []interface{}{}
+	for _, principal := range principals.Slice() {
+		sources = append(sources, principal)
+	}
+	if len(sources) == 0 {
+		sources = append(sources, noPrincipals)
+	}
+	spec["rules"] = []interface{}{
+		map[string]interface{}{
+			"from": []interface{}{
+				map[string]interface{}{
+					"source": map[string]interface{}{"principals": sources},
+				},
+			},
+		},
+	}
+	return spec
+}
+
+// authorizationPolicyPrincipals returns the principals allowed by an AuthorizationPolicy's rules,
+// leaving out the noPrincipals sentinel.
+func authorizationPolicyPrincipals(ap *unstructured.Unstructured) peerauthv1.HashSet {
+	principals := peerauthv1.HashSet{}
+	rules, _, _ := unstructured.NestedSlice(ap.Object, "spec", "rules")
+	for _, rule := range rules {
+		rule, ok := rule.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		froms, _, _ := unstructured.NestedSlice(rule, "from")
+		for _, from := range froms {
+			from, ok := from.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			sources, _, _ := unstructured.NestedStringSlice(from, "source", "principals")
+			for _, principal := range sources {
+				if principal != noPrincipals {
+					principals.Add(principal)
+				}
+			}
+		}
+	}
+	return principals
+}
+
+// authorizationPolicyChange is a planned write to a generated AuthorizationPolicy, or to any
+// other object generated for the DAP.
+type authorizationPolicyChange struct {
+	action peerauthv1.ChangeAction
+	// desired is nil for deletions.
+	desired *unstructured.Unstructured
+	// existing is nil for creations.
+	existing *unstructured.Unstructured
+	// merged updates only the rules of a user-authored AuthorizationPolicy.
+	merged bool
+	// drifted restores a generated AuthorizationPolicy someone else deleted or modified as
+	// described by drift.
+	drifted bool
+	drift   string
+}
+
+// principals returns the principals granted before and after the change.
+func (c authorizationPolicyChange) principals() (before, after peerauthv1.HashSet) {
+	before, after = peerauthv1.HashSet{}, peerauthv1.HashSet{}
+	if c.existing != nil {
+		before = generatedPrincipals(c.existing)
+	}
+	if c.desired != nil {
+		after = generatedPrincipals(c.desired)
+	}
+	return before, after
+}
+
+// object returns the object the change writes or deletes.
+func (c authorizationPolicyChange) object() *unstructured.Unstructured {
+	if c.desired != nil {
+		return c.desired
+	}
+	return c.existing
+}
+
+// intended describes the change. The namespace is only set for Sidecars, the only objects
+// generated outside the DAP's namespace.
+func (c authorizationPolicyChange) intended() peerauthv1.IntendedChange {
+	before, after := c.principals()
+	intended := peerauthv1.IntendedChange{
+		APIVersion:        c.object().GetAPIVersion(),
+		Kind:              c.object().GetKind(),
+		Name:              c.object().GetName(),
+		Action:            c.action,
+		AddedPrincipals:   after.Difference(before),
+		RemovedPrincipals: before.Difference(after),
+	}
+	if c.object().GetLabels()[sidecarEgressLabel] != "" {
+		intended.Namespace = c.object().GetNamespace()
+	}
+	return intended
+}
+
+// ownedBy reports whether obj was generated for the DAP: it carries the DAP's label and the
+// DAP is its controller.
+func ownedBy(obj *unstructured.Unstructured, dap *peerauthv1.DynamicAuthorizationPolicy) bool {
+	return obj.GetLabels()[dapLabel] == dap.GetName() && metav1.IsControlledBy(obj, dap)
+}
+
+// planGenerated compares an object generated for the DAP with the one that exists, returning
+// the write reconciling them, if any. An existing object the DAP does not own is described as a
+// conflict instead. generated tells whether the last reconcile wrote obj, so that recreating it
+// is reported as drift.
+func (r *DynamicAuthorizationPolicyReconciler) planGenerated(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy, obj *unstructured.Unstructured, generated bool,
+) (*authorizationPolicyChange, string, error) {
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(obj.GroupVersionKind())
+	err := r.Get(ctx, client.ObjectKeyFromObject(obj), existing)
+	switch {
+	case kerrors.IsNotFound(err):
+		return &authorizationPolicyChange{action: peerauthv1.ChangeCreate, desired: obj, drifted: generated}, "", nil
+	case err != nil:
+		return nil, "", errors.Wrapf(err, "unable to get %s %s", obj.GetKind(), client.ObjectKeyFromObject(obj))
+	case !ownedBy(existing, dap):
+		return nil, fmt.Sprintf("%s %s", obj.GetKind(), client.ObjectKeyFromObject(existing)), nil
+	case generatedFieldsDiffer(existing, obj):
+		diff := drift(existing, obj)
+		return &authorizationPolicyChange{
+			action: peerauthv1.ChangeUpdate, desired: obj, existing: existing, drifted: diff != "", drift: diff,
+		}, "", nil
+	}
+	return nil, "", nil
+}
+
+// planAuthorizationPolicies compares the objects the DAP's backends generate, along with its
+// PeerAuthentications, with the ones that exist and returns the writes needed to
+// reconcile them, including deleting objects left behind by entries or backends that were
+// removed from the spec and merging principals into user-authored AuthorizationPolicies.
+// Existing objects the DAP does not own are never written; they are returned as conflicts
+// instead.
+func (r *DynamicAuthorizationPolicyReconciler) planAuthorizationPolicies(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy, sapm peerauthv1.ServiceAccountPolicyMapping,
+) ([]authorizationPolicyChange, []string, error) {
+	changes, conflicts := []authorizationPolicyChange{}, []string{}
+	desired := map[schema.GroupKind]map[string]bool{}
+	plan := func(obj *unstructured.Unstructured, generated bool) error {
+		gk := obj.GroupVersionKind().GroupKind()
+		if desired[gk] == nil {
+			desired[gk] = map[string]bool{}
+		}
+		desired[gk][obj.GetName()] = true
+		change, conflict, err := r.planGenerated(ctx, dap, obj, generated)
+		switch {
+		case err != nil:
+			return err
+		case conflict != "":
+			conflicts = append(conflicts, conflict)
+		case change != nil:
+			changes = append(changes, *change)
+		}
+		return nil
+	}
+	for _, name := range backendNames {
+		if !dap.HasBackend(name) {
+			continue
+		}
+		objs, err := backends[name].Generate(dap, sapm)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "unable to generate %s objects", name)
+		}
+		for _, obj := range objs {
+			// An object of a backend the last reconcile wrote, for a policy with principals in
+			// status, was generated by it unless it was dry run.
+			_, generated := dap.Status.ServiceAccountPolicyMapping[obj.GetName()]
+			generated = generated && wroteBackend(dap, name) && len(dap.Status.IntendedChanges) == 0
+			if err := plan(obj, generated); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	for _, pa := range PeerAuthentications(dap) {
+		if err := plan(pa, false); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, gvk := range ownedKinds(dap) {
+		generated := &unstructured.UnstructuredList{}
+		generated.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		err := r.List(ctx, generated, client.InNamespace(dap.GetNamespace()), client.MatchingLabels{dapLabel: dap.GetName()})
+		if meta.IsNoMatchError(err) {
+			// The backend is not installed, so there is nothing it could have generated.
+			continue
+		}
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "unable to list generated %ss", gvk.Kind)
+		}
+		for i := range generated.Items {
+			obj := &generated.Items[i]
+			if desired[gvk.GroupKind()][obj.GetName()] || !metav1.IsControlledBy(obj, dap) {
+				continue
+			}
+			changes = append(changes, authorizationPolicyChange{action: peerauthv1.ChangeDelete, existing: obj})
+		}
+	}
+
+	merged, err := r.planMergedAuthorizationPolicies(ctx, dap, sapm)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(changes, merged...), conflicts, nil
+}
+
+// applyAuthorizationPolicies performs the planned writes, returning the changes that were
+// applied before any error.
+func (r *DynamicAuthorizationPolicyReconciler) applyAuthorizationPolicies(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy, changes []authorizationPolicyChange,
+) ([]authorizationPolicyChange, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	for i, change := range changes {
+		applied := changes[:i]
+		obj := change.object()
+		log.Info("syncing "+obj.GetKind(), obj.GetKind(), obj.GetName(), "operation", change.action)
+		switch change.action {
+		case peerauthv1.ChangeCreate, peerauthv1.ChangeUpdate:
+			var err error
+			switch {
+			case change.merged:
+				err = r.applyMergedAuthorizationPolicy(ctx, change)
+			case obj.GetNamespace() != dap.GetNamespace():
+				// Objects in other namespaces cannot be owned by the DAP.
+				err = r.applyGenerated(ctx, obj)
+			default:
+				err = r.applyOwned(ctx, dap, obj)
+			}
+			if err != nil {
+				return applied, errors.Wrapf(err, "unable to apply %s %s", obj.GetKind(), client.ObjectKeyFromObject(obj))
+			}
+			if change.drifted {
+				r.recordDrift(dap, obj, change.drift)
+			}
+		case peerauthv1.ChangeDelete:
+			if err := r.Delete(ctx, obj); err != nil && !kerrors.IsNotFound(err) {
+				return applied, errors.Wrapf(err, "unable to delete %s %s", obj.GetKind(), client.ObjectKeyFromObject(obj))
+			}
+		}
+	}
+	return changes, nil
+}
+
+// recordOwnershipConflicts sets the ObjectsOwned condition, emitting a warning Event when
+// objects the DAP would generate but does not own appear or change.
+func (r *DynamicAuthorizationPolicyReconciler) recordOwnershipConflicts(dap *peerauthv1.DynamicAuthorizationPolicy,
+	conflicts []string) {
+	condition := metav1.Condition{
+		Type:               peerauthv1.ConditionObjectsOwned,
+		Status:             metav1.ConditionTrue,
+		Reason:             reasonObjectsOwned,
+		Message:            "every generated object is owned by the DAP",
+		ObservedGeneration: dap.GetGeneration(),
+	}
+	if len(conflicts) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = reasonObjectNotOwned
+		condition.Message = fmt.Sprintf("%s already exist without being owned by the DAP and are left untouched",
+			strings.Join(conflicts, ", "))
+		if previous := meta.FindStatusCondition(dap.Status.Conditions, condition.Type); previous == nil ||
+			previous.Message != condition.Message {
+			r.Recorder.Event(dap, corev1.EventTypeWarning, reasonObjectNotOwned, condition.Message)
+		}
+	}
+	meta.SetStatusCondition(&dap.Status.Conditions, condition)
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAuthorizationPoliciesWithoutPrincipals(t *testing.T) {
+	t.Parallel()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{
+				{Name: "namespace", PodSelectors: map[string]string{"app": "caller"}},
+				{Name: "api", PodSelectors: map[string]string{"app": "caller"}, WorkloadSelector: map[string]string{"app": "api"}},
+			},
+		},
+	}
+
+	aps := AuthorizationPolicies(dap, peerauthv1.ServiceAccountPolicyMapping{})
+	if len(aps) != 1 || aps[0].GetName() != "api" {
+		t.Fatalf("generated %d AuthorizationPolicies, want only the one selecting workloads", len(aps))
+	}
+	want := map[string]interface{}{
+		"action":   "ALLOW",
+		"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "api"}},
+		"rules": []interface{}{map[string]interface{}{"from": []interface{}{map[string]interface{}{
+			"source": map[string]interface{}{"principals": []interface{}{noPrincipals}},
+		}}}},
+	}
+	if !reflect.DeepEqual(aps[0].Object["spec"], want) {
+		t.Errorf("spec = %v, want %v", aps[0].Object["spec"], want)
+	}
+	if principals := authorizationPolicyPrincipals(aps[0]); len(principals) != 0 {
+		t.Errorf("principals = %v, want the sentinel left out", principals.Slice())
+	}
+
+	aps = AuthorizationPolicies(dap, peerauthv1.ServiceAccountPolicyMapping{
+		"namespace": peerauthv1.FromSlice([]string{"cluster.local/ns/client/sa/caller"}),
+	})
+	if len(aps) != 2 {
+		t.Errorf("generated %d AuthorizationPolicies, want the namespace-wide one once it has principals", len(aps))
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Backend generates the objects enforcing the principals a DAP's policies grant. Generated
+// objects are labelled with dapLabel, controlled by the DAP and live in its namespace.
+type Backend interface {
+	// Generate builds the objects granting each of the DAP's policies the principals in sapm.
+	Generate(dap *peerauthv1.DynamicAuthorizationPolicy, sapm peerauthv1.ServiceAccountPolicyMapping) ([]*unstructured.Unstructured, error)
+	// Kinds lists the kinds of the objects Generate builds.
+	Kinds() []schema.GroupVersionKind
+	// Principals returns the principals granted by an object of one of Kinds.
+	Principals(obj *unstructured.Unstructured) peerauthv1.HashSet
+}
+
+// backends are the registered backends by the name DAPs select them with.
+var backends = map[peerauthv1.Backend]Backend{ // nolint:gochecknoglobals
+	peerauthv1.BackendIstio:         istioBackend{},
+	peerauthv1.BackendLinkerd:       linkerdBackend{},
+	peerauthv1.BackendNetworkPolicy: networkPolicyBackend{},
+}
+
+// backendNames lists the registered backends in the order their objects are written.
+var backendNames = []peerauthv1.Backend{ // nolint:gochecknoglobals
+	peerauthv1.BackendIstio,
+	peerauthv1.BackendLinkerd,
+	peerauthv1.BackendNetworkPolicy,
+}
+
+// generatedKinds returns the kinds generated by every registered backend.
+func generatedKinds() []schema.GroupVersionKind {
+	kinds := []schema.GroupVersionKind{}
+	for _, name := range backendNames {
+		kinds = append(kinds, backends[name].Kinds()...)
+	}
+	return kinds
+}
+
+// ownedKinds returns the kinds the DAP may own: those generated by the backends it selects or
+// the last reconcile wrote, and PeerAuthentications when Istio is one of them. Kinds of other
+// backends are not listed, as their CRDs need not be installed.
+func ownedKinds(dap *peerauthv1.DynamicAuthorizationPolicy) []schema.GroupVersionKind {
+	kinds := []schema.GroupVersionKind{}
+	for _, name := range backendNames {
+		if !dap.HasBackend(name) && !wroteBackend(dap, name) {
+			continue
+		}
+		kinds = append(kinds, backends[name].Kinds()...)
+		if name == peerauthv1.BackendIstio {
+			kinds = append(kinds, PeerAuthenticationGVK)
+		}
+	}
+	return kinds
+}
+
+// generatedPrincipals returns the principals granted by an object of one of the backends'
+// kinds. Merged AuthorizationPolicies are Istio's.
+func generatedPrincipals(obj *unstructured.Unstructured) peerauthv1.HashSet {
+	for _, name := range backendNames {
+		for _, kind := range backends[name].Kinds() {
+			if kind.GroupKind() == obj.GroupVersionKind().GroupKind() {
+				return backends[name].Principals(obj)
+			}
+		}
+	}
+	return peerauthv1.HashSet{}
+}
+
+// wroteBackend reports whether the last reconcile wrote the backend's objects. DAPs reconciled
+// before backends were recorded only wrote Istio's.
+func wroteBackend(dap *peerauthv1.DynamicAuthorizationPolicy, backend peerauthv1.Backend) bool {
+	written := dap.Status.Backends
+	if len(written) == 0 {
+		written = []peerauthv1.Backend{peerauthv1.BackendIstio}
+	}
+	for _, b := range written {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// istioBackend generates a security.istio.io AuthorizationPolicy per policy.
+type istioBackend struct{}
+
+func (istioBackend) Generate(dap *peerauthv1.DynamicAuthorizationPolicy,
+	sapm peerauthv1.ServiceAccountPolicyMapping) ([]*unstructured.Unstructured, error) {
+	return AuthorizationPolicies(dap, sapm), nil
+}
+
+func (istioBackend) Kinds() []schema.GroupVersionKind {
+	return []schema.GroupVersionKind{AuthorizationPolicyGVK}
+}
+
+func (istioBackend) Principals(obj *unstructured.Unstructured) peerauthv1.HashSet {
+	return authorizationPolicyPrincipals(obj)
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// statusWrite is the last time a DAP's status was written and the generation it reflected.
+type statusWrite struct {
+	at         time.Time
+	generation int64
+}
+
+// statusWrites coalesces reconciles triggered by pod churn: once a DAP's status is written,
+// reconciles of the same generation are deferred until the debounce window has passed.
+// Spec changes bump the generation and are reconciled immediately.
+type statusWrites struct {
+	mu     sync.Mutex
+	writes map[types.NamespacedName]statusWrite
+}
+
+// nolint:gochecknoglobals
+var lastStatusWrites = &statusWrites{writes: map[types.NamespacedName]statusWrite{}}
+
+// wait returns how long a reconcile of key at generation should be deferred.
+func (s *statusWrites) wait(key types.NamespacedName, generation int64, window time.Duration, now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.writes[key]
+	if !ok || last.generation != generation {
+		return 0
+	}
+	if wait := last.at.Add(window).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (s *statusWrites) written(key types.NamespacedName, generation int64, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes[key] = statusWrite{at: at, generation: generation}
+}
+
+func (s *statusWrites) forget(key types.NamespacedName) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.writes, key)
+}
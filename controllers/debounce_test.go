@@ -0,0 +1,156 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestStatusWritesWait(t *testing.T) {
+	t.Parallel()
+	key := types.NamespacedName{Namespace: "debounce", Name: "wait"}
+	now := time.Unix(100, 0)
+	writes := &statusWrites{writes: map[types.NamespacedName]statusWrite{}}
+
+	if wait := writes.wait(key, 1, time.Minute, now); wait != 0 {
+		t.Errorf("wait before any write = %v, want 0", wait)
+	}
+	writes.written(key, 1, now)
+	tests := map[string]struct {
+		generation int64
+		now        time.Time
+		want       time.Duration
+	}{
+		"within window":      {1, now.Add(20 * time.Second), 40 * time.Second},
+		"after window":       {1, now.Add(time.Minute), 0},
+		"spec changed":       {2, now.Add(20 * time.Second), 0},
+		"window not started": {1, now, time.Minute},
+	}
+	for name, tt := range tests {
+		if got := writes.wait(key, tt.generation, time.Minute, tt.now); got != tt.want {
+			t.Errorf("%s: wait = %v, want %v", name, got, tt.want)
+		}
+	}
+	writes.forget(key)
+	if wait := writes.wait(key, 1, time.Minute, now); wait != 0 {
+		t.Errorf("wait after forget = %v, want 0", wait)
+	}
+}
+
+func TestReconcileDebounce(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	labels := map[string]string{"app": "debounced"}
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "debounce", Generation: 1},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name: "policy", TrustDomain: "cluster.local", PodSelectors: labels,
+			}},
+		},
+	}
+	key := client.ObjectKeyFromObject(dap)
+	pod := func(sa string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: sa, Namespace: "debounce", Labels: labels},
+			Spec:       corev1.PodSpec{ServiceAccountName: sa},
+		}
+	}
+
+	c := newApplyClient(fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(dap).Build())
+	triggers := make(chan event.GenericEvent, 10)
+	podr := &PodReconciler{Client: c, Scheme: c.Scheme(), Triggers: triggers}
+	dapr := &DynamicAuthorizationPolicyReconciler{
+		Client:         c,
+		Scheme:         c.Scheme(),
+		Recorder:       record.NewFakeRecorder(100),
+		DebounceWindow: time.Minute,
+	}
+	createPods := func(names ...string) {
+		t.Helper()
+		for _, name := range names {
+			if err := c.Create(ctx, pod(name)); err != nil {
+				t.Fatal(err)
+			}
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "debounce", Name: name}}
+			if _, err := podr.Reconcile(ctx, req); err != nil {
+				t.Fatal(err)
+			}
+			if triggered := (<-triggers).Object; client.ObjectKeyFromObject(triggered) != key {
+				t.Fatalf("pod %s triggered %s, want %s", name, client.ObjectKeyFromObject(triggered), key)
+			}
+		}
+	}
+	reconcile := func() (ctrl.Result, *peerauthv1.DynamicAuthorizationPolicy) {
+		t.Helper()
+		result, err := dapr.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &peerauthv1.DynamicAuthorizationPolicy{}
+		if err := c.Get(ctx, key, got); err != nil {
+			t.Fatal(err)
+		}
+		return result, got
+	}
+
+	createPods("a", "b", "c")
+	result, got := reconcile()
+	if result.RequeueAfter != 0 || len(got.Status.ServiceAccountPolicyMapping["policy"]) != 3 {
+		t.Fatalf("first reconcile: result %+v, principals %v", result, got.Status.ServiceAccountPolicyMapping)
+	}
+	written := got.GetResourceVersion()
+
+	createPods("d", "e")
+	for i := 0; i < 2; i++ {
+		result, got = reconcile()
+		if result.RequeueAfter <= 0 || result.RequeueAfter > time.Minute {
+			t.Errorf("reconcile within window: RequeueAfter = %v, want (0, 1m]", result.RequeueAfter)
+		}
+		if got.GetResourceVersion() != written {
+			t.Errorf("status written within the debounce window")
+		}
+	}
+
+	lastStatusWrites.written(key, got.GetGeneration(), time.Now().Add(-time.Minute))
+	result, got = reconcile()
+	if result.RequeueAfter != 0 || len(got.Status.ServiceAccountPolicyMapping["policy"]) != 5 {
+		t.Errorf("reconcile after window: result %+v, principals %v", result, got.Status.ServiceAccountPolicyMapping)
+	}
+
+	got.Spec.DynamicPolicies[0].MaxPrincipals = new(int32)
+	*got.Spec.DynamicPolicies[0].MaxPrincipals = 10
+	got.SetGeneration(got.GetGeneration() + 1)
+	if err := c.Update(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := reconcile(); result.RequeueAfter != 0 {
+		t.Errorf("spec change was debounced: RequeueAfter = %v", result.RequeueAfter)
+	}
+}
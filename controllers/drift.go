@@ -0,0 +1,143 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// generatedHashAnnotation holds a digest of the spec fields the controller generated for an
+// object, so changes made to them by anyone else can be told apart from the controller's own.
+const generatedHashAnnotation = "peerauth.aweis.io/generated-hash"
+
+// maxDriftValue bounds the length of each value quoted in a DriftCorrected Event.
+const maxDriftValue = 256
+
+// generatedSpecFields lists, per kind, the spec fields the controller generates. Other spec
+// fields may be owned by other managers.
+var generatedSpecFields = map[schema.GroupKind][]string{ // nolint:gochecknoglobals
+	AuthorizationPolicyGVK.GroupKind():        {"action", "selector", "rules"},
+	PeerAuthenticationGVK.GroupKind():         {"selector", "mtls", "portLevelMtls"},
+	SidecarGVK.GroupKind():                    {"workloadSelector", "egress"},
+	LinkerdAuthorizationPolicyGVK.GroupKind(): {"targetRef", "requiredAuthenticationRefs"},
+	MeshTLSAuthenticationGVK.GroupKind():      {"identities"},
+	NetworkPolicyGVK.GroupKind():              {"podSelector", "policyTypes", "ingress"},
+}
+
+// generatedHash returns a digest of the generated spec fields of obj.
+func generatedHash(obj *unstructured.Unstructured) string {
+	fields := map[string]interface{}{}
+	for _, field := range generatedSpecFields[obj.GroupVersionKind().GroupKind()] {
+		if value, ok, _ := unstructured.NestedFieldNoCopy(obj.Object, "spec", field); ok {
+			fields[field] = value
+		}
+	}
+	data, _ := json.Marshal(fields)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// setGeneratedHash annotates obj with the digest of its generated spec fields.
+func setGeneratedHash(obj *unstructured.Unstructured) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[generatedHashAnnotation] = generatedHash(obj)
+	obj.SetAnnotations(annotations)
+}
+
+// generatedFieldsDiffer reports whether existing differs from desired in the spec fields the
+// controller generates or in its generated hash, or lacks any of desired's labels or
+// annotations. Fields other managers own are ignored.
+func generatedFieldsDiffer(existing, desired *unstructured.Unstructured) bool {
+	if generatedFieldsDiff(existing, desired) != "" ||
+		existing.GetAnnotations()[generatedHashAnnotation] != generatedHash(desired) {
+		return true
+	}
+	labels := existing.GetLabels()
+	for k, v := range desired.GetLabels() {
+		if labels[k] != v {
+			return true
+		}
+	}
+	annotations := existing.GetAnnotations()
+	for k, v := range desired.GetAnnotations() {
+		if annotations[k] != v {
+			return true
+		}
+	}
+	return false
+}
+
+// generatedFieldsDiff describes the generated spec fields in which existing differs from
+// desired, or returns "" if there are none.
+func generatedFieldsDiff(existing, desired *unstructured.Unstructured) string {
+	diffs := []string{}
+	for _, field := range generatedSpecFields[desired.GroupVersionKind().GroupKind()] {
+		got, _, _ := unstructured.NestedFieldNoCopy(existing.Object, "spec", field)
+		want, _, _ := unstructured.NestedFieldNoCopy(desired.Object, "spec", field)
+		if !equality.Semantic.DeepEqual(got, want) {
+			diffs = append(diffs, fmt.Sprintf("spec.%s: %s -> %s", field, driftValue(got), driftValue(want)))
+		}
+	}
+	return strings.Join(diffs, "; ")
+}
+
+func driftValue(value interface{}) string {
+	if value == nil {
+		return "<unset>"
+	}
+	data, _ := json.Marshal(value)
+	if len(data) > maxDriftValue {
+		return string(data[:maxDriftValue]) + "..."
+	}
+	return string(data)
+}
+
+// drift describes how existing, generated by the controller, was changed by someone else to
+// differ from desired, or returns "" if it was not.
+func drift(existing, desired *unstructured.Unstructured) string {
+	hash, ok := existing.GetAnnotations()[generatedHashAnnotation]
+	if !ok || hash == generatedHash(existing) {
+		return ""
+	}
+	return generatedFieldsDiff(existing, desired)
+}
+
+// recordDrift emits a DriftCorrected Event for a generated object that was restored after being
+// modified, or deleted when diff is empty.
+func (r *DynamicAuthorizationPolicyReconciler) recordDrift(dap *peerauthv1.DynamicAuthorizationPolicy,
+	obj *unstructured.Unstructured, diff string) {
+	if diff == "" {
+		r.Recorder.Eventf(dap, corev1.EventTypeWarning, reasonDriftCorrected,
+			"recreated deleted %s %s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+		return
+	}
+	r.Recorder.Eventf(dap, corev1.EventTypeWarning, reasonDriftCorrected,
+		"restored modified %s %s/%s: %s", obj.GetKind(), obj.GetNamespace(), obj.GetName(), diff)
+}
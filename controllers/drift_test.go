@@ -0,0 +1,150 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestDrift(t *testing.T) {
+	t.Parallel()
+	ap := func(action string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{"action": action},
+		}}
+		obj.SetGroupVersionKind(AuthorizationPolicyGVK)
+		return obj
+	}
+	desired := ap("ALLOW")
+	generated := ap("ALLOW")
+	setGeneratedHash(generated)
+	modified := generated.DeepCopy()
+	modified.Object["spec"].(map[string]interface{})["action"] = "DENY"
+	foreign := generated.DeepCopy()
+	foreign.Object["spec"].(map[string]interface{})["provider"] = map[string]interface{}{"name": "ext-authz"}
+
+	tests := map[string]struct {
+		existing *unstructured.Unstructured
+		want     string
+	}{
+		"unchanged":                 {existing: generated},
+		"modified":                  {existing: modified, want: `spec.action: "DENY" -> "ALLOW"`},
+		"other managers' fields":    {existing: foreign},
+		"not generated by the hash": {existing: ap("DENY")},
+	}
+	for name, tt := range tests {
+		if got := drift(tt.existing, desired); got != tt.want {
+			t.Errorf("%s: drift = %q, want %q", name, got, tt.want)
+		}
+	}
+}
+
+func TestGeneratorOf(t *testing.T) {
+	t.Parallel()
+	sidecar := &unstructured.Unstructured{}
+	sidecar.SetAnnotations(map[string]string{sidecarGrantsAnnotation: "server/dap,web/frontend"})
+	got := []types.NamespacedName{}
+	for _, request := range generatorOf(sidecar) {
+		got = append(got, request.NamespacedName)
+	}
+	want := []types.NamespacedName{{Namespace: "server", Name: "dap"}, {Namespace: "web", Name: "frontend"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("generatorOf = %v, want %v", got, want)
+	}
+	if requests := generatorOf(&unstructured.Unstructured{}); len(requests) != 0 {
+		t.Errorf("generatorOf unannotated object = %v, want none", requests)
+	}
+}
+
+func TestReconcileDriftCorrected(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "default"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:         "policy",
+				TrustDomain:  "cluster.local",
+				PodSelectors: map[string]string{"app": "caller"},
+			}},
+		},
+	}
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: "default", Labels: map[string]string{"app": "caller"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	rt := newReconcilerTest(t, dap, caller)
+	c := rt.c
+	recorder := rt.recorder
+	driftEvents := func() []string {
+		events := []string{}
+		for {
+			select {
+			case e := <-recorder.Events:
+				if strings.Contains(e, reasonDriftCorrected) {
+					events = append(events, e)
+				}
+			default:
+				return events
+			}
+		}
+	}
+	rt.reconcileDAP(dap)
+	if events := driftEvents(); len(events) != 0 {
+		t.Errorf("DriftCorrected events after creation = %v", events)
+	}
+
+	ap := &unstructured.Unstructured{}
+	ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+	key := client.ObjectKey{Namespace: "default", Name: "policy"}
+	if err := c.Get(ctx, key, ap); err != nil {
+		t.Fatal(err)
+	}
+	if err := unstructured.SetNestedField(ap.Object, "DENY", "spec", "action"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Update(ctx, ap); err != nil {
+		t.Fatal(err)
+	}
+	rt.reconcileDAP(dap)
+	events := driftEvents()
+	if len(events) != 1 || !strings.Contains(events[0], `spec.action: "DENY" -> "ALLOW"`) {
+		t.Errorf("DriftCorrected events after modification = %v", events)
+	}
+
+	if err := c.Delete(ctx, ap); err != nil {
+		t.Fatal(err)
+	}
+	rt.reconcileDAP(dap)
+	if err := c.Get(ctx, key, ap); err != nil {
+		t.Errorf("deleted AuthorizationPolicy not recreated: %v", err)
+	}
+	events = driftEvents()
+	if len(events) != 1 || !strings.Contains(events[0], "recreated deleted AuthorizationPolicy default/policy") {
+		t.Errorf("DriftCorrected events after deletion = %v", events)
+	}
+}
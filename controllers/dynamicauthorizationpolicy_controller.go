@@ -18,83 +18,256 @@ package controllers
 
 import (
 	"context"
-	"fmt"
+	"strings"
+	"time"
 
-	corev1 "k8s.io/api/core/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
 	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
 )
 
 // DynamicAuthorizationPolicyReconciler reconciles a DynamicAuthorizationPolicy object.
 type DynamicAuthorizationPolicyReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// Audit, when set, receives a record for every principal granted or revoked.
+	Audit AuditSink
+	// DryRun puts every DAP in DryRun mode regardless of its spec.
+	DryRun bool
+	// Tenancy, when set, restricts the namespaces each DAP may select pods from.
+	Tenancy *TenancySource
+	// MaxPrincipals caps the principals granted by policies that do not set their own limit.
+	// Zero means unlimited.
+	MaxPrincipals int
+	// DebounceWindow is the minimum time between status writes for a DAP whose spec has not
+	// changed, coalescing the reconciles triggered by pod churn.
+	DebounceWindow time.Duration
+	// PodTriggers receives the DAPs affected by pod changes from the PodReconciler.
+	PodTriggers <-chan event.GenericEvent
+	// Principals, when set, is kept current by the PodReconciler so pods are only relisted
+	// when a DAP's spec changes or every ResyncPeriod.
+	Principals   *PrincipalIndex
+	ResyncPeriod time.Duration
+	// WatchNamespaces are the namespaces the manager's cache watches. Pods in other namespaces
+	// are never selected. Empty means every namespace.
+	WatchNamespaces []string
+	// SidecarEgress generates Sidecars for the callers of DAPs setting spec.sidecarEgress. The
+	// Sidecars restrict the egress of workloads in other namespaces, so they are opt-in.
+	SidecarEgress bool
+	// MeshNamespaces are the namespaces, such as the Istio control plane and mesh root
+	// namespaces, every generated Sidecar keeps egress to. Empty means istio-system.
+	MeshNamespaces []string
+	// Options configures the controller's concurrency and workqueue rate limiter.
+	Options controller.Options
 }
 
 //+kubebuilder:rbac:groups=peerauth.aweis.io,resources=dynamicauthorizationpolicies,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=peerauth.aweis.io,resources=dynamicauthorizationpolicies/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=peerauth.aweis.io,resources=dynamicauthorizationpolicies/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get
+//+kubebuilder:rbac:groups=security.istio.io,resources=authorizationpolicies,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=security.istio.io,resources=peerauthentications,verbs=get;list;watch;create;update;patch;delete
 
 func (r *DynamicAuthorizationPolicyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
+	started := time.Now()
 
 	dap := peerauthv1.DynamicAuthorizationPolicy{}
 	err := r.Get(ctx, req.NamespacedName, &dap)
 	if err != nil {
 		if kerrors.IsNotFound(err) {
 			log.Info("resource no longer available", "DynamicAuthorizationPolicy", req.NamespacedName)
+			exportedPolicies.clear(req.NamespacedName)
+			pendingPodChanges.forget(req.NamespacedName)
+			lastStatusWrites.forget(req.NamespacedName)
+			if r.Principals != nil {
+				r.Principals.Delete(req.NamespacedName)
+			}
 			return ctrl.Result{}, nil
 		}
+		observeReconcileError(withReason(errorReasonGet, err))
 		return ctrl.Result{}, errors.Wrapf(err,
 			"unable to get DynamicAuthorizationPolicy %s", req.NamespacedName)
 	}
 
-	sapm := peerauthv1.ServiceAccountPolicyMapping{}
-	for i := range dap.Spec.DynamicPolicies {
-		policy := dap.Spec.DynamicPolicies[i]
-		pods := corev1.PodList{}
+	if !dap.GetDeletionTimestamp().IsZero() {
+		if err := r.finalize(ctx, &dap); err != nil {
+			observeReconcileError(err)
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+	if !controllerutil.ContainsFinalizer(&dap, dapFinalizer) {
+		if err := r.applyFinalizer(ctx, &dap, true); err != nil {
+			observeReconcileError(withReason(errorReasonStatus, err))
+			return ctrl.Result{}, err
+		}
+	}
 
-		err := r.List(ctx, &pods, client.MatchingLabels(policy.PodSelectors))
-		if err != nil {
-			return ctrl.Result{}, errors.Wrapf(err,
-				"unable to list ServiceAccountPolicyMapping using labels %+v", policy.PodSelectors)
+	if wait := lastStatusWrites.wait(req.NamespacedName, dap.GetGeneration(), r.DebounceWindow, time.Now()); wait > 0 {
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+
+	if err := r.reconcile(ctx, &dap); err != nil {
+		observeReconcileError(err)
+		if !kerrors.IsConflict(err) {
+			r.Recorder.Event(&dap, corev1.EventTypeWarning, reasonSyncFailed, err.Error())
 		}
+		return ctrl.Result{}, err
+	}
+	exportedPolicies.set(req.NamespacedName, dap.Status.ServiceAccountPolicyMapping)
+	pendingPodChanges.synced(req.NamespacedName, started)
+	lastStatusWrites.written(req.NamespacedName, dap.GetGeneration(), time.Now())
+	if r.Principals != nil {
+		return ctrl.Result{RequeueAfter: r.ResyncPeriod}, nil
+	}
+	return ctrl.Result{}, nil
+}
 
-		for _, pod := range pods.Items {
-			log.Info("adding pod to DAP policies", "Pod", pod.GetName())
-			sapm.Map(policy, pod)
+func (r *DynamicAuthorizationPolicyReconciler) reconcile(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy) error {
+	log := log.FromContext(ctx)
+
+	tenancy, err := r.Tenancy.Load(ctx)
+	if err != nil {
+		return withReason(errorReasonResolve, err)
+	}
+	selected, err := r.selectPods(ctx, dap)
+	if err != nil {
+		return withReason(errorReasonResolve, err)
+	}
+	res := ResolveContributors(dap, tenancy, selected)
+	r.recordTenancyViolations(dap, res.Violations)
+	r.recordUnwatchedNamespaces(dap, unwatchedNamespaces(dap, r.WatchNamespaces))
+	r.recordPrincipalLimits(dap, limitPrincipals(dap, &res, r.MaxPrincipals))
+	for policy, principals := range res.Contributors {
+		for principal, pods := range principals {
+			log.Info("adding pods to DAP policies", "Policy", policy, "Principal", principal, "Pods", pods)
+		}
+	}
+
+	changes, ownershipConflicts, err := r.planAuthorizationPolicies(ctx, dap, res.Mapping)
+	if err != nil {
+		return withReason(errorReasonSync, err)
+	}
+	r.recordOwnershipConflicts(dap, ownershipConflicts)
+	sidecars, overlapping, err := r.planSidecars(ctx, dap, tenancy, res.Mapping)
+	if err != nil {
+		return withReason(errorReasonSync, err)
+	}
+	changes = append(changes, sidecars...)
+	r.recordSidecarOverlaps(dap, overlapping)
+	if r.DryRun || dap.IsDryRun() {
+		r.recordIntendedChanges(dap, changes)
+	} else {
+		applied, err := r.applyAuthorizationPolicies(ctx, dap, changes)
+		r.recordPrincipalChanges(dap, applied)
+		observeAppliedChanges(dap, applied)
+		r.audit(ctx, dap, applied, res.Contributors)
+		if err != nil {
+			return withReason(errorReasonSync, err)
 		}
+		dap.Status.IntendedChanges = nil
+		dap.Status.Backends = dap.GetBackends()
+		dap.Status.MergedRules = mergedRules(dap)
+	}
+	conflicts, err := r.peerAuthenticationConflicts(ctx, dap, PeerAuthentications(dap))
+	if err != nil {
+		return withReason(errorReasonSync, err)
 	}
+	r.recordPeerAuthenticationConflicts(dap, conflicts)
 
-	dap.Status.ServiceAccountPolicyMapping = sapm
-	log.Info(fmt.Sprintf("%+v", dap))
+	r.recordPendingPrincipals(dap, res.Pending)
+	dap.Status.ServiceAccountPolicyMapping = res.Mapping
 
-	if err := r.Update(ctx, &dap); err != nil {
-		return ctrl.Result{}, errors.Wrapf(err,
-			"unable to update DynamicAuthorizationPolicy %s", req.NamespacedName)
+	return withReason(errorReasonStatus, errors.Wrapf(r.applyStatus(ctx, dap),
+		"unable to update DynamicAuthorizationPolicy %s", client.ObjectKeyFromObject(dap)))
+}
+
+// PlannedChange is a write the controller would perform for a DAP.
+type PlannedChange struct {
+	peerauthv1.IntendedChange
+	// Object is the object written, or nil for a deletion.
+	Object *unstructured.Unstructured
+}
+
+// Plan returns the writes the controller would perform for the DAP against the objects its
+// client reads, through the same backends, PeerAuthentications, Sidecars and principal limits
+// as a reconcile, and sets the DAP's status mapping. Nothing is written, so a DAP read from a
+// manifest can be planned against a snapshot or a live cluster.
+func (r *DynamicAuthorizationPolicyReconciler) Plan(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy) ([]PlannedChange, error) {
+	tenancy, err := r.Tenancy.Load(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return ctrl.Result{}, nil
+	selected, err := SelectPods(ctx, r, dap)
+	if err != nil {
+		return nil, err
+	}
+	res := ResolveContributors(dap, tenancy, selected)
+	limitPrincipals(dap, &res, r.MaxPrincipals)
+
+	changes, _, err := r.planAuthorizationPolicies(ctx, dap, res.Mapping)
+	if err != nil {
+		return nil, err
+	}
+	sidecars, _, err := r.planSidecars(ctx, dap, tenancy, res.Mapping)
+	if err != nil {
+		return nil, err
+	}
+	dap.Status.ServiceAccountPolicyMapping = res.Mapping
+
+	planned := []PlannedChange{}
+	for _, change := range append(changes, sidecars...) {
+		planned = append(planned, PlannedChange{IntendedChange: change.intended(), Object: change.desired})
+	}
+	return planned, nil
+}
+
+// selectPods returns the pods selected by the DAP's policies from the principal index when it
+// is current, relisting them otherwise.
+func (r *DynamicAuthorizationPolicyReconciler) selectPods(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy) (Contributors, error) {
+	if r.Principals == nil {
+		return SelectPods(ctx, r, dap)
+	}
+	now := time.Now()
+	if selected, ok := r.Principals.Contributors(dap, r.ResyncPeriod, now); ok {
+		return selected, nil
+	}
+	r.Principals.BeginSync(dap)
+	selected, err := SelectPods(ctx, r, dap)
+	if err != nil {
+		return nil, err
+	}
+	return r.Principals.Sync(dap, selected, now), nil
 }
 
 func (r *DynamicAuthorizationPolicyReconciler) podSelectorIndexer(obj client.Object) []string {
-	keys := []string{}
 	dap, ok := obj.(*peerauthv1.DynamicAuthorizationPolicy)
 	if !ok {
 		return []string{}
 	}
-
-	for _, policy := range dap.GetPolicies() {
-		for key, val := range policy.PodSelectors {
-			keys = append(keys, indexKey(key, val))
-		}
-	}
-	return keys
+	return podSelectorIndexKeys(dap)
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -107,9 +280,46 @@ func (r *DynamicAuthorizationPolicyReconciler) SetupWithManager(mgr ctrl.Manager
 		return errors.Wrap(err, "unable to add indexer")
 	}
 
-	err = ctrl.NewControllerManagedBy(mgr).
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("dynamicauthorizationpolicy-controller")
+	}
+
+	// Generated objects are watched so that changes to them made by anyone else are reverted.
+	// Kinds of backends the cluster does not serve are skipped, since watching them fails.
+	generated := func(gvk schema.GroupVersionKind) (*unstructured.Unstructured, bool) {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(gvk)
+		_, err := mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+		return obj, err == nil
+	}
+	bldr := ctrl.NewControllerManagedBy(mgr).
 		For(&peerauthv1.DynamicAuthorizationPolicy{}).
-		Complete(r)
+		WithOptions(r.Options)
+	for _, gvk := range append(generatedKinds(), PeerAuthenticationGVK) {
+		if obj, ok := generated(gvk); ok {
+			bldr = bldr.Owns(obj)
+		}
+	}
+	if obj, ok := generated(SidecarGVK); ok {
+		bldr = bldr.Watches(&source.Kind{Type: obj}, handler.EnqueueRequestsFromMapFunc(generatorOf))
+	}
+	if r.PodTriggers != nil {
+		bldr = bldr.Watches(&source.Channel{Source: r.PodTriggers}, &handler.EnqueueRequestForObject{})
+	}
+	err = bldr.Complete(r)
 
 	return errors.Wrap(err, "unable to register DynamicAuthorizationPolicy controller")
 }
+
+// generatorOf maps a generated Sidecar to the DAPs granting egress through it.
+func generatorOf(obj client.Object) []reconcile.Request {
+	requests := []reconcile.Request{}
+	for _, granted := range sidecarGrantedBy(obj) {
+		parts := strings.SplitN(granted, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: parts[0], Name: parts[1]}})
+	}
+	return requests
+}
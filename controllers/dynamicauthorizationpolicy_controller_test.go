@@ -26,8 +26,11 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -113,11 +116,15 @@ func matchingSelectorsTest(desc string, dap *v1.DynamicAuthorizationPolicy, pods
 			dapNN := client.ObjectKeyFromObject(dap)
 
 			if useFakeClient {
+				recorder := record.NewFakeRecorder(10)
 				dapr := DynamicAuthorizationPolicyReconciler{
-					Scheme: scheme.Scheme,
-					Client: k8sClient,
+					Scheme:   scheme.Scheme,
+					Client:   k8sClient,
+					Recorder: recorder,
 				}
-				dapr.Reconcile(ctx, ctrl.Request{NamespacedName: dapNN})
+				_, err := dapr.Reconcile(ctx, ctrl.Request{NamespacedName: dapNN})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(recorder.Events).To(Receive(HavePrefix("Normal PrincipalAdded ")))
 			}
 
 			Eventually(func(g Gomega) { // nolint:varnamelen
@@ -135,6 +142,14 @@ func matchingSelectorsTest(desc string, dap *v1.DynamicAuthorizationPolicy, pods
 							g.Expect(policy).To(HaveKey(podPolicy))
 						}
 					}
+
+					ap := unstructured.Unstructured{}
+					ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+					err := k8sClient.Get(ctx, client.ObjectKey{Namespace: dap.Namespace, Name: name}, &ap)
+					g.Expect(err).NotTo(HaveOccurred())
+					rules, _, err := unstructured.NestedSlice(ap.Object, "spec", "rules")
+					g.Expect(err).NotTo(HaveOccurred())
+					g.Expect(rules).To(HaveLen(1))
 				}
 			}, timeout, interval).Should(Succeed())
 		})
@@ -153,3 +168,58 @@ func hasSelectors(pod *corev1.Pod, selectors map[string]string) bool {
 	}
 	return true
 }
+
+var _ = Describe("DynamicAuthorizationPolicy controller in DryRun mode", func() {
+	It("records intended changes without creating AuthorizationPolicies", func() {
+		ctx := context.Background()
+		labelSel := map[string]string{"dryRunKey": "dryRunVal"}
+		dap := &v1.DynamicAuthorizationPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "dap-dry-run", Namespace: "default"},
+			Spec: v1.DynamicAuthorizationPolicySpec{
+				Mode: v1.ModeDryRun,
+				DynamicPolicies: []v1.DynamicPolicy{
+					{Name: "dry-run-policy", PodSelectors: labelSel, TrustDomain: "cluster.local"},
+				},
+			},
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-dry-run", Namespace: "default", Labels: labelSel},
+			Spec: corev1.PodSpec{
+				Containers:         []corev1.Container{{Image: "image", Name: "container"}},
+				ServiceAccountName: "dry-run",
+			},
+		}
+		Expect(k8sClient.Create(ctx, pod)).Should(Succeed())
+		Expect(k8sClient.Create(ctx, dap)).Should(Succeed())
+
+		dapNN := client.ObjectKeyFromObject(dap)
+		if useFakeClient {
+			recorder := record.NewFakeRecorder(10)
+			dapr := DynamicAuthorizationPolicyReconciler{
+				Scheme:   scheme.Scheme,
+				Client:   k8sClient,
+				Recorder: recorder,
+			}
+			_, err := dapr.Reconcile(ctx, ctrl.Request{NamespacedName: dapNN})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorder.Events).To(Receive(ContainSubstring("would create AuthorizationPolicy.security.istio.io dry-run-policy")))
+		}
+
+		Eventually(func(g Gomega) {
+			createdDap := v1.DynamicAuthorizationPolicy{}
+			g.Expect(k8sClient.Get(ctx, dapNN, &createdDap)).To(Succeed())
+			g.Expect(createdDap.Status.IntendedChanges).To(ConsistOf(v1.IntendedChange{
+				APIVersion:      AuthorizationPolicyGVK.GroupVersion().String(),
+				Kind:            "AuthorizationPolicy",
+				Name:            "dry-run-policy",
+				Action:          v1.ChangeCreate,
+				AddedPrincipals: []string{"cluster.local/ns/default/sa/dry-run"},
+			}))
+		}, timeout, interval).Should(Succeed())
+
+		ap := unstructured.Unstructured{}
+		ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+		err := k8sClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "dry-run-policy"}, &ap)
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+	})
+})
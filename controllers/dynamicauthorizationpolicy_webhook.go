@@ -0,0 +1,139 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+//+kubebuilder:webhook:path=/validate-peerauth-aweis-io-v1-dynamicauthorizationpolicy,mutating=false,failurePolicy=fail,sideEffects=None,groups=peerauth.aweis.io,resources=dynamicauthorizationpolicies,verbs=create;update,versions=v1,name=vdynamicauthorizationpolicy.kb.io,admissionReviewVersions=v1
+
+// DynamicAuthorizationPolicyValidator rejects DAPs with invalid pod selectors or rule references,
+// or that list namespaces the tenancy policy does not allow for the DAP's namespace.
+type DynamicAuthorizationPolicyValidator struct {
+	Tenancy *TenancySource
+}
+
+// SetupWebhookWithManager registers the validating webhook with the Manager.
+func (v *DynamicAuthorizationPolicyValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	err := ctrl.NewWebhookManagedBy(mgr).
+		For(&peerauthv1.DynamicAuthorizationPolicy{}).
+		WithValidator(v).
+		Complete()
+	return errors.Wrap(err, "unable to register DynamicAuthorizationPolicy webhook")
+}
+
+func (v *DynamicAuthorizationPolicyValidator) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	return v.validate(ctx, nil, obj)
+}
+
+// ValidateUpdate only validates spec changes, so the controller's finalizer and status writes
+// and the deletion of a DAP are never rejected, and only checks newly added namespaces against
+// the tenancy policy, so tightening it does not make existing DAPs uneditable.
+func (v *DynamicAuthorizationPolicyValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	old, ok := oldObj.(*peerauthv1.DynamicAuthorizationPolicy)
+	if !ok {
+		return errors.Errorf("expected a DynamicAuthorizationPolicy but got %T", oldObj)
+	}
+	dap, ok := newObj.(*peerauthv1.DynamicAuthorizationPolicy)
+	if !ok {
+		return errors.Errorf("expected a DynamicAuthorizationPolicy but got %T", newObj)
+	}
+	if !dap.GetDeletionTimestamp().IsZero() || equality.Semantic.DeepEqual(old.Spec, dap.Spec) {
+		return nil
+	}
+	return v.validate(ctx, old, newObj)
+}
+
+func (v *DynamicAuthorizationPolicyValidator) ValidateDelete(context.Context, runtime.Object) error {
+	return nil
+}
+
+// validate checks the DAP in obj. When old is set, only namespaces it did not already list for
+// the same policy are checked against the tenancy policy.
+func (v *DynamicAuthorizationPolicyValidator) validate(ctx context.Context,
+	old *peerauthv1.DynamicAuthorizationPolicy, obj runtime.Object) error {
+	dap, ok := obj.(*peerauthv1.DynamicAuthorizationPolicy)
+	if !ok {
+		return errors.Errorf("expected a DynamicAuthorizationPolicy but got %T", obj)
+	}
+	tenancy, err := v.Tenancy.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]peerauthv1.HashSet{}
+	if old != nil {
+		for _, policy := range old.GetPolicies() {
+			existing[policy.Name] = peerauthv1.FromSlice(policy.Namespaces)
+		}
+	}
+
+	errs := field.ErrorList{}
+	if !dap.HasBackend(peerauthv1.BackendIstio) {
+		if dap.Spec.PeerAuthentication != nil {
+			errs = append(errs, field.Forbidden(field.NewPath("spec", "peerAuthentication"),
+				"requires the Istio backend"))
+		}
+		if dap.Spec.SidecarEgress != nil {
+			errs = append(errs, field.Forbidden(field.NewPath("spec", "sidecarEgress"),
+				"requires the Istio backend"))
+		}
+	}
+	for i, policy := range dap.GetPolicies() {
+		if policy.AuthorizationPolicyRule != nil && !dap.HasBackend(peerauthv1.BackendIstio) {
+			errs = append(errs, field.Forbidden(
+				field.NewPath("spec", "dynamicPolicies").Index(i).Child("authorizationPolicyRule"),
+				"requires the Istio backend"))
+		}
+		if dap.HasBackend(peerauthv1.BackendLinkerd) && policy.Server == "" && len(policy.WorkloadSelector) > 0 {
+			errs = append(errs, field.Required(
+				field.NewPath("spec", "dynamicPolicies").Index(i).Child("server"),
+				"the Linkerd backend needs a Server to honour workloadSelector"))
+		}
+		if _, err := policy.Selector(); err != nil {
+			errs = append(errs, field.Invalid(
+				field.NewPath("spec", "dynamicPolicies").Index(i).Child("podSelectorExpressions"),
+				policy.PodSelectorExpressions, err.Error()))
+		}
+		if ref := policy.AuthorizationPolicyRule; ref != nil && (ref.Index == nil) == (ref.Label == "") {
+			errs = append(errs, field.Invalid(
+				field.NewPath("spec", "dynamicPolicies").Index(i).Child("authorizationPolicyRule"),
+				ref, "exactly one of index and label must be set"))
+		}
+		for j, ns := range policy.Namespaces {
+			if !existing[policy.Name][ns] && !tenancy.Allows(dap.GetNamespace(), ns) {
+				errs = append(errs, field.Forbidden(
+					field.NewPath("spec", "dynamicPolicies").Index(i).Child("namespaces").Index(j),
+					"DynamicAuthorizationPolicies in namespace "+dap.GetNamespace()+
+						" may not select pods from namespace "+ns))
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return kerrors.NewInvalid(peerauthv1.GroupVersion.WithKind("DynamicAuthorizationPolicy").GroupKind(), dap.GetName(), errs)
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// Event reasons recorded on DynamicAuthorizationPolicies.
+const (
+	reasonApprovalRequired             = "ApprovalRequired"
+	reasonDriftCorrected               = "DriftCorrected"
+	reasonDryRun                       = "DryRun"
+	reasonNamespaceNotAllowed          = "NamespaceNotAllowed"
+	reasonNamespacesAllowed            = "NamespacesAllowed"
+	reasonNamespaceNotWatched          = "NamespaceNotWatched"
+	reasonNamespacesWatched            = "NamespacesWatched"
+	reasonObjectNotOwned               = "ObjectNotOwned"
+	reasonObjectsOwned                 = "ObjectsOwned"
+	reasonPermissivePeerAuthentication = "PermissivePeerAuthentication"
+	reasonPrincipalAdded               = "PrincipalAdded"
+	reasonPrincipalLimitExceeded       = "PrincipalLimitExceeded"
+	reasonPrincipalsWithinLimit        = "PrincipalsWithinLimit"
+	reasonPrincipalRemoved             = "PrincipalRemoved"
+	reasonSidecarEgress                = "SidecarEgress"
+	reasonSidecarEgressDisabled        = "SidecarEgressDisabled"
+	reasonSidecarOverlap               = "SidecarOverlap"
+	reasonStrictMTLS                   = "StrictMTLS"
+	reasonSyncFailed                   = "SyncFailed"
+)
+
+// recordPendingPrincipals stores the principals awaiting approval in the DAP's status,
+// emitting an Event listing those that were not already pending.
+func (r *DynamicAuthorizationPolicyReconciler) recordPendingPrincipals(dap *peerauthv1.DynamicAuthorizationPolicy,
+	pending map[string][]string) {
+	msgs := []string{}
+	for _, policy := range dap.GetPolicies() {
+		added := peerauthv1.FromSlice(pending[policy.Name]).Difference(
+			peerauthv1.FromSlice(dap.Status.PendingPrincipals[policy.Name]))
+		if len(added) > 0 {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", policy.Name, strings.Join(added, ", ")))
+		}
+	}
+	if len(msgs) > 0 {
+		r.Recorder.Event(dap, corev1.EventTypeNormal, reasonApprovalRequired, strings.Join(msgs, "; "))
+	}
+	dap.Status.PendingPrincipals = pending
+}
+
+// recordPrincipalChanges emits at most one PrincipalAdded and one PrincipalRemoved Event for
+// the changes applied in a reconcile, listing the affected principals per object.
+func (r *DynamicAuthorizationPolicyReconciler) recordPrincipalChanges(dap *peerauthv1.DynamicAuthorizationPolicy,
+	applied []authorizationPolicyChange) {
+	added, removed := []string{}, []string{}
+	for _, change := range applied {
+		intended := change.intended()
+		if len(intended.AddedPrincipals) > 0 {
+			added = append(added, fmt.Sprintf("%s: %s", intended.Object(), strings.Join(intended.AddedPrincipals, ", ")))
+		}
+		if len(intended.RemovedPrincipals) > 0 {
+			removed = append(removed, fmt.Sprintf("%s: %s", intended.Object(), strings.Join(intended.RemovedPrincipals, ", ")))
+		}
+	}
+	if len(added) > 0 {
+		r.Recorder.Event(dap, corev1.EventTypeNormal, reasonPrincipalAdded, strings.Join(added, "; "))
+	}
+	if len(removed) > 0 {
+		r.Recorder.Event(dap, corev1.EventTypeNormal, reasonPrincipalRemoved, strings.Join(removed, "; "))
+	}
+}
+
+// recordIntendedChanges stores the planned writes in the DAP's status instead of applying them,
+// emitting an Event whenever the plan differs from the one already recorded.
+func (r *DynamicAuthorizationPolicyReconciler) recordIntendedChanges(dap *peerauthv1.DynamicAuthorizationPolicy,
+	changes []authorizationPolicyChange) {
+	intended := []peerauthv1.IntendedChange{}
+	for _, change := range changes {
+		intended = append(intended, change.intended())
+	}
+	if len(intended) == 0 {
+		dap.Status.IntendedChanges = nil
+		return
+	}
+	if !equality.Semantic.DeepEqual(intended, dap.Status.IntendedChanges) {
+		r.Recorder.Event(dap, corev1.EventTypeNormal, reasonDryRun, intendedChangesMessage(intended))
+	}
+	dap.Status.IntendedChanges = intended
+}
+
+func intendedChangesMessage(intended []peerauthv1.IntendedChange) string {
+	msgs := []string{}
+	for _, change := range intended {
+		msgs = append(msgs, fmt.Sprintf("would %s %s (+%d/-%d principals)",
+			strings.ToLower(string(change.Action)), change.Object(),
+			len(change.AddedPrincipals), len(change.RemovedPrincipals)))
+	}
+	return strings.Join(msgs, "; ")
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// FeaturePrincipalIndex keeps each DAP's principals current from pod events instead of
+	// relisting pods on every reconcile.
+	FeaturePrincipalIndex = "PrincipalIndex"
+	// FeatureValidatingWebhook serves the DynamicAuthorizationPolicy validating webhook.
+	FeatureValidatingWebhook = "ValidatingWebhook"
+	// FeatureSidecarEgress generates Sidecars for the callers of DAPs setting sidecarEgress.
+	FeatureSidecarEgress = "SidecarEgress"
+)
+
+// FeatureGates enables or disables optional controller features by name. It implements
+// flag.Value, parsing a comma separated list of name=bool pairs.
+type FeatureGates map[string]bool
+
+// DefaultFeatureGates returns every known feature gate with its default.
+func DefaultFeatureGates() FeatureGates {
+	return FeatureGates{
+		FeaturePrincipalIndex:    true,
+		FeatureValidatingWebhook: true,
+		FeatureSidecarEgress:     false,
+	}
+}
+
+// Enabled reports whether the named feature is enabled.
+func (g FeatureGates) Enabled(name string) bool {
+	return g[name]
+}
+
+// Merge overrides the gates with those in other, rejecting unknown features.
+func (g FeatureGates) Merge(other map[string]bool) error {
+	known := DefaultFeatureGates()
+	for name, enabled := range other {
+		if _, ok := known[name]; !ok {
+			return errors.Errorf("unknown feature gate %q", name)
+		}
+		g[name] = enabled
+	}
+	return nil
+}
+
+func (g FeatureGates) String() string {
+	pairs := []string{}
+	for name, enabled := range g {
+		pairs = append(pairs, fmt.Sprintf("%s=%t", name, enabled))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (g FeatureGates) Set(value string) error {
+	gates := map[string]bool{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("feature gate %q must be given as name=bool", pair)
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse feature gate %q", pair)
+		}
+		gates[strings.TrimSpace(kv[0])] = enabled
+	}
+	return g.Merge(gates)
+}
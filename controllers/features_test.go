@@ -0,0 +1,68 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestFeatureGates(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		args    []string
+		want    map[string]bool
+		wantErr bool
+	}{
+		"defaults": {
+			want: map[string]bool{FeaturePrincipalIndex: true, FeatureValidatingWebhook: true},
+		},
+		"disable one": {
+			args: []string{"--feature-gates=PrincipalIndex=false"},
+			want: map[string]bool{FeaturePrincipalIndex: false, FeatureValidatingWebhook: true},
+		},
+		"repeated flag": {
+			args: []string{"--feature-gates=PrincipalIndex=false, ValidatingWebhook=false", "--feature-gates=PrincipalIndex=true"},
+			want: map[string]bool{FeaturePrincipalIndex: true, FeatureValidatingWebhook: false},
+		},
+		"unknown gate": {
+			args:    []string{"--feature-gates=Unknown=true"},
+			wantErr: true,
+		},
+		"missing value": {
+			args:    []string{"--feature-gates=PrincipalIndex"},
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		gates := DefaultFeatureGates()
+		fs := flag.NewFlagSet(name, flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.Var(gates, "feature-gates", "")
+		err := fs.Parse(tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %t", name, err, tt.wantErr)
+			continue
+		}
+		for feature, enabled := range tt.want {
+			if gates.Enabled(feature) != enabled {
+				t.Errorf("%s: %s enabled = %t, want %t (%s)", name, feature, !enabled, enabled, gates)
+			}
+		}
+	}
+}
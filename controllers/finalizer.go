@@ -0,0 +1,126 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// dapFinalizer keeps a DAP until the resources generated for it in other namespaces and the
+// rules it merged principals into in user-authored AuthorizationPolicies, which owner references
+// cannot clean up, are removed.
+const dapFinalizer = "peerauth.aweis.io/cleanup"
+
+// finalizerFieldManager applies dapFinalizer. It is separate from fieldManager so the finalizer
+// is only ever added or removed by applyFinalizer.
+const finalizerFieldManager = "dynamic-authorization-policy-finalizer"
+
+// applyFinalizer adds or removes dapFinalizer, updating the DAP's finalizers and resourceVersion.
+func (r *DynamicAuthorizationPolicyReconciler) applyFinalizer(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy, present bool) error {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(peerauthv1.GroupVersion.WithKind("DynamicAuthorizationPolicy"))
+	obj.SetName(dap.GetName())
+	obj.SetNamespace(dap.GetNamespace())
+	obj.SetResourceVersion(dap.GetResourceVersion())
+	if present {
+		obj.SetFinalizers([]string{dapFinalizer})
+	}
+	if err := r.apply(ctx, obj, finalizerFieldManager); err != nil {
+		return errors.Wrapf(err, "unable to apply finalizer to DynamicAuthorizationPolicy %s", client.ObjectKeyFromObject(dap))
+	}
+	dap.SetFinalizers(obj.GetFinalizers())
+	dap.SetResourceVersion(obj.GetResourceVersion())
+	return nil
+}
+
+// finalize removes what the DAP generated or merged and then its finalizer. Cleanup does not
+// depend on the DAP's current mode: a DAP switched to dry run after being enforced still leaves
+// what it wrote behind otherwise. The removals are reported like the ones reconcile applies.
+func (r *DynamicAuthorizationPolicyReconciler) finalize(ctx context.Context, dap *peerauthv1.DynamicAuthorizationPolicy) error {
+	if !controllerutil.ContainsFinalizer(dap, dapFinalizer) {
+		return nil
+	}
+	changes, err := r.planCleanup(ctx, dap)
+	if err != nil {
+		return withReason(errorReasonSync, err)
+	}
+	applied, err := r.applyAuthorizationPolicies(ctx, dap, changes)
+	r.recordPrincipalChanges(dap, applied)
+	r.audit(ctx, dap, applied, nil)
+	if err != nil {
+		return withReason(errorReasonSync, err)
+	}
+	if err := r.applyFinalizer(ctx, dap, false); err != nil {
+		return withReason(errorReasonStatus, err)
+	}
+	exportedPolicies.clear(client.ObjectKeyFromObject(dap))
+	return nil
+}
+
+// planCleanup returns the writes deleting the resources generated for the DAP and releasing the
+// rules of user-authored AuthorizationPolicies it merged principals into. Rules are only
+// released once the DAP was enforced, as recorded by status.backends, so a DAP that only ever
+// ran dry leaves the user's rules alone.
+func (r *DynamicAuthorizationPolicyReconciler) planCleanup(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy) ([]authorizationPolicyChange, error) {
+	changes := []authorizationPolicyChange{}
+	for _, gvk := range ownedKinds(dap) {
+		generated := &unstructured.UnstructuredList{}
+		generated.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		err := r.List(ctx, generated, client.InNamespace(dap.GetNamespace()), client.MatchingLabels{dapLabel: dap.GetName()})
+		if meta.IsNoMatchError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to list generated %ss", gvk.Kind)
+		}
+		for i := range generated.Items {
+			if metav1.IsControlledBy(&generated.Items[i], dap) {
+				changes = append(changes, authorizationPolicyChange{action: peerauthv1.ChangeDelete, existing: &generated.Items[i]})
+			}
+		}
+	}
+
+	// Sidecars shared with other DAPs keep the egress those grant.
+	tenancy, err := r.Tenancy.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sidecars, _, err := r.planSidecars(ctx, dap, tenancy, nil)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, sidecars...)
+
+	if len(dap.Status.Backends) == 0 {
+		return changes, nil
+	}
+	releases, err := r.planMergedRuleReleases(ctx, dap)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, releases...), nil
+}
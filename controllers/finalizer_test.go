@@ -0,0 +1,209 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+func TestReconcileFinalizer(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: "client", Labels: map[string]string{"app": "caller"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	shared := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"rules": []interface{}{map[string]interface{}{}}},
+	}}
+	shared.SetGroupVersionKind(AuthorizationPolicyGVK)
+	shared.SetName("shared")
+	shared.SetNamespace("server")
+	index := int32(0)
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{
+				{Name: "generated", PodSelectors: map[string]string{"app": "caller"}},
+				{
+					Name:                    "merged",
+					PodSelectors:            map[string]string{"app": "caller"},
+					AuthorizationPolicyRule: &peerauthv1.AuthorizationPolicyRuleRef{Name: "shared", Index: &index},
+				},
+			},
+			SidecarEgress: &peerauthv1.SidecarEgress{},
+		},
+	}
+	rt := newReconcilerTest(t, dap, caller, shared)
+	c := rt.c
+	rt.SidecarEgress = true
+
+	sidecar := sidecarWorkload{namespace: "client", selector: "app=caller"}.key()
+	got := rt.reconcileDAP(dap)
+	if !controllerutil.ContainsFinalizer(got, dapFinalizer) {
+		t.Fatalf("finalizers = %v, want %s", got.GetFinalizers(), dapFinalizer)
+	}
+	if _, err := rt.get(SidecarGVK, sidecar); err != nil {
+		t.Fatalf("generated Sidecar: %v", err)
+	}
+
+	if err := c.Delete(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(dap)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(dap), got); !kerrors.IsNotFound(err) {
+		t.Errorf("DAP not deleted after cleanup: %v, finalizers %v", err, got.GetFinalizers())
+	}
+	if _, err := rt.get(SidecarGVK, sidecar); err == nil {
+		t.Error("Sidecar in another namespace survived the DAP's deletion")
+	}
+	if _, err := rt.get(AuthorizationPolicyGVK, client.ObjectKey{Namespace: "server", Name: "generated"}); err == nil {
+		t.Error("generated AuthorizationPolicy survived the DAP's deletion")
+	}
+	ap, err := rt.get(AuthorizationPolicyGVK, client.ObjectKey{Namespace: "server", Name: "shared"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{map[string]interface{}{
+		"from": []interface{}{map[string]interface{}{"source": map[string]interface{}{"principals": []interface{}{noPrincipals}}}},
+	}}
+	if rules, _, _ := unstructured.NestedSlice(ap.Object, "spec", "rules"); !reflect.DeepEqual(rules, want) {
+		t.Errorf("shared rules = %v, want the merged rule kept without the DAP's principals", rules)
+	}
+}
+
+func TestFinalizeWithoutMergeTarget(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	index := int32(0)
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:                    "merged",
+				AuthorizationPolicyRule: &peerauthv1.AuthorizationPolicyRuleRef{Name: "gone", Index: &index},
+			}},
+		},
+	}
+	rt := newReconcilerTest(t, dap)
+	if err := rt.applyFinalizer(ctx, dap, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.finalize(ctx, dap); err != nil {
+		t.Fatalf("finalize with a missing AuthorizationPolicy: %v", err)
+	}
+	if controllerutil.ContainsFinalizer(dap, dapFinalizer) {
+		t.Error("finalizer kept")
+	}
+}
+
+func TestFinalizeAfterSwitchingToDryRun(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: "client", Labels: map[string]string{"app": "caller"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	shared := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"rules": []interface{}{map[string]interface{}{}}},
+	}}
+	shared.SetGroupVersionKind(AuthorizationPolicyGVK)
+	shared.SetName("shared")
+	shared.SetNamespace("server")
+	index := int32(0)
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:                    "merged",
+				TrustDomain:             "cluster.local",
+				PodSelectors:            map[string]string{"app": "caller"},
+				AuthorizationPolicyRule: &peerauthv1.AuthorizationPolicyRuleRef{Name: "shared", Index: &index},
+			}},
+			SidecarEgress: &peerauthv1.SidecarEgress{},
+		},
+	}
+	c := newApplyClient(fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(dap, caller, shared).Build())
+	recorder := record.NewFakeRecorder(100)
+	audit := &bytes.Buffer{}
+	r := &DynamicAuthorizationPolicyReconciler{
+		Client: c, Scheme: c.Scheme(), Recorder: recorder, Audit: NewJSONLinesAuditSink(audit), SidecarEgress: true,
+	}
+	reconcile := func() *peerauthv1.DynamicAuthorizationPolicy {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(dap)}); err != nil {
+			t.Fatal(err)
+		}
+		got := &peerauthv1.DynamicAuthorizationPolicy{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(dap), got); err != nil && !kerrors.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	got := reconcile()
+	got.Spec.Mode = peerauthv1.ModeDryRun
+	if err := c.Update(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	got = reconcile()
+	if err := c.Delete(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	for len(recorder.Events) > 0 {
+		<-recorder.Events
+	}
+	audit.Reset()
+	reconcile()
+
+	sidecar := &unstructured.Unstructured{}
+	sidecar.SetGroupVersionKind(SidecarGVK)
+	if err := c.Get(ctx, sidecarWorkload{namespace: "client", selector: "app=caller"}.key(), sidecar); err == nil {
+		t.Error("Sidecar survived deleting a DAP switched to dry run")
+	}
+	ap := &unstructured.Unstructured{}
+	ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+	if err := c.Get(ctx, client.ObjectKeyFromObject(shared), ap); err != nil {
+		t.Fatal(err)
+	}
+	if principals := authorizationPolicyPrincipals(ap); len(principals) != 0 {
+		t.Errorf("shared AuthorizationPolicy still grants %v", principals.Slice())
+	}
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Normal PrincipalRemoved AuthorizationPolicy.security.istio.io shared: cluster.local/ns/client/sa/caller") {
+		t.Errorf("event = %q, want the merged principal's removal", event)
+	}
+	if !strings.Contains(audit.String(), `"action":"`+string(AuditRevoke)+`"`) {
+		t.Errorf("audit log = %q, want the revocation recorded", audit.String())
+	}
+}
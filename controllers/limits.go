@@ -0,0 +1,80 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// maxPrincipals returns the number of principals policy may grant, or 0 when unlimited.
+func maxPrincipals(policy peerauthv1.DynamicPolicy, defaultMax int) int {
+	if policy.MaxPrincipals != nil {
+		return int(*policy.MaxPrincipals)
+	}
+	return defaultMax
+}
+
+// limitPrincipals replaces the principals of every policy selecting more than it may grant
+// with those it was last granted, returning the number selected by each such policy.
+func limitPrincipals(dap *peerauthv1.DynamicAuthorizationPolicy, res *Resolution, defaultMax int) map[string]int {
+	exceeded := map[string]int{}
+	for _, policy := range dap.GetPolicies() {
+		limit := maxPrincipals(policy, defaultMax)
+		if selected := len(res.Mapping[policy.Name]); limit > 0 && selected > limit {
+			exceeded[policy.Name] = selected
+			res.Mapping[policy.Name] = peerauthv1.FromSlice(
+				dap.Status.ServiceAccountPolicyMapping[policy.Name].Difference(nil))
+		}
+	}
+	return exceeded
+}
+
+// recordPrincipalLimits sets the Degraded condition, emitting a warning Event when a policy
+// starts exceeding its limit or the number of principals it selects changes.
+func (r *DynamicAuthorizationPolicyReconciler) recordPrincipalLimits(dap *peerauthv1.DynamicAuthorizationPolicy,
+	exceeded map[string]int) {
+	condition := metav1.Condition{
+		Type:               peerauthv1.ConditionDegraded,
+		Status:             metav1.ConditionFalse,
+		Reason:             reasonPrincipalsWithinLimit,
+		Message:            "all policies select no more principals than they may grant",
+		ObservedGeneration: dap.GetGeneration(),
+	}
+	if len(exceeded) > 0 {
+		msgs := []string{}
+		for _, policy := range dap.GetPolicies() {
+			if selected, ok := exceeded[policy.Name]; ok {
+				msgs = append(msgs, fmt.Sprintf("policy %s selects %d principals but may grant at most %d; "+
+					"keeping the last-known-good principals", policy.Name, selected, maxPrincipals(policy, r.MaxPrincipals)))
+			}
+		}
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = reasonPrincipalLimitExceeded
+		condition.Message = strings.Join(msgs, "; ")
+		if previous := meta.FindStatusCondition(dap.Status.Conditions, condition.Type); previous == nil ||
+			previous.Message != condition.Message {
+			r.Recorder.Event(dap, corev1.EventTypeWarning, reasonPrincipalLimitExceeded, condition.Message)
+		}
+	}
+	meta.SetStatusCondition(&dap.Status.Conditions, condition)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestMaxPrincipals(t *testing.T) {
+	t.Parallel()
+	one := int32(1)
+	tests := map[string]struct {
+		policyMax  *int32
+		defaultMax int
+		want       int
+	}{
+		"unlimited":        {nil, 0, 0},
+		"default":          {nil, 5, 5},
+		"policy overrides": {&one, 5, 1},
+	}
+	for name, tt := range tests {
+		if got := maxPrincipals(peerauthv1.DynamicPolicy{MaxPrincipals: tt.policyMax}, tt.defaultMax); got != tt.want {
+			t.Errorf("%s: maxPrincipals = %d, want %d", name, got, tt.want)
+		}
+	}
+}
+
+func TestReconcilePrincipalLimit(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	pod := func(sa string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: sa, Namespace: "default", Labels: map[string]string{"app": "caller"}},
+			Spec:       corev1.PodSpec{ServiceAccountName: sa},
+		}
+	}
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "default"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:         "policy",
+				TrustDomain:  "cluster.local",
+				PodSelectors: map[string]string{"app": "caller"},
+			}},
+		},
+	}
+	rt := newReconcilerTest(t, dap, pod("a"))
+	c := rt.c
+	recorder := rt.recorder
+	rt.MaxPrincipals = 1
+	granted := func() []string {
+		t.Helper()
+		ap := &unstructured.Unstructured{}
+		ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+		if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "policy"}, ap); err != nil {
+			t.Fatal(err)
+		}
+		return authorizationPolicyPrincipals(ap).Difference(nil)
+	}
+	want := []string{"cluster.local/ns/default/sa/a"}
+
+	got := rt.reconcileDAP(dap)
+	if meta.IsStatusConditionTrue(got.Status.Conditions, peerauthv1.ConditionDegraded) {
+		t.Errorf("unexpected %s condition within the limit", peerauthv1.ConditionDegraded)
+	}
+
+	if err := c.Create(ctx, pod("b")); err != nil {
+		t.Fatal(err)
+	}
+	got = rt.reconcileDAP(dap)
+	if principals := got.Status.ServiceAccountPolicyMapping["policy"].Difference(nil); !reflect.DeepEqual(principals, want) {
+		t.Errorf("status principals = %v, want last-known-good %v", principals, want)
+	}
+	if principals := granted(); !reflect.DeepEqual(principals, want) {
+		t.Errorf("AuthorizationPolicy principals = %v, want last-known-good %v", principals, want)
+	}
+	condition := meta.FindStatusCondition(got.Status.Conditions, peerauthv1.ConditionDegraded)
+	if condition == nil || condition.Status != metav1.ConditionTrue || condition.Reason != reasonPrincipalLimitExceeded {
+		t.Errorf("unexpected %s condition %+v", peerauthv1.ConditionDegraded, condition)
+	}
+	found := false
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; strings.HasPrefix(event, "Warning PrincipalLimitExceeded ") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected a PrincipalLimitExceeded warning event")
+	}
+
+	got.Spec.DynamicPolicies[0].MaxPrincipals = new(int32)
+	*got.Spec.DynamicPolicies[0].MaxPrincipals = 2
+	if err := c.Update(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	got = rt.reconcileDAP(dap)
+	if principals := granted(); len(principals) != 2 {
+		t.Errorf("AuthorizationPolicy principals = %v, want both once the limit is raised", principals)
+	}
+	if meta.IsStatusConditionTrue(got.Status.Conditions, peerauthv1.ConditionDegraded) {
+		t.Errorf("%s condition not cleared once the limit is raised", peerauthv1.ConditionDegraded)
+	}
+}
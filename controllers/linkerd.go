@@ -0,0 +1,146 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Linkerd policy kinds generated by the Linkerd backend.
+var (
+	LinkerdAuthorizationPolicyGVK = schema.GroupVersionKind{ // nolint:gochecknoglobals
+		Group:   "policy.linkerd.io",
+		Version: "v1alpha1",
+		Kind:    "AuthorizationPolicy",
+	}
+	MeshTLSAuthenticationGVK = schema.GroupVersionKind{ // nolint:gochecknoglobals
+		Group:   "policy.linkerd.io",
+		Version: "v1alpha1",
+		Kind:    "MeshTLSAuthentication",
+	}
+)
+
+// linkerdIdentityInfix separates a service account's name and namespace from the trust domain
+// in a Linkerd identity.
+const linkerdIdentityInfix = ".serviceaccount.identity.linkerd."
+
+// noLinkerdIdentity authenticates policies without principals. A MeshTLSAuthentication needs
+// an identity, so the policy fails closed on one no workload has.
+const noLinkerdIdentity = "no-principals.peerauth.aweis.io"
+
+// linkerdBackend generates, per policy, a MeshTLSAuthentication of the policy's identities and
+// an AuthorizationPolicy requiring it for the policy's Server or the DAP's namespace.
+type linkerdBackend struct{}
+
+func (linkerdBackend) Generate(dap *peerauthv1.DynamicAuthorizationPolicy,
+	sapm peerauthv1.ServiceAccountPolicyMapping) ([]*unstructured.Unstructured, error) {
+	objs := []*unstructured.Unstructured{}
+	for _, policy := range dap.GetPolicies() {
+		if policy.Server == "" && len(policy.WorkloadSelector) > 0 {
+			return nil, errors.Errorf("policy %s needs a Server for the Linkerd backend to honour its workloadSelector",
+				policy.Name)
+		}
+		identities := []interface{}{}
+		for _, principal := range sapm[policy.Name].Slice() {
+			if identity, ok := linkerdIdentity(principal); ok {
+				identities = append(identities, identity)
+			}
+		}
+		if len(identities) == 0 {
+			identities = append(identities, noLinkerdIdentity)
+		}
+		authn := linkerdObject(dap, MeshTLSAuthenticationGVK, policy.Name)
+		authn.Object["spec"] = map[string]interface{}{"identities": identities}
+
+		target := map[string]interface{}{"kind": "Namespace", "name": dap.GetNamespace()}
+		if policy.Server != "" {
+			target = map[string]interface{}{"group": "policy.linkerd.io", "kind": "Server", "name": policy.Server}
+		}
+		authz := linkerdObject(dap, LinkerdAuthorizationPolicyGVK, policy.Name)
+		authz.Object["spec"] = map[string]interface{}{
+			"targetRef": target,
+			"requiredAuthenticationRefs": []interface{}{map[string]interface{}{
+				"group": MeshTLSAuthenticationGVK.Group,
+				"kind":  MeshTLSAuthenticationGVK.Kind,
+				"name":  policy.Name,
+			}},
+		}
+		objs = append(objs, authn, authz)
+	}
+	return objs, nil
+}
+
+func (linkerdBackend) Kinds() []schema.GroupVersionKind {
+	return []schema.GroupVersionKind{MeshTLSAuthenticationGVK, LinkerdAuthorizationPolicyGVK}
+}
+
+// Principals returns the principals a MeshTLSAuthentication authenticates. AuthorizationPolicies
+// only reference them, so grant none.
+func (linkerdBackend) Principals(obj *unstructured.Unstructured) peerauthv1.HashSet {
+	principals := peerauthv1.HashSet{}
+	if obj.GroupVersionKind().GroupKind() != MeshTLSAuthenticationGVK.GroupKind() {
+		return principals
+	}
+	identities, _, _ := unstructured.NestedStringSlice(obj.Object, "spec", "identities")
+	for _, identity := range identities {
+		if principal, ok := linkerdPrincipal(identity); ok {
+			principals.Add(principal)
+		}
+	}
+	return principals
+}
+
+func linkerdObject(dap *peerauthv1.DynamicAuthorizationPolicy, gvk schema.GroupVersionKind, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	obj.SetName(name)
+	obj.SetNamespace(dap.GetNamespace())
+	obj.SetLabels(map[string]string{dapLabel: dap.GetName()})
+	return obj
+}
+
+// linkerdIdentity converts a principal of the form <trust domain>/ns/<namespace>/sa/<name> to
+// the Linkerd identity of the same service account.
+func linkerdIdentity(principal string) (string, bool) {
+	parts := strings.Split(principal, "/")
+	if len(parts) != 5 || parts[1] != "ns" || parts[3] != "sa" {
+		return "", false
+	}
+	return fmt.Sprintf("%s.%s%s%s", parts[4], parts[2], linkerdIdentityInfix, parts[0]), true
+}
+
+// linkerdPrincipal converts a Linkerd identity back to a principal. Namespaces cannot contain
+// dots, so the service account's name ends at the last dot before the namespace.
+func linkerdPrincipal(identity string) (string, bool) {
+	parts := strings.SplitN(identity, linkerdIdentityInfix, 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	i := strings.LastIndex(parts[0], ".")
+	if i < 0 {
+		return "", false
+	}
+	return fmt.Sprintf("%s/ns/%s/sa/%s", parts[1], parts[0][i+1:], parts[0][:i]), true
+}
+
+//+kubebuilder:rbac:groups=policy.linkerd.io,resources=authorizationpolicies;meshtlsauthentications,verbs=get;list;watch;create;update;patch;delete
@@ -0,0 +1,296 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestLinkerdIdentity(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		principal string
+		identity  string
+		ok        bool
+	}{
+		"service account": {
+			principal: "cluster.local/ns/client/sa/caller",
+			identity:  "caller.client.serviceaccount.identity.linkerd.cluster.local",
+			ok:        true,
+		},
+		"dotted service account": {
+			principal: "example.org/ns/client/sa/batch.v2",
+			identity:  "batch.v2.client.serviceaccount.identity.linkerd.example.org",
+			ok:        true,
+		},
+		"not a service account": {principal: "cluster.local/ns/client"},
+	}
+	for name, tt := range tests {
+		identity, ok := linkerdIdentity(tt.principal)
+		if identity != tt.identity || ok != tt.ok {
+			t.Errorf("%s: linkerdIdentity = %q, %v, want %q, %v", name, identity, ok, tt.identity, tt.ok)
+		}
+		if !tt.ok {
+			continue
+		}
+		if principal, ok := linkerdPrincipal(identity); principal != tt.principal || !ok {
+			t.Errorf("%s: linkerdPrincipal = %q, %v, want %q", name, principal, ok, tt.principal)
+		}
+	}
+	if _, ok := linkerdPrincipal(noLinkerdIdentity); ok {
+		t.Error("the no-principals identity converted to a principal")
+	}
+}
+
+func TestLinkerdBackend(t *testing.T) {
+	t.Parallel()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			Backends: []peerauthv1.Backend{peerauthv1.BackendLinkerd},
+			DynamicPolicies: []peerauthv1.DynamicPolicy{
+				{Name: "api", Server: "api-http", WorkloadSelector: map[string]string{"app": "api"}},
+				{Name: "namespace"},
+			},
+		},
+	}
+	sapm := peerauthv1.ServiceAccountPolicyMapping{
+		"api": peerauthv1.HashSet{"cluster.local/ns/b/sa/caller": true, "cluster.local/ns/a/sa/caller": true},
+	}
+	objs, err := linkerdBackend{}.Generate(dap, sapm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]interface{}{}
+	for _, obj := range objs {
+		if obj.GetLabels()[dapLabel] != "dap" || obj.GetNamespace() != "server" {
+			t.Errorf("%s %s labels = %v", obj.GetKind(), client.ObjectKeyFromObject(obj), obj.GetLabels())
+		}
+		got[obj.GetKind()+"/"+obj.GetName()] = obj.Object["spec"]
+	}
+	authn := func(name string) []interface{} {
+		return []interface{}{map[string]interface{}{
+			"group": "policy.linkerd.io", "kind": "MeshTLSAuthentication", "name": name,
+		}}
+	}
+	want := map[string]interface{}{
+		"MeshTLSAuthentication/api": map[string]interface{}{"identities": []interface{}{
+			"caller.a.serviceaccount.identity.linkerd.cluster.local",
+			"caller.b.serviceaccount.identity.linkerd.cluster.local",
+		}},
+		"AuthorizationPolicy/api": map[string]interface{}{
+			"targetRef":                  map[string]interface{}{"group": "policy.linkerd.io", "kind": "Server", "name": "api-http"},
+			"requiredAuthenticationRefs": authn("api"),
+		},
+		"MeshTLSAuthentication/namespace": map[string]interface{}{"identities": []interface{}{noLinkerdIdentity}},
+		"AuthorizationPolicy/namespace": map[string]interface{}{
+			"targetRef":                  map[string]interface{}{"kind": "Namespace", "name": "server"},
+			"requiredAuthenticationRefs": authn("namespace"),
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Linkerd specs = %v, want %v", got, want)
+	}
+	if principals := generatedPrincipals(objs[0]); !reflect.DeepEqual(principals, sapm["api"]) {
+		t.Errorf("MeshTLSAuthentication principals = %v, want %v", principals, sapm["api"])
+	}
+	if principals := generatedPrincipals(objs[2]); len(principals) != 0 {
+		t.Errorf("fail-closed MeshTLSAuthentication principals = %v, want none", principals)
+	}
+
+	dap.Spec.DynamicPolicies[0].Server = ""
+	if _, err := (linkerdBackend{}).Generate(dap, sapm); err == nil {
+		t.Error("generated a namespace-wide Linkerd policy for a workloadSelector")
+	}
+}
+
+func TestValidateBackends(t *testing.T) {
+	t.Parallel()
+	validator := &DynamicAuthorizationPolicyValidator{}
+	linkerd := func(mutate func(*peerauthv1.DynamicAuthorizationPolicy)) *peerauthv1.DynamicAuthorizationPolicy {
+		dap := tenancyDAP()
+		dap.Spec.Backends = []peerauthv1.Backend{peerauthv1.BackendLinkerd}
+		mutate(dap)
+		return dap
+	}
+	for name, dap := range map[string]*peerauthv1.DynamicAuthorizationPolicy{
+		"peerAuthentication": linkerd(func(dap *peerauthv1.DynamicAuthorizationPolicy) {
+			dap.Spec.PeerAuthentication = &peerauthv1.PeerAuthentication{}
+		}),
+		"sidecarEgress": linkerd(func(dap *peerauthv1.DynamicAuthorizationPolicy) {
+			dap.Spec.SidecarEgress = &peerauthv1.SidecarEgress{}
+		}),
+		"authorizationPolicyRule": linkerd(func(dap *peerauthv1.DynamicAuthorizationPolicy) {
+			dap.Spec.DynamicPolicies[0].AuthorizationPolicyRule = &peerauthv1.AuthorizationPolicyRuleRef{Name: "handwritten", Label: "callers"}
+		}),
+		"workloadSelector without server": linkerd(func(dap *peerauthv1.DynamicAuthorizationPolicy) {
+			dap.Spec.DynamicPolicies[0].WorkloadSelector = map[string]string{"app": "api"}
+		}),
+	} {
+		if err := validator.ValidateCreate(context.Background(), dap); err == nil {
+			t.Errorf("%s accepted with the Linkerd backend", name)
+		}
+	}
+	dap := linkerd(func(dap *peerauthv1.DynamicAuthorizationPolicy) {
+		dap.Spec.DynamicPolicies[0].WorkloadSelector = map[string]string{"app": "api"}
+		dap.Spec.DynamicPolicies[0].Server = "api-http"
+	})
+	if err := validator.ValidateCreate(context.Background(), dap); err != nil {
+		t.Errorf("Linkerd DAP with a Server rejected: %v", err)
+	}
+}
+
+func TestReconcileSwitchBackends(t *testing.T) {
+	t.Parallel()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "default"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:         "policy",
+				TrustDomain:  "cluster.local",
+				PodSelectors: map[string]string{"app": "caller"},
+			}},
+		},
+	}
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: "default", Labels: map[string]string{"app": "caller"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	rt := newReconcilerTest(t, dap, caller)
+	recorder := rt.recorder
+	exists := func(gvk schema.GroupVersionKind) bool {
+		t.Helper()
+		_, err := rt.get(gvk, client.ObjectKey{Namespace: "default", Name: "policy"})
+		if err != nil && !kerrors.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+	setBackends := func(backends ...peerauthv1.Backend) {
+		t.Helper()
+		rt.update(dap, func(got *peerauthv1.DynamicAuthorizationPolicy) { got.Spec.Backends = backends })
+		rt.reconcileDAP(dap)
+	}
+
+	rt.reconcileDAP(dap)
+	if !exists(AuthorizationPolicyGVK) || exists(LinkerdAuthorizationPolicyGVK) {
+		t.Fatal("default backend did not generate only an Istio AuthorizationPolicy")
+	}
+
+	setBackends(peerauthv1.BackendLinkerd)
+	if exists(AuthorizationPolicyGVK) {
+		t.Error("Istio AuthorizationPolicy survived switching to the Linkerd backend")
+	}
+	if !exists(LinkerdAuthorizationPolicyGVK) || !exists(MeshTLSAuthenticationGVK) {
+		t.Error("Linkerd backend did not generate its objects")
+	}
+
+	setBackends(peerauthv1.BackendIstio, peerauthv1.BackendLinkerd)
+	if !exists(AuthorizationPolicyGVK) || !exists(LinkerdAuthorizationPolicyGVK) {
+		t.Error("both backends did not generate their objects")
+	}
+	for len(recorder.Events) > 0 {
+		if e := <-recorder.Events; strings.Contains(e, reasonDriftCorrected) {
+			t.Errorf("switching backends recorded %q", e)
+		}
+	}
+}
+
+// noIstioClient serves no Istio kinds, as in a cluster running only Linkerd, counting the
+// attempts to list them.
+type noIstioClient struct {
+	client.Client
+	lists int
+}
+
+func (c *noIstioClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	gvk := list.GetObjectKind().GroupVersionKind()
+	if strings.HasSuffix(gvk.Group, "istio.io") {
+		c.lists++
+		return &meta.NoKindMatchError{GroupKind: gvk.GroupKind(), SearchedVersions: []string{gvk.Version}}
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestReconcileLinkerdWithoutIstio(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "default"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			Backends: []peerauthv1.Backend{peerauthv1.BackendLinkerd},
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:         "policy",
+				TrustDomain:  "cluster.local",
+				PodSelectors: map[string]string{"app": "caller"},
+			}},
+		},
+	}
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: "default", Labels: map[string]string{"app": "caller"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	c := &noIstioClient{Client: newApplyClient(fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(dap, caller).Build())}
+	r := &DynamicAuthorizationPolicyReconciler{Client: c, Scheme: c.Scheme(), Recorder: record.NewFakeRecorder(10)}
+	reconcile := func() {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(dap)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Until status records the backends written, the default Istio's kinds are listed, and
+	// found not to be served.
+	reconcile()
+	policy := &unstructured.Unstructured{}
+	policy.SetGroupVersionKind(LinkerdAuthorizationPolicyGVK)
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "policy"}, policy); err != nil {
+		t.Fatalf("Linkerd AuthorizationPolicy not generated: %v", err)
+	}
+
+	c.lists = 0
+	reconcile()
+	got := &peerauthv1.DynamicAuthorizationPolicy{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(dap), got); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if c.lists != 0 {
+		t.Errorf("a Linkerd-only DAP listed Istio kinds %d times", c.lists)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(policy), policy); !kerrors.IsNotFound(err) {
+		t.Errorf("Linkerd AuthorizationPolicy survived deleting the DAP: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Contributors records the pods that contributed each principal, keyed by policy name and then principal.
+type Contributors map[string]map[string][]types.NamespacedName
+
+func (c Contributors) add(policy, principal string, pod types.NamespacedName) {
+	if c[policy] == nil {
+		c[policy] = map[string][]types.NamespacedName{}
+	}
+	c[policy][principal] = append(c[policy][principal], pod)
+}
+
+// remove drops pod from the contributors of principal, and the principal once no pods remain.
+func (c Contributors) remove(policy, principal string, pod types.NamespacedName) {
+	pods := c[policy][principal]
+	for i := range pods {
+		if pods[i] == pod {
+			pods = append(pods[:i:i], pods[i+1:]...)
+			break
+		}
+	}
+	if len(pods) > 0 {
+		c[policy][principal] = pods
+		return
+	}
+	delete(c[policy], principal)
+	if len(c[policy]) == 0 {
+		delete(c, policy)
+	}
+}
+
+func (c Contributors) copy() Contributors {
+	out := Contributors{}
+	for policy, principals := range c {
+		for principal, pods := range principals {
+			for _, pod := range pods {
+				out.add(policy, principal, pod)
+			}
+		}
+	}
+	return out
+}
+
+// Pods returns the pods that contributed principal to policy, sorted by namespace and name.
+func (c Contributors) Pods(policy, principal string) []types.NamespacedName {
+	pods := append([]types.NamespacedName{}, c[policy][principal]...)
+	sortNamespacedNames(pods)
+	return pods
+}
+
+func sortNamespacedNames(names []types.NamespacedName) {
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].String() < names[j].String()
+	})
+}
+
+// Resolution is the result of mapping a DynamicAuthorizationPolicy's selectors onto pods.
+type Resolution struct {
+	Mapping      peerauthv1.ServiceAccountPolicyMapping
+	Contributors Contributors
+	// Pending holds, per policy, selected principals withheld from Mapping until approved.
+	Pending map[string][]string
+	// Violations holds, per policy, the listed namespaces the tenancy policy does not allow.
+	Violations map[string][]string
+}
+
+// Resolve lists the pods selected by each of the DAP's policies and maps them to principals.
+// It is shared by the reconciler and the kubectl-dap plugin so both compute identical mappings.
+// Pods in namespaces the tenancy policy does not allow for the DAP are ignored.
+func Resolve(ctx context.Context, c client.Reader, dap *peerauthv1.DynamicAuthorizationPolicy,
+	tenancy *TenancyPolicy) (Resolution, error) {
+	selected, err := SelectPods(ctx, c, dap)
+	if err != nil {
+		return Resolution{}, err
+	}
+	return ResolveContributors(dap, tenancy, selected), nil
+}
+
+// SelectPods lists the pods selected by each of the DAP's policies, keyed by the principal
+// each pod would be granted.
+func SelectPods(ctx context.Context, c client.Reader,
+	dap *peerauthv1.DynamicAuthorizationPolicy) (Contributors, error) {
+	selected := Contributors{}
+	for _, policy := range dap.GetPolicies() {
+		pods := corev1.PodList{}
+		if err := policy.ListPods(ctx, c, &pods); err != nil {
+			return nil, errors.Wrapf(err,
+				"unable to list ServiceAccountPolicyMapping using labels %+v", policy.PodSelectors)
+		}
+		for _, pod := range pods.Items {
+			selected.add(policy.Name, policy.Principal(pod), client.ObjectKeyFromObject(&pod))
+		}
+	}
+	return selected, nil
+}
+
+// ResolveContributors maps the pods selected by each policy to principals, dropping pods the
+// tenancy policy does not allow and withholding principals that await approval.
+func ResolveContributors(dap *peerauthv1.DynamicAuthorizationPolicy, tenancy *TenancyPolicy,
+	selected Contributors) Resolution {
+	res := Resolution{
+		Mapping:      peerauthv1.ServiceAccountPolicyMapping{},
+		Contributors: Contributors{},
+		Violations:   tenancy.Violations(dap),
+	}
+	for _, policy := range dap.GetPolicies() {
+		for principal, pods := range selected[policy.Name] {
+			for _, pod := range pods {
+				if !tenancy.Allows(dap.GetNamespace(), pod.Namespace) {
+					continue
+				}
+				res.Mapping.Add(policy.Name, principal)
+				res.Contributors.add(policy.Name, principal, pod)
+			}
+		}
+		if policy.RequireApproval {
+			gate(&res, policy, dap.Status.ServiceAccountPolicyMapping[policy.Name])
+		}
+	}
+	return res
+}
+
+// gate withholds principals from a policy requiring approval unless they are approved or were
+// already granted. Granted principals come from the DAP's status subresource, which only the
+// controller may write. Principals no longer selected are dropped from granted regardless.
+func gate(res *Resolution, policy peerauthv1.DynamicPolicy, granted peerauthv1.HashSet) {
+	approved := peerauthv1.FromSlice(policy.ApprovedPrincipals)
+	selected := res.Mapping[policy.Name]
+	if selected == nil {
+		return
+	}
+	allowed := peerauthv1.HashSet{}
+	pending := []string{}
+	for _, principal := range selected.Difference(nil) {
+		if approved.Get(principal) || granted.Get(principal) {
+			allowed.Add(principal)
+			continue
+		}
+		pending = append(pending, principal)
+	}
+	res.Mapping[policy.Name] = allowed
+	if len(pending) > 0 {
+		if res.Pending == nil {
+			res.Pending = map[string][]string{}
+		}
+		res.Pending[policy.Name] = pending
+	}
+}
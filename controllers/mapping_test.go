@@ -0,0 +1,103 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestResolveRequireApproval(t *testing.T) {
+	t.Parallel()
+	pod := func(name, sa string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "caller"}},
+			Spec:       corev1.PodSpec{ServiceAccountName: sa},
+		}
+	}
+	principal := func(sa string) string { return "cluster.local/ns/default/sa/" + sa }
+
+	tests := map[string]struct {
+		approved    []string
+		granted     []string
+		wantMapping []string
+		wantPending []string
+	}{
+		"new principals are held": {
+			wantMapping: []string{},
+			wantPending: []string{principal("a"), principal("b")},
+		},
+		"approved principals are granted": {
+			approved:    []string{principal("a")},
+			wantMapping: []string{principal("a")},
+			wantPending: []string{principal("b")},
+		},
+		"granted principals stay granted": {
+			granted:     []string{principal("b")},
+			wantMapping: []string{principal("b")},
+			wantPending: []string{principal("a")},
+		},
+		"principals no longer selected are revoked": {
+			approved:    []string{principal("a"), principal("b")},
+			granted:     []string{principal("gone")},
+			wantMapping: []string{principal("a"), principal("b")},
+		},
+	}
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c := fake.NewClientBuilder().WithScheme(scheme.Scheme).
+				WithObjects(pod("pod-a", "a"), pod("pod-b", "b")).Build()
+			dap := &peerauthv1.DynamicAuthorizationPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "default"},
+				Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+					DynamicPolicies: []peerauthv1.DynamicPolicy{{
+						Name:               "policy",
+						TrustDomain:        "cluster.local",
+						PodSelectors:       map[string]string{"app": "caller"},
+						RequireApproval:    true,
+						ApprovedPrincipals: tt.approved,
+					}},
+				},
+				Status: peerauthv1.DynamicAuthorizationPolicyStatus{
+					ServiceAccountPolicyMapping: peerauthv1.ServiceAccountPolicyMapping{
+						"policy": peerauthv1.FromSlice(tt.granted),
+					},
+				},
+			}
+
+			res, err := Resolve(context.Background(), c, dap, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := res.Mapping["policy"].Difference(nil); !reflect.DeepEqual(got, tt.wantMapping) {
+				t.Errorf("mapping = %v, want %v", got, tt.wantMapping)
+			}
+			if got := res.Pending["policy"]; !reflect.DeepEqual(got, tt.wantPending) {
+				t.Errorf("pending = %v, want %v", got, tt.wantPending)
+			}
+		})
+	}
+}
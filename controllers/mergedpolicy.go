@@ -0,0 +1,241 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// mergeFieldManager is the field manager principals merged into user-authored
+// AuthorizationPolicies are applied with.
+const mergeFieldManager = "dynamic-authorization-policy-merge"
+
+// noPrincipals is merged into rules whose policy grants no principals. An empty principals list
+// matches every peer, so the rule fails closed on an identity no workload has instead.
+const noPrincipals = "peerauth.aweis.io/no-principals"
+
+// ruleIndex resolves a rule reference against the rules of an AuthorizationPolicy.
+func ruleIndex(ap *unstructured.Unstructured, rules []interface{}, ref peerauthv1.AuthorizationPolicyRuleRef) (int, error) {
+	switch {
+	case ref.Index != nil && ref.Label != "":
+		return 0, errors.Errorf("rule reference to AuthorizationPolicy %s sets both index and label", ref.Name)
+	case ref.Index != nil:
+		if int(*ref.Index) >= len(rules) {
+			return 0, errors.Errorf("AuthorizationPolicy %s has no rule %d", ref.Name, *ref.Index)
+		}
+		return int(*ref.Index), nil
+	case ref.Label != "":
+		for i, label := range strings.Split(ap.GetAnnotations()[peerauthv1.AuthorizationPolicyRuleLabelsAnnotation], ",") {
+			if strings.TrimSpace(label) != ref.Label {
+				continue
+			}
+			if i >= len(rules) {
+				return 0, errors.Errorf("AuthorizationPolicy %s has no rule labelled %s", ref.Name, ref.Label)
+			}
+			return i, nil
+		}
+		return 0, errors.Errorf("AuthorizationPolicy %s has no rule labelled %s", ref.Name, ref.Label)
+	}
+	return 0, errors.Errorf("rule reference to AuthorizationPolicy %s sets neither index nor label", ref.Name)
+}
+
+// mergePrincipals sets the principals of the first source of a rule, adding one if the rule has
+// none, and leaves its other fields untouched.
+func mergePrincipals(rule map[string]interface{}, principals peerauthv1.HashSet) {
+	values := []interface{}{}
+	for _, principal := range principals.Slice() {
+		values = append(values, principal)
+	}
+	if len(values) == 0 {
+		values = append(values, noPrincipals)
+	}
+	froms, _, _ := unstructured.NestedSlice(rule, "from")
+	if len(froms) == 0 {
+		froms = []interface{}{map[string]interface{}{}}
+	}
+	from, ok := froms[0].(map[string]interface{})
+	if !ok {
+		from = map[string]interface{}{}
+	}
+	source, ok := from["source"].(map[string]interface{})
+	if !ok {
+		source = map[string]interface{}{}
+	}
+	source["principals"] = values
+	from["source"] = source
+	froms[0] = from
+	rule["from"] = froms
+}
+
+// mergedRules returns the rules the DAP's policies merge principals into. They only merge
+// through the Istio backend.
+func mergedRules(dap *peerauthv1.DynamicAuthorizationPolicy) []peerauthv1.AuthorizationPolicyRuleRef {
+	if !dap.HasBackend(peerauthv1.BackendIstio) {
+		return nil
+	}
+	refs := []peerauthv1.AuthorizationPolicyRuleRef{}
+	for _, policy := range dap.GetPolicies() {
+		if policy.AuthorizationPolicyRule != nil {
+			refs = append(refs, *policy.AuthorizationPolicyRule)
+		}
+	}
+	return refs
+}
+
+// ruleMerge sets the principals of a referenced rule. Released rules are left with noPrincipals.
+type ruleMerge struct {
+	ref        peerauthv1.AuthorizationPolicyRuleRef
+	principals peerauthv1.HashSet
+	released   bool
+}
+
+// planMergedAuthorizationPolicies returns the writes merging the principals of policies that
+// reference user-authored AuthorizationPolicy rules, one per referenced AuthorizationPolicy.
+// Rules merged into by the last reconcile that are no longer referenced are released.
+func (r *DynamicAuthorizationPolicyReconciler) planMergedAuthorizationPolicies(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy, sapm peerauthv1.ServiceAccountPolicyMapping,
+) ([]authorizationPolicyChange, error) {
+	merges := []ruleMerge{}
+	refs := mergedRules(dap)
+	for _, policy := range dap.GetPolicies() {
+		if ref := policy.AuthorizationPolicyRule; ref != nil && dap.HasBackend(peerauthv1.BackendIstio) {
+			merges = append(merges, ruleMerge{ref: *ref, principals: sapm[policy.Name]})
+		}
+	}
+	for _, ref := range dap.Status.MergedRules {
+		if !containsRuleRef(refs, ref) {
+			merges = append(merges, ruleMerge{ref: ref, released: true})
+		}
+	}
+	return r.planMergedRules(ctx, dap, merges)
+}
+
+// planMergedRuleReleases returns the writes releasing every rule the DAP's policies merged
+// principals into, one per AuthorizationPolicy.
+func (r *DynamicAuthorizationPolicyReconciler) planMergedRuleReleases(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy) ([]authorizationPolicyChange, error) {
+	merges := []ruleMerge{}
+	for _, ref := range append(mergedRules(dap), dap.Status.MergedRules...) {
+		merges = append(merges, ruleMerge{ref: ref, released: true})
+	}
+	return r.planMergedRules(ctx, dap, merges)
+}
+
+// planMergedRules returns the writes performing merges, one per AuthorizationPolicy whose rules
+// change. Released rules are kept, with noPrincipals, rather than removed, since removing one
+// would shift the index of every later rule, including rules other DAPs merge into, and an ALLOW
+// rule without principals matches every peer. A released rule that no longer resolves, or that
+// another merge sets, is skipped.
+func (r *DynamicAuthorizationPolicyReconciler) planMergedRules(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy, merges []ruleMerge) ([]authorizationPolicyChange, error) {
+	log := ctrl.LoggerFrom(ctx)
+	merged := map[string]*authorizationPolicyChange{}
+	set := map[string]map[int]bool{}
+	names := []string{}
+	// Merges granting principals come first, so released rules they set are skipped.
+	sort.SliceStable(merges, func(i, j int) bool { return !merges[i].released && merges[j].released })
+	for _, merge := range merges {
+		ref := merge.ref
+		change, ok := merged[ref.Name]
+		if !ok {
+			existing := &unstructured.Unstructured{}
+			existing.SetGroupVersionKind(AuthorizationPolicyGVK)
+			key := client.ObjectKey{Namespace: dap.GetNamespace(), Name: ref.Name}
+			if err := r.Get(ctx, key, existing); err != nil {
+				if !merge.released || !kerrors.IsNotFound(err) {
+					return nil, errors.Wrapf(err, "unable to get AuthorizationPolicy %s", key)
+				}
+				log.Info("skipping releasing merged rule", "AuthorizationPolicy", ref.Name, "reason", err.Error())
+				continue
+			}
+			change = &authorizationPolicyChange{
+				action: peerauthv1.ChangeUpdate, desired: existing.DeepCopy(), existing: existing, merged: true,
+			}
+			merged[ref.Name], set[ref.Name] = change, map[int]bool{}
+			names = append(names, ref.Name)
+		}
+		rules, _, _ := unstructured.NestedSlice(change.desired.Object, "spec", "rules")
+		i, err := ruleIndex(change.desired, rules, ref)
+		switch {
+		case err != nil && merge.released:
+			log.Info("skipping releasing merged rule", "AuthorizationPolicy", ref.Name, "reason", err.Error())
+			continue
+		case err != nil:
+			return nil, err
+		case merge.released && set[ref.Name][i]:
+			continue
+		}
+		rule, ok := rules[i].(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("AuthorizationPolicy %s rule %d is not an object", ref.Name, i)
+		}
+		mergePrincipals(rule, merge.principals)
+		set[ref.Name][i] = true
+		if err := unstructured.SetNestedSlice(change.desired.Object, rules, "spec", "rules"); err != nil {
+			return nil, errors.Wrapf(err, "unable to merge principals into AuthorizationPolicy %s", ref.Name)
+		}
+	}
+	changes := []authorizationPolicyChange{}
+	for _, name := range names {
+		change := merged[name]
+		rules, _, _ := unstructured.NestedSlice(change.existing.Object, "spec", "rules")
+		desiredRules, _, _ := unstructured.NestedSlice(change.desired.Object, "spec", "rules")
+		if !equality.Semantic.DeepEqual(rules, desiredRules) {
+			changes = append(changes, *change)
+		}
+	}
+	return changes, nil
+}
+
+func containsRuleRef(refs []peerauthv1.AuthorizationPolicyRuleRef, ref peerauthv1.AuthorizationPolicyRuleRef) bool {
+	for _, r := range refs {
+		if equality.Semantic.DeepEqual(r, ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyMergedAuthorizationPolicy applies the rules of a merged AuthorizationPolicy with the
+// merge field manager. Istio's CRD treats rules as an atomic list, so the whole list is applied
+// with the user's other rules unchanged. The resourceVersion of the AuthorizationPolicy the
+// change was planned against is applied as a precondition, so concurrent edits to the user's
+// rules conflict instead of being overwritten.
+func (r *DynamicAuthorizationPolicyReconciler) applyMergedAuthorizationPolicy(ctx context.Context,
+	change authorizationPolicyChange) error {
+	desired := change.desired
+	rules, _, _ := unstructured.NestedSlice(desired.Object, "spec", "rules")
+	ap := &unstructured.Unstructured{}
+	ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+	ap.SetName(desired.GetName())
+	ap.SetNamespace(desired.GetNamespace())
+	ap.SetResourceVersion(change.existing.GetResourceVersion())
+	if err := unstructured.SetNestedSlice(ap.Object, rules, "spec", "rules"); err != nil {
+		return errors.Wrapf(err, "unable to build AuthorizationPolicy %s", client.ObjectKeyFromObject(desired))
+	}
+	return r.apply(ctx, ap, mergeFieldManager)
+}
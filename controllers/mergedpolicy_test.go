@@ -0,0 +1,391 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestRuleIndex(t *testing.T) {
+	t.Parallel()
+	index := func(i int32) *int32 { return &i }
+	ap := &unstructured.Unstructured{}
+	ap.SetAnnotations(map[string]string{peerauthv1.AuthorizationPolicyRuleLabelsAnnotation: "admin, callers,extra"})
+	rules := []interface{}{map[string]interface{}{}, map[string]interface{}{}}
+	tests := map[string]struct {
+		ref     peerauthv1.AuthorizationPolicyRuleRef
+		want    int
+		wantErr bool
+	}{
+		"index":               {ref: peerauthv1.AuthorizationPolicyRuleRef{Index: index(1)}, want: 1},
+		"index out of range":  {ref: peerauthv1.AuthorizationPolicyRuleRef{Index: index(2)}, wantErr: true},
+		"label":               {ref: peerauthv1.AuthorizationPolicyRuleRef{Label: "callers"}, want: 1},
+		"label without rule":  {ref: peerauthv1.AuthorizationPolicyRuleRef{Label: "extra"}, wantErr: true},
+		"unknown label":       {ref: peerauthv1.AuthorizationPolicyRuleRef{Label: "other"}, wantErr: true},
+		"index and label":     {ref: peerauthv1.AuthorizationPolicyRuleRef{Index: index(0), Label: "admin"}, wantErr: true},
+		"neither index/label": {ref: peerauthv1.AuthorizationPolicyRuleRef{}, wantErr: true},
+	}
+	for name, tt := range tests {
+		got, err := ruleIndex(ap, rules, tt.ref)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %t", name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("%s: ruleIndex = %d, want %d", name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateAuthorizationPolicyRule(t *testing.T) {
+	t.Parallel()
+	index := int32(0)
+	validator := &DynamicAuthorizationPolicyValidator{}
+	for _, ref := range []*peerauthv1.AuthorizationPolicyRuleRef{
+		{Name: "handwritten"},
+		{Name: "handwritten", Index: &index, Label: "callers"},
+	} {
+		dap := tenancyDAP()
+		dap.Spec.DynamicPolicies[0].AuthorizationPolicyRule = ref
+		if err := validator.ValidateCreate(context.Background(), dap); err == nil {
+			t.Errorf("rule reference %+v accepted", ref)
+		}
+	}
+	dap := tenancyDAP()
+	dap.Spec.DynamicPolicies[0].AuthorizationPolicyRule = &peerauthv1.AuthorizationPolicyRuleRef{Name: "handwritten", Index: &index}
+	if err := validator.ValidateCreate(context.Background(), dap); err != nil {
+		t.Errorf("rule reference by index rejected: %v", err)
+	}
+}
+
+func TestReconcileMergedAuthorizationPolicy(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	userRule := map[string]interface{}{
+		"to": []interface{}{map[string]interface{}{"operation": map[string]interface{}{"paths": []interface{}{"/healthz"}}}},
+	}
+	ap := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"action": "ALLOW",
+			"rules": []interface{}{
+				userRule,
+				map[string]interface{}{
+					"from": []interface{}{map[string]interface{}{
+						"source": map[string]interface{}{"namespaces": []interface{}{"client"}},
+					}},
+				},
+			},
+		},
+	}}
+	ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+	ap.SetName("handwritten")
+	ap.SetNamespace("server")
+	ap.SetAnnotations(map[string]string{peerauthv1.AuthorizationPolicyRuleLabelsAnnotation: "health,callers"})
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:                    "policy",
+				TrustDomain:             "cluster.local",
+				PodSelectors:            map[string]string{"app": "caller"},
+				AuthorizationPolicyRule: &peerauthv1.AuthorizationPolicyRuleRef{Name: "handwritten", Label: "callers"},
+			}},
+		},
+	}
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: "client", Labels: map[string]string{"app": "caller"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	rt := newReconcilerTest(t, dap, ap, caller)
+	c := rt.c
+
+	if _, err := rt.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(dap)}); err != nil {
+		t.Fatal(err)
+	}
+	got := &unstructured.Unstructured{}
+	got.SetGroupVersionKind(AuthorizationPolicyGVK)
+	if err := c.Get(ctx, client.ObjectKeyFromObject(ap), got); err != nil {
+		t.Fatal(err)
+	}
+	rules, _, _ := unstructured.NestedSlice(got.Object, "spec", "rules")
+	want := []interface{}{
+		userRule,
+		map[string]interface{}{
+			"from": []interface{}{map[string]interface{}{
+				"source": map[string]interface{}{
+					"namespaces": []interface{}{"client"},
+					"principals": []interface{}{"cluster.local/ns/client/sa/caller"},
+				},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules = %v, want %v", rules, want)
+	}
+	if action, _, _ := unstructured.NestedString(got.Object, "spec", "action"); action != "ALLOW" {
+		t.Errorf("action = %q, want the user's ALLOW untouched", action)
+	}
+	if len(got.GetOwnerReferences()) != 0 || !reflect.DeepEqual(c.appliedBy(got), []string{mergeFieldManager}) {
+		t.Errorf("owners = %v, field managers = %v", got.GetOwnerReferences(), c.appliedBy(got))
+	}
+	generated := &unstructured.Unstructured{}
+	generated.SetGroupVersionKind(AuthorizationPolicyGVK)
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "server", Name: "policy"}, generated); err == nil {
+		t.Error("an AuthorizationPolicy was generated for a merged policy")
+	}
+
+	if _, err := rt.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(dap)}); err != nil {
+		t.Fatal(err)
+	}
+	if applies := c.applies(got); applies != 1 {
+		t.Errorf("rules applied %d times, want unchanged rules left alone", applies)
+	}
+}
+
+func TestPlanMergedRuleRemovals(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	rule := func(namespace string) interface{} {
+		return map[string]interface{}{
+			"from": []interface{}{map[string]interface{}{
+				"source": map[string]interface{}{"namespaces": []interface{}{namespace}},
+			}},
+		}
+	}
+	ap := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"rules": []interface{}{rule("health"), rule("client"), rule("extra")}},
+	}}
+	ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+	ap.SetName("handwritten")
+	ap.SetNamespace("server")
+	ap.SetAnnotations(map[string]string{peerauthv1.AuthorizationPolicyRuleLabelsAnnotation: "health,callers,extra"})
+	index := int32(0)
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{
+				{Name: "callers", AuthorizationPolicyRule: &peerauthv1.AuthorizationPolicyRuleRef{Name: "handwritten", Label: "callers"}},
+				{Name: "health", AuthorizationPolicyRule: &peerauthv1.AuthorizationPolicyRuleRef{Name: "handwritten", Index: &index}},
+				{Name: "gone", AuthorizationPolicyRule: &peerauthv1.AuthorizationPolicyRuleRef{Name: "gone", Index: &index}},
+			},
+		},
+	}
+	rt := newReconcilerTest(t, dap, ap)
+	c := rt.c
+
+	changes, err := rt.planMergedRuleReleases(ctx, dap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 {
+		t.Fatalf("changes = %v, want one for the existing AuthorizationPolicy", changes)
+	}
+	if err := rt.applyMergedAuthorizationPolicy(ctx, changes[0]); err != nil {
+		t.Fatal(err)
+	}
+	got := &unstructured.Unstructured{}
+	got.SetGroupVersionKind(AuthorizationPolicyGVK)
+	if err := c.Get(ctx, client.ObjectKeyFromObject(ap), got); err != nil {
+		t.Fatal(err)
+	}
+	released := func(namespace string) interface{} {
+		return map[string]interface{}{
+			"from": []interface{}{map[string]interface{}{
+				"source": map[string]interface{}{"namespaces": []interface{}{namespace}, "principals": []interface{}{noPrincipals}},
+			}},
+		}
+	}
+	want := []interface{}{released("health"), released("client"), rule("extra")}
+	if rules, _, _ := unstructured.NestedSlice(got.Object, "spec", "rules"); !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules = %v, want the merged rules kept in place without the DAP's principals", rules)
+	}
+	if labels := got.GetAnnotations()[peerauthv1.AuthorizationPolicyRuleLabelsAnnotation]; labels != "health,callers,extra" {
+		t.Errorf("rule labels = %q, want them unchanged", labels)
+	}
+}
+
+func TestApplyMergedAuthorizationPolicyConflicts(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ap := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"rules": []interface{}{map[string]interface{}{}}},
+	}}
+	ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+	ap.SetName("handwritten")
+	ap.SetNamespace("server")
+	index := int32(0)
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name: "policy", AuthorizationPolicyRule: &peerauthv1.AuthorizationPolicyRuleRef{Name: "handwritten", Index: &index},
+			}},
+		},
+	}
+	rt := newReconcilerTest(t, dap, ap)
+	c := rt.c
+
+	changes, err := rt.planMergedAuthorizationPolicies(ctx, dap, peerauthv1.ServiceAccountPolicyMapping{
+		"policy": peerauthv1.HashSet{"cluster.local/ns/client/sa/caller": true},
+	})
+	if err != nil || len(changes) != 1 {
+		t.Fatalf("changes = %v, %v", changes, err)
+	}
+	edited := changes[0].existing.DeepCopy()
+	if err := unstructured.SetNestedSlice(edited.Object, []interface{}{map[string]interface{}{}, map[string]interface{}{}}, "spec", "rules"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Update(ctx, edited); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.applyMergedAuthorizationPolicy(ctx, changes[0]); !kerrors.IsConflict(err) {
+		t.Errorf("applying rules planned against a stale AuthorizationPolicy = %v, want a conflict", err)
+	}
+}
+
+// mergedRulesFixture returns an AuthorizationPolicy with a rule per namespace, labelled after
+// it, and a DAP merging the principals of the pods labelled app=caller into the labelled rules.
+func mergedRulesFixture(name string, namespaces []string, labels ...string) (*unstructured.Unstructured, *peerauthv1.DynamicAuthorizationPolicy) {
+	rules := []interface{}{}
+	for _, namespace := range namespaces {
+		rules = append(rules, map[string]interface{}{
+			"from": []interface{}{map[string]interface{}{
+				"source": map[string]interface{}{"namespaces": []interface{}{namespace}},
+			}},
+		})
+	}
+	ap := &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"rules": rules}}}
+	ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+	ap.SetName("handwritten")
+	ap.SetNamespace("server")
+	ap.SetAnnotations(map[string]string{peerauthv1.AuthorizationPolicyRuleLabelsAnnotation: strings.Join(namespaces, ",")})
+	dap := &peerauthv1.DynamicAuthorizationPolicy{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "server"}}
+	for _, label := range labels {
+		dap.Spec.DynamicPolicies = append(dap.Spec.DynamicPolicies, peerauthv1.DynamicPolicy{
+			Name:                    label,
+			PodSelectors:            map[string]string{"app": "caller"},
+			AuthorizationPolicyRule: &peerauthv1.AuthorizationPolicyRuleRef{Name: "handwritten", Label: label},
+		})
+	}
+	return ap, dap
+}
+
+// mergedPrincipals returns the principals of the first source of each rule of ap.
+func mergedPrincipals(t *testing.T, c client.Client, ap *unstructured.Unstructured) [][]interface{} {
+	t.Helper()
+	got := &unstructured.Unstructured{}
+	got.SetGroupVersionKind(AuthorizationPolicyGVK)
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(ap), got); err != nil {
+		t.Fatal(err)
+	}
+	rules, _, _ := unstructured.NestedSlice(got.Object, "spec", "rules")
+	principals := [][]interface{}{}
+	for _, rule := range rules {
+		froms, _, _ := unstructured.NestedSlice(rule.(map[string]interface{}), "from")
+		p, _, _ := unstructured.NestedSlice(froms[0].(map[string]interface{}), "source", "principals")
+		principals = append(principals, p)
+	}
+	return principals
+}
+
+func TestReconcileMergedRuleNoLongerReferenced(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ap, dap := mergedRulesFixture("dap", []string{"client", "other"}, "client", "other")
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: "client", Labels: map[string]string{"app": "caller"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	rt := newReconcilerTest(t, dap, ap, caller)
+	c := rt.c
+
+	rt.reconcileDAP(dap)
+	granted := []interface{}{"cluster.local/ns/client/sa/caller"}
+	if got, want := mergedPrincipals(t, c, ap), [][]interface{}{granted, granted}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("principals = %v, want %v", got, want)
+	}
+
+	// Editing the reference to the second rule away releases it.
+	if err := c.Get(ctx, client.ObjectKeyFromObject(dap), dap); err != nil {
+		t.Fatal(err)
+	}
+	if len(dap.Status.MergedRules) != 2 {
+		t.Errorf("merged rules = %v, want both references", dap.Status.MergedRules)
+	}
+	dap.Spec.DynamicPolicies = dap.Spec.DynamicPolicies[:1]
+	if err := c.Update(ctx, dap); err != nil {
+		t.Fatal(err)
+	}
+	rt.reconcileDAP(dap)
+	if got, want := mergedPrincipals(t, c, ap), [][]interface{}{granted, {noPrincipals}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("principals = %v, want %v", got, want)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(dap), dap); err != nil {
+		t.Fatal(err)
+	}
+	if len(dap.Status.MergedRules) != 1 || dap.Status.MergedRules[0].Label != "client" {
+		t.Errorf("merged rules = %v, want only the remaining reference", dap.Status.MergedRules)
+	}
+}
+
+func TestFinalizeKeepsRulesOtherDAPsMergeInto(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ap, first := mergedRulesFixture("first", []string{"first", "second"}, "first")
+	_, second := mergedRulesFixture("second", []string{"first", "second"}, "second")
+	// Each DAP's rule is referenced by index, so removing the first would shift the second.
+	for i, dap := range []*peerauthv1.DynamicAuthorizationPolicy{first, second} {
+		index := int32(i)
+		dap.Spec.DynamicPolicies[0].AuthorizationPolicyRule = &peerauthv1.AuthorizationPolicyRuleRef{Name: "handwritten", Index: &index}
+	}
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: "client", Labels: map[string]string{"app": "caller"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	rt := newReconcilerTest(t, first, second, ap, caller)
+	c := rt.c
+
+	rt.reconcileDAP(first)
+	rt.reconcileDAP(second)
+	granted := []interface{}{"cluster.local/ns/client/sa/caller"}
+	if got, want := mergedPrincipals(t, c, ap), [][]interface{}{granted, granted}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("principals = %v, want %v", got, want)
+	}
+
+	if err := c.Get(ctx, client.ObjectKeyFromObject(first), first); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	rt.reconcileDAP(first)
+	rt.reconcileDAP(second)
+	if got, want := mergedPrincipals(t, c, ap), [][]interface{}{{noPrincipals}, granted}; !reflect.DeepEqual(got, want) {
+		t.Errorf("principals = %v, want the first rule released and the second kept in place", got)
+	}
+}
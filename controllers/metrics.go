@@ -0,0 +1,254 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// nolint:gochecknoglobals
+var (
+	principalsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dap_principals",
+		Help: "Number of principals currently mapped to each DynamicAuthorizationPolicy policy.",
+	}, []string{"namespace", "dap", "policy"})
+
+	principalGrants = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dap_principal_grants_total",
+		Help: "Total number of principals granted through generated AuthorizationPolicies.",
+	}, []string{"namespace", "dap", "policy"})
+
+	principalRevocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dap_principal_revocations_total",
+		Help: "Total number of principals revoked through generated AuthorizationPolicies.",
+	}, []string{"namespace", "dap", "policy"})
+
+	podChangeLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dap_pod_change_to_status_seconds",
+		Help:    "Time from observing a pod change to writing the status of a DynamicAuthorizationPolicy it affects.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+
+	reconcileErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dap_reconcile_errors_total",
+		Help: "Total number of DynamicAuthorizationPolicy reconcile errors by reason.",
+	}, []string{"reason"})
+
+	auditRecordsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dap_audit_records_dropped_total",
+		Help: "Total number of audit records dropped while the audit webhook did not accept them.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		principalsGauge,
+		principalGrants,
+		principalRevocations,
+		podChangeLatency,
+		reconcileErrors,
+		auditRecordsDropped,
+	)
+}
+
+// Reconcile error reasons reported by dap_reconcile_errors_total.
+const (
+	errorReasonGet      = "get"
+	errorReasonResolve  = "resolve"
+	errorReasonSync     = "sync"
+	errorReasonStatus   = "status"
+	errorReasonAudit    = "audit"
+	errorReasonConflict = "conflict"
+	errorReasonUnknown  = "unknown"
+)
+
+// reasonError labels an error with the reconcile step that produced it.
+type reasonError struct {
+	reason string
+	err    error
+}
+
+func (e reasonError) Error() string { return e.err.Error() }
+func (e reasonError) Unwrap() error { return e.err }
+
+func withReason(reason string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return reasonError{reason: reason, err: err}
+}
+
+func observeReconcileError(err error) {
+	reason := errorReasonUnknown
+	re := reasonError{}
+	if errors.As(err, &re) {
+		reason = re.reason
+	}
+	if kerrors.IsConflict(err) {
+		reason = errorReasonConflict
+	}
+	reconcileErrors.WithLabelValues(reason).Inc()
+}
+
+// observeAppliedChanges counts the principals granted and revoked by applied changes.
+func observeAppliedChanges(dap *peerauthv1.DynamicAuthorizationPolicy, applied []authorizationPolicyChange) {
+	exportedPolicies.count(client.ObjectKeyFromObject(dap), applied)
+}
+
+// principalSeries remembers which policy series were exported for each DAP so they can be
+// removed when a policy or the whole DAP goes away.
+type principalSeries struct {
+	mu       sync.Mutex
+	policies map[types.NamespacedName][]string
+	// counted holds the policies with grant and revocation counters, which are kept for as long
+	// as the DAP exists.
+	counted map[types.NamespacedName]map[string]bool
+}
+
+// nolint:gochecknoglobals
+var exportedPolicies = &principalSeries{
+	policies: map[types.NamespacedName][]string{},
+	counted:  map[types.NamespacedName]map[string]bool{},
+}
+
+// count adds the principals granted and revoked by the applied changes to each policy's
+// counters. A policy whose principals several objects carry, as with more than one backend,
+// counts each principal once.
+func (s *principalSeries) count(key types.NamespacedName, applied []authorizationPolicyChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	added, removed := map[string]peerauthv1.HashSet{}, map[string]peerauthv1.HashSet{}
+	for _, change := range applied {
+		intended := change.intended()
+		if len(intended.AddedPrincipals) == 0 && len(intended.RemovedPrincipals) == 0 {
+			// PeerAuthentications, Sidecars and repaired objects grant nothing.
+			continue
+		}
+		granted, revoked := added[intended.Name], removed[intended.Name]
+		if granted == nil {
+			granted, revoked = peerauthv1.HashSet{}, peerauthv1.HashSet{}
+			added[intended.Name], removed[intended.Name] = granted, revoked
+		}
+		for _, principal := range intended.AddedPrincipals {
+			granted.Add(principal)
+		}
+		for _, principal := range intended.RemovedPrincipals {
+			revoked.Add(principal)
+		}
+	}
+	for policy := range added {
+		principalGrants.WithLabelValues(key.Namespace, key.Name, policy).Add(float64(len(added[policy])))
+		principalRevocations.WithLabelValues(key.Namespace, key.Name, policy).Add(float64(len(removed[policy])))
+		if s.counted[key] == nil {
+			s.counted[key] = map[string]bool{}
+		}
+		s.counted[key][policy] = true
+	}
+}
+
+func (s *principalSeries) set(key types.NamespacedName, sapm peerauthv1.ServiceAccountPolicyMapping) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policies := []string{}
+	for policy, principals := range sapm {
+		principalsGauge.WithLabelValues(key.Namespace, key.Name, policy).Set(float64(len(principals)))
+		policies = append(policies, policy)
+	}
+	for _, policy := range s.policies[key] {
+		if _, ok := sapm[policy]; !ok {
+			principalsGauge.DeleteLabelValues(key.Namespace, key.Name, policy)
+		}
+	}
+	s.policies[key] = policies
+}
+
+// clear removes every series exported for the DAP.
+func (s *principalSeries) clear(key types.NamespacedName) {
+	s.set(key, nil)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.policies, key)
+	for policy := range s.counted[key] {
+		principalGrants.DeleteLabelValues(key.Namespace, key.Name, policy)
+		principalRevocations.DeleteLabelValues(key.Namespace, key.Name, policy)
+	}
+	delete(s.counted, key)
+}
+
+// podChanges records when pod changes were first observed for each DAP that has not yet
+// written its status, so the DAP reconciler can report end-to-end latency, along with the
+// most recent pod that triggered it.
+type podChanges struct {
+	mu    sync.Mutex
+	since map[types.NamespacedName]time.Time
+	pods  map[types.NamespacedName]types.NamespacedName
+}
+
+// nolint:gochecknoglobals
+var pendingPodChanges = &podChanges{
+	since: map[types.NamespacedName]time.Time{},
+	pods:  map[types.NamespacedName]types.NamespacedName{},
+}
+
+func (p *podChanges) observe(key, pod types.NamespacedName, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.since[key]; !ok {
+		p.since[key] = at
+	}
+	p.pods[key] = pod
+}
+
+// lastPod returns the most recent pod whose change triggered key, if any is pending.
+func (p *podChanges) lastPod(key types.NamespacedName) types.NamespacedName {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pods[key]
+}
+
+func (p *podChanges) forget(key types.NamespacedName) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.since, key)
+	delete(p.pods, key)
+}
+
+// synced reports the latency of the pending change for key, if any, and forgets it. Changes
+// first observed after the reconcile started are kept, as the pod reconciler may run
+// concurrently and the DAP will be reconciled again for them.
+func (p *podChanges) synced(key types.NamespacedName, started time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	at, ok := p.since[key]
+	if !ok || at.After(started) {
+		return
+	}
+	podChangeLatency.Observe(time.Since(at).Seconds())
+	delete(p.since, key)
+	delete(p.pods, key)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPrincipalSeries(t *testing.T) {
+	key := types.NamespacedName{Namespace: "metrics", Name: "dap"}
+	series := &principalSeries{
+		policies: map[types.NamespacedName][]string{},
+		counted:  map[types.NamespacedName]map[string]bool{},
+	}
+
+	series.set(key, peerauthv1.ServiceAccountPolicyMapping{
+		"a": peerauthv1.FromSlice([]string{"p1", "p2"}),
+		"b": peerauthv1.FromSlice([]string{"p1"}),
+	})
+	if got := testutil.ToFloat64(principalsGauge.WithLabelValues("metrics", "dap", "a")); got != 2 {
+		t.Errorf("dap_principals{policy=a} = %v, want 2", got)
+	}
+
+	series.set(key, peerauthv1.ServiceAccountPolicyMapping{"a": peerauthv1.FromSlice([]string{"p1"})})
+	if deleted := principalsGauge.DeleteLabelValues("metrics", "dap", "b"); deleted {
+		t.Error("dap_principals{policy=b} was not removed with its policy")
+	}
+
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "metrics"},
+		Spec:       peerauthv1.DynamicAuthorizationPolicySpec{DynamicPolicies: []peerauthv1.DynamicPolicy{{Name: "a"}}},
+	}
+	desired := AuthorizationPolicies(dap, peerauthv1.ServiceAccountPolicyMapping{"a": peerauthv1.FromSlice([]string{"p1"})})
+	series.count(key, []authorizationPolicyChange{{action: peerauthv1.ChangeCreate, desired: desired[0]}})
+	if got := testutil.ToFloat64(principalGrants.WithLabelValues("metrics", "dap", "a")); got != 1 {
+		t.Errorf("dap_principal_grants_total{policy=a} = %v, want 1", got)
+	}
+
+	// The same grant through both backends' objects counts once.
+	dap.Spec.Backends = []peerauthv1.Backend{peerauthv1.BackendIstio, peerauthv1.BackendLinkerd}
+	sapm := peerauthv1.ServiceAccountPolicyMapping{"a": peerauthv1.FromSlice([]string{"cluster.local/ns/client/sa/caller"})}
+	changes := []authorizationPolicyChange{}
+	for _, name := range dap.GetBackends() {
+		objs, err := backends[name].Generate(dap, sapm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range objs {
+			changes = append(changes, authorizationPolicyChange{action: peerauthv1.ChangeCreate, desired: obj})
+		}
+	}
+	series.count(key, changes)
+	if got := testutil.ToFloat64(principalGrants.WithLabelValues("metrics", "dap", "a")); got != 2 {
+		t.Errorf("dap_principal_grants_total{policy=a} = %v, want the grant through two backends counted once", got)
+	}
+
+	series.clear(key)
+	if deleted := principalsGauge.DeleteLabelValues("metrics", "dap", "a"); deleted {
+		t.Error("dap_principals{policy=a} was not removed with its DAP")
+	}
+	if deleted := principalGrants.DeleteLabelValues("metrics", "dap", "a"); deleted {
+		t.Error("dap_principal_grants_total{policy=a} was not removed with its DAP")
+	}
+	if deleted := principalRevocations.DeleteLabelValues("metrics", "dap", "a"); deleted {
+		t.Error("dap_principal_revocations_total{policy=a} was not removed with its DAP")
+	}
+}
+
+func TestObserveReconcileError(t *testing.T) {
+	tests := map[string]struct {
+		err    error
+		reason string
+	}{
+		"labelled error": {
+			err:    withReason(errorReasonResolve, errors.New("boom")),
+			reason: errorReasonResolve,
+		},
+		"wrapped conflict": {
+			err: withReason(errorReasonStatus, errors.Wrap(
+				kerrors.NewConflict(schema.GroupResource{}, "dap", errors.New("stale")), "unable to update")),
+			reason: errorReasonConflict,
+		},
+		"unlabelled error": {
+			err:    errors.New("boom"),
+			reason: errorReasonUnknown,
+		},
+	}
+	for name, tt := range tests {
+		before := testutil.ToFloat64(reconcileErrors.WithLabelValues(tt.reason))
+		observeReconcileError(tt.err)
+		if got := testutil.ToFloat64(reconcileErrors.WithLabelValues(tt.reason)); got != before+1 {
+			t.Errorf("%s: dap_reconcile_errors_total{reason=%s} = %v, want %v", name, tt.reason, got, before+1)
+		}
+	}
+}
+
+func TestPodChangesSynced(t *testing.T) {
+	key := types.NamespacedName{Namespace: "metrics", Name: "synced"}
+	pod := types.NamespacedName{Namespace: "metrics", Name: "pod"}
+	started := time.Now()
+	changes := &podChanges{
+		since: map[types.NamespacedName]time.Time{},
+		pods:  map[types.NamespacedName]types.NamespacedName{},
+	}
+
+	changes.observe(key, pod, started.Add(time.Second))
+	changes.synced(key, started)
+	if got := changes.lastPod(key); got != pod {
+		t.Errorf("change observed during the reconcile was forgotten")
+	}
+	changes.synced(key, started.Add(2*time.Second))
+	if got := changes.lastPod(key); got != (types.NamespacedName{}) {
+		t.Errorf("change observed before the reconcile was kept: %s", got)
+	}
+}
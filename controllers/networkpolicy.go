@@ -0,0 +1,147 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// NetworkPolicyGVK is the Kubernetes NetworkPolicy kind generated by the NetworkPolicy backend.
+var NetworkPolicyGVK = schema.GroupVersionKind{ // nolint:gochecknoglobals
+	Group:   "networking.k8s.io",
+	Version: "v1",
+	Kind:    "NetworkPolicy",
+}
+
+// networkPolicyPrincipalsAnnotation lists, comma-separated and sorted, the principals a
+// generated NetworkPolicy's peers were built from.
+const networkPolicyPrincipalsAnnotation = "peerauth.aweis.io/principals"
+
+// networkPolicyBackend generates, per policy, a NetworkPolicy restricting ingress to the
+// workloads it protects to pods matching its selectors in the namespaces of the principals it
+// grants. It enforces at L3/L4, so it also restricts traffic that bypasses the mesh.
+type networkPolicyBackend struct{}
+
+// Generate builds the peers from the same approved and limited principals the other backends
+// grant, so a principal withheld from a policy opens no namespace to it. NetworkPolicies cannot
+// select pods by service account, so a peer admits every selected pod in its namespace. Policies
+// merged into user-authored AuthorizationPolicies are skipped, since the workloads those protect
+// are selected by the user's policy. A policy without principals gets no ingress rules, which
+// denies all ingress, so it fails closed.
+func (networkPolicyBackend) Generate(dap *peerauthv1.DynamicAuthorizationPolicy,
+	sapm peerauthv1.ServiceAccountPolicyMapping) ([]*unstructured.Unstructured, error) {
+	nps := []*unstructured.Unstructured{}
+	for _, policy := range dap.GetPolicies() {
+		if policy.AuthorizationPolicyRule != nil {
+			continue
+		}
+		peers := []interface{}{}
+		for _, namespace := range principalNamespaces(sapm[policy.Name]) {
+			peers = append(peers, map[string]interface{}{
+				"namespaceSelector": labelSelector(map[string]string{corev1.LabelMetadataName: namespace}, nil),
+				"podSelector":       labelSelector(policy.PodSelectors, policy.PodSelectorExpressions),
+			})
+		}
+		spec := map[string]interface{}{
+			"podSelector": labelSelector(policy.WorkloadSelector, nil),
+			"policyTypes": []interface{}{"Ingress"},
+		}
+		if len(peers) > 0 {
+			spec["ingress"] = []interface{}{map[string]interface{}{"from": peers}}
+		}
+
+		np := &unstructured.Unstructured{}
+		np.SetGroupVersionKind(NetworkPolicyGVK)
+		np.SetName(policy.Name)
+		np.SetNamespace(dap.GetNamespace())
+		np.SetLabels(map[string]string{dapLabel: dap.GetName()})
+		np.SetAnnotations(map[string]string{networkPolicyPrincipalsAnnotation: strings.Join(sapm[policy.Name].Slice(), ",")})
+		np.Object["spec"] = spec
+		nps = append(nps, np)
+	}
+	return nps, nil
+}
+
+func (networkPolicyBackend) Kinds() []schema.GroupVersionKind {
+	return []schema.GroupVersionKind{NetworkPolicyGVK}
+}
+
+// Principals returns the principals a NetworkPolicy's peers were built from whose namespace a
+// peer still admits, so a peer removed by hand no longer counts as a grant.
+func (networkPolicyBackend) Principals(obj *unstructured.Unstructured) peerauthv1.HashSet {
+	admitted := map[string]bool{}
+	ingress, _, _ := unstructured.NestedSlice(obj.Object, "spec", "ingress")
+	for _, rule := range ingress {
+		rule, _ := rule.(map[string]interface{})
+		peers, _, _ := unstructured.NestedSlice(rule, "from")
+		for _, peer := range peers {
+			peer, _ := peer.(map[string]interface{})
+			namespace, _, _ := unstructured.NestedString(peer, "namespaceSelector", "matchLabels", corev1.LabelMetadataName)
+			admitted[namespace] = true
+		}
+	}
+	principals := peerauthv1.HashSet{}
+	granted := obj.GetAnnotations()[networkPolicyPrincipalsAnnotation]
+	if granted == "" {
+		return principals
+	}
+	for _, principal := range strings.Split(granted, ",") {
+		for _, namespace := range principalNamespaces(peerauthv1.FromSlice([]string{principal})) {
+			if admitted[namespace] {
+				principals.Add(principal)
+			}
+		}
+	}
+	return principals
+}
+
+// labelSelector builds an unstructured LabelSelector, omitting empty fields so it matches the
+// selector the API server returns.
+func labelSelector(matchLabels map[string]string, expressions []metav1.LabelSelectorRequirement) map[string]interface{} {
+	selector := map[string]interface{}{}
+	if len(matchLabels) > 0 {
+		labels := map[string]interface{}{}
+		for k, v := range matchLabels {
+			labels[k] = v
+		}
+		selector["matchLabels"] = labels
+	}
+	if len(expressions) > 0 {
+		requirements := []interface{}{}
+		for _, expression := range expressions {
+			requirement := map[string]interface{}{"key": expression.Key, "operator": string(expression.Operator)}
+			if len(expression.Values) > 0 {
+				values := []interface{}{}
+				for _, value := range expression.Values {
+					values = append(values, value)
+				}
+				requirement["values"] = values
+			}
+			requirements = append(requirements, requirement)
+		}
+		selector["matchExpressions"] = requirements
+	}
+	return selector
+}
+
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
@@ -0,0 +1,231 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestNetworkPolicyBackend(t *testing.T) {
+	t.Parallel()
+	index := int32(0)
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			Backends: []peerauthv1.Backend{peerauthv1.BackendIstio, peerauthv1.BackendNetworkPolicy},
+			DynamicPolicies: []peerauthv1.DynamicPolicy{
+				{
+					Name:             "api",
+					PodSelectors:     map[string]string{"app": "caller"},
+					WorkloadSelector: map[string]string{"app": "api"},
+					PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"web"}},
+					},
+				},
+				{Name: "empty", PodSelectors: map[string]string{"app": "batch"}},
+				{Name: "merged", AuthorizationPolicyRule: &peerauthv1.AuthorizationPolicyRuleRef{Name: "handwritten", Index: &index}},
+			},
+		},
+	}
+	sapm := peerauthv1.ServiceAccountPolicyMapping{
+		"api":    peerauthv1.HashSet{"cluster.local/ns/b/sa/caller": true, "cluster.local/ns/a/sa/caller": true},
+		"merged": peerauthv1.HashSet{"cluster.local/ns/a/sa/caller": true},
+	}
+	nps, err := networkPolicyBackend{}.Generate(dap, sapm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]interface{}{}
+	for _, np := range nps {
+		if np.GetLabels()[dapLabel] != "dap" || np.GetNamespace() != "server" {
+			t.Errorf("NetworkPolicy %s labels = %v", client.ObjectKeyFromObject(np), np.GetLabels())
+		}
+		if got, want := (networkPolicyBackend{}).Principals(np).Slice(), sapm[np.GetName()].Slice(); !reflect.DeepEqual(got, want) {
+			t.Errorf("NetworkPolicy %s principals = %v, want %v", np.GetName(), got, want)
+		}
+		got[np.GetName()] = np.Object["spec"]
+	}
+	peer := func(namespace string) map[string]interface{} {
+		return map[string]interface{}{
+			"namespaceSelector": map[string]interface{}{
+				"matchLabels": map[string]interface{}{corev1.LabelMetadataName: namespace},
+			},
+			"podSelector": map[string]interface{}{
+				"matchLabels": map[string]interface{}{"app": "caller"},
+				"matchExpressions": []interface{}{map[string]interface{}{
+					"key": "tier", "operator": "In", "values": []interface{}{"web"},
+				}},
+			},
+		}
+	}
+	want := map[string]interface{}{
+		"api": map[string]interface{}{
+			"podSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "api"}},
+			"policyTypes": []interface{}{"Ingress"},
+			"ingress":     []interface{}{map[string]interface{}{"from": []interface{}{peer("a"), peer("b")}}},
+		},
+		"empty": map[string]interface{}{
+			"podSelector": map[string]interface{}{},
+			"policyTypes": []interface{}{"Ingress"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NetworkPolicy specs = %v, want %v", got, want)
+	}
+}
+
+func TestReconcileNetworkPolicy(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			Backends: []peerauthv1.Backend{peerauthv1.BackendIstio, peerauthv1.BackendNetworkPolicy},
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:             "policy",
+				TrustDomain:      "cluster.local",
+				PodSelectors:     map[string]string{"app": "caller"},
+				WorkloadSelector: map[string]string{"app": "api"},
+			}},
+		},
+	}
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: "client", Labels: map[string]string{"app": "caller"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	rt := newReconcilerTest(t, dap, caller)
+	c := rt.c
+
+	rt.reconcileDAP(dap)
+	ap := &unstructured.Unstructured{}
+	ap.SetGroupVersionKind(AuthorizationPolicyGVK)
+	key := client.ObjectKey{Namespace: "server", Name: "policy"}
+	if err := c.Get(ctx, key, ap); err != nil {
+		t.Fatalf("generated AuthorizationPolicy: %v", err)
+	}
+	np := &networkingv1.NetworkPolicy{}
+	if err := c.Get(ctx, key, np); err != nil {
+		t.Fatalf("generated NetworkPolicy: %v", err)
+	}
+	if owner := metav1.GetControllerOf(np); owner == nil || owner.Name != "dap" {
+		t.Errorf("NetworkPolicy controller = %v, want the DAP", owner)
+	}
+	want := []networkingv1.NetworkPolicyPeer{{
+		NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{corev1.LabelMetadataName: "client"}},
+		PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "caller"}},
+	}}
+	if len(np.Spec.Ingress) != 1 || !reflect.DeepEqual(np.Spec.Ingress[0].From, want) {
+		t.Errorf("NetworkPolicy ingress = %+v, want from %+v", np.Spec.Ingress, want)
+	}
+
+	// The API server omits empty selector fields, so an unchanged NetworkPolicy must not be
+	// reapplied.
+	rt.reconcileDAP(dap)
+	if applies := c.applies(np); applies != 1 {
+		t.Errorf("NetworkPolicy applied %d times, want once", applies)
+	}
+}
+
+func TestReconcileNetworkPolicyApprovedPrincipals(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			Backends: []peerauthv1.Backend{peerauthv1.BackendIstio, peerauthv1.BackendNetworkPolicy},
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:               "policy",
+				PodSelectors:       map[string]string{"app": "caller"},
+				WorkloadSelector:   map[string]string{"app": "api"},
+				RequireApproval:    true,
+				ApprovedPrincipals: []string{"cluster.local/ns/client/sa/caller"},
+			}},
+		},
+	}
+	pod := func(namespace, name string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{"app": "caller"}},
+			Spec:       corev1.PodSpec{ServiceAccountName: name},
+		}
+	}
+	rt := newReconcilerTest(t, dap, pod("client", "caller"), pod("client", "worker"), pod("other", "caller"))
+	c := rt.c
+	reconcile := func() *unstructured.Unstructured {
+		t.Helper()
+		if _, err := rt.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(dap)}); err != nil {
+			t.Fatal(err)
+		}
+		np := &unstructured.Unstructured{}
+		np.SetGroupVersionKind(NetworkPolicyGVK)
+		if err := c.Get(ctx, client.ObjectKey{Namespace: "server", Name: "policy"}, np); err != nil {
+			t.Fatalf("generated NetworkPolicy: %v", err)
+		}
+		return np
+	}
+	approve := func(principal string) {
+		t.Helper()
+		if err := c.Get(ctx, client.ObjectKeyFromObject(dap), dap); err != nil {
+			t.Fatal(err)
+		}
+		dap.Spec.DynamicPolicies[0].ApprovedPrincipals = append(dap.Spec.DynamicPolicies[0].ApprovedPrincipals, principal)
+		if err := c.Update(ctx, dap); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The principal awaiting approval in another namespace opens no peer for it.
+	np := reconcile()
+	want := []string{"cluster.local/ns/client/sa/caller"}
+	if got := (networkPolicyBackend{}).Principals(np).Slice(); !reflect.DeepEqual(got, want) {
+		t.Errorf("NetworkPolicy principals = %v, want %v", got, want)
+	}
+	ingress, _, _ := unstructured.NestedSlice(np.Object, "spec", "ingress")
+	if len(ingress) != 1 {
+		t.Fatalf("NetworkPolicy ingress = %v, want one rule", ingress)
+	}
+	if peers, _, _ := unstructured.NestedSlice(ingress[0].(map[string]interface{}), "from"); len(peers) != 1 {
+		t.Errorf("NetworkPolicy peers = %v, want only the approved principal's namespace", peers)
+	}
+
+	// Approving another principal in an admitted namespace leaves the peers alone but is still
+	// written, so the NetworkPolicy reports the grant.
+	approve("cluster.local/ns/client/sa/worker")
+	np = reconcile()
+	want = append(want, "cluster.local/ns/client/sa/worker")
+	if got := (networkPolicyBackend{}).Principals(np).Slice(); !reflect.DeepEqual(got, want) {
+		t.Errorf("NetworkPolicy principals = %v, want %v", got, want)
+	}
+	if applies := c.applies(np); applies != 2 {
+		t.Errorf("NetworkPolicy applied %d times, want twice", applies)
+	}
+
+	// A peer removed by hand no longer counts as a grant.
+	unstructured.RemoveNestedField(np.Object, "spec", "ingress")
+	if got := (networkPolicyBackend{}).Principals(np); len(got) != 0 {
+		t.Errorf("NetworkPolicy without peers principals = %v, want none", got)
+	}
+}
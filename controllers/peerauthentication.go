@@ -0,0 +1,198 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PeerAuthenticationGVK is the Istio PeerAuthentication kind generated when a DAP sets
+// spec.peerAuthentication.
+var PeerAuthenticationGVK = schema.GroupVersionKind{ // nolint:gochecknoglobals
+	Group:   "security.istio.io",
+	Version: "v1beta1",
+	Kind:    "PeerAuthentication",
+}
+
+// PeerAuthentications builds a STRICT PeerAuthentication for the workloads of each of the DAP's
+// policies, in spec order. Policies protecting the same workloads share the first one's.
+func PeerAuthentications(dap *peerauthv1.DynamicAuthorizationPolicy) []*unstructured.Unstructured {
+	pas := []*unstructured.Unstructured{}
+	if dap.Spec.PeerAuthentication == nil || !dap.HasBackend(peerauthv1.BackendIstio) {
+		return pas
+	}
+	seen := []labels.Set{}
+	for _, policy := range dap.GetPolicies() {
+		if containsSelector(seen, policy.WorkloadSelector) {
+			continue
+		}
+		seen = append(seen, policy.WorkloadSelector)
+
+		pa := &unstructured.Unstructured{}
+		pa.SetGroupVersionKind(PeerAuthenticationGVK)
+		pa.SetName(policy.Name)
+		pa.SetNamespace(dap.GetNamespace())
+		pa.SetLabels(map[string]string{dapLabel: dap.GetName()})
+		pa.Object["spec"] = peerAuthenticationSpec(policy.WorkloadSelector, dap.Spec.PeerAuthentication)
+		pas = append(pas, pa)
+	}
+	return pas
+}
+
+func containsSelector(selectors []labels.Set, selector labels.Set) bool {
+	for _, s := range selectors {
+		if labels.Equals(s, selector) {
+			return true
+		}
+	}
+	return false
+}
+
+func peerAuthenticationSpec(selector labels.Set, pa *peerauthv1.PeerAuthentication) map[string]interface{} {
+	spec := map[string]interface{}{
+		"mtls": map[string]interface{}{"mode": string(peerauthv1.MTLSStrict)},
+	}
+	if len(selector) > 0 {
+		matchLabels := map[string]interface{}{}
+		for k, v := range selector {
+			matchLabels[k] = v
+		}
+		spec["selector"] = map[string]interface{}{"matchLabels": matchLabels}
+	}
+	if len(pa.PortLevelMTLS) > 0 {
+		ports := map[string]interface{}{}
+		for _, port := range pa.PortLevelMTLS {
+			ports[strconv.Itoa(int(port.Port))] = map[string]interface{}{"mode": string(port.Mode)}
+		}
+		spec["portLevelMtls"] = ports
+	}
+	return spec
+}
+
+// peerAuthenticationConflicts returns the names of the PeerAuthentications in the DAP's
+// namespace, not generated for it, that make mutual TLS permissive for workloads the desired
+// PeerAuthentications make STRICT. Workload PeerAuthentications take precedence over
+// namespace-wide ones, so a namespace-wide policy only conflicts with a namespace-wide one.
+func (r *DynamicAuthorizationPolicyReconciler) peerAuthenticationConflicts(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy, desired []*unstructured.Unstructured) ([]string, error) {
+	if len(desired) == 0 {
+		return nil, nil
+	}
+	existing := &unstructured.UnstructuredList{}
+	existing.SetGroupVersionKind(PeerAuthenticationGVK.GroupVersion().WithKind(PeerAuthenticationGVK.Kind + "List"))
+	err := r.List(ctx, existing, client.InNamespace(dap.GetNamespace()))
+	if meta.IsNoMatchError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list PeerAuthentications")
+	}
+	conflicts := []string{}
+	for i := range existing.Items {
+		other := &existing.Items[i]
+		if metav1.IsControlledBy(other, dap) || !permissive(other) {
+			continue
+		}
+		for _, pa := range desired {
+			if overrides(peerAuthenticationSelector(other), peerAuthenticationSelector(pa)) {
+				conflicts = append(conflicts, other.GetName())
+				break
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// permissive reports whether a PeerAuthentication accepts plaintext on any port.
+func permissive(pa *unstructured.Unstructured) bool {
+	isPermissive := func(mode string) bool {
+		return mode == string(peerauthv1.MTLSPermissive) || mode == string(peerauthv1.MTLSDisable)
+	}
+	if mode, _, _ := unstructured.NestedString(pa.Object, "spec", "mtls", "mode"); isPermissive(mode) {
+		return true
+	}
+	ports, _, _ := unstructured.NestedMap(pa.Object, "spec", "portLevelMtls")
+	for port := range ports {
+		if mode, _, _ := unstructured.NestedString(ports, port, "mode"); isPermissive(mode) {
+			return true
+		}
+	}
+	return false
+}
+
+func peerAuthenticationSelector(pa *unstructured.Unstructured) labels.Set {
+	matchLabels, _, _ := unstructured.NestedStringMap(pa.Object, "spec", "selector", "matchLabels")
+	return matchLabels
+}
+
+// overrides reports whether a PeerAuthentication selecting other may apply instead of one
+// selecting strict to some workload.
+func overrides(other, strict labels.Set) bool {
+	switch {
+	case len(strict) == 0:
+		return true
+	case len(other) == 0:
+		return false
+	}
+	for k, v := range other {
+		if sv, ok := strict[k]; ok && sv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// recordPeerAuthenticationConflicts sets the StrictMTLS condition when the DAP generates
+// PeerAuthentications, emitting a warning Event when conflicting policies appear or change.
+func (r *DynamicAuthorizationPolicyReconciler) recordPeerAuthenticationConflicts(
+	dap *peerauthv1.DynamicAuthorizationPolicy, conflicts []string) {
+	if dap.Spec.PeerAuthentication == nil {
+		meta.RemoveStatusCondition(&dap.Status.Conditions, peerauthv1.ConditionStrictMTLS)
+		return
+	}
+	condition := metav1.Condition{
+		Type:               peerauthv1.ConditionStrictMTLS,
+		Status:             metav1.ConditionTrue,
+		Reason:             reasonStrictMTLS,
+		Message:            "no other PeerAuthentication allows plaintext traffic to protected workloads",
+		ObservedGeneration: dap.GetGeneration(),
+	}
+	if len(conflicts) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = reasonPermissivePeerAuthentication
+		condition.Message = fmt.Sprintf("PeerAuthentications %s allow plaintext traffic to protected workloads",
+			strings.Join(conflicts, ", "))
+		if previous := meta.FindStatusCondition(dap.Status.Conditions, condition.Type); previous == nil ||
+			previous.Message != condition.Message {
+			r.Recorder.Event(dap, corev1.EventTypeWarning, reasonPermissivePeerAuthentication, condition.Message)
+		}
+	}
+	meta.SetStatusCondition(&dap.Status.Conditions, condition)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestPeerAuthentications(t *testing.T) {
+	t.Parallel()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "default"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{
+				{Name: "a", WorkloadSelector: map[string]string{"app": "server"}},
+				{Name: "b", WorkloadSelector: map[string]string{"app": "server"}},
+				{Name: "c"},
+			},
+		},
+	}
+	if pas := PeerAuthentications(dap); len(pas) != 0 {
+		t.Fatalf("PeerAuthentications without spec.peerAuthentication = %v, want none", pas)
+	}
+
+	dap.Spec.PeerAuthentication = &peerauthv1.PeerAuthentication{
+		PortLevelMTLS: []peerauthv1.PortMTLS{{Port: 8080, Mode: peerauthv1.MTLSPermissive}},
+	}
+	pas := PeerAuthentications(dap)
+	if len(pas) != 2 {
+		t.Fatalf("PeerAuthentications = %d, want one per distinct workload selector", len(pas))
+	}
+	want := map[string]interface{}{
+		"mtls":          map[string]interface{}{"mode": "STRICT"},
+		"selector":      map[string]interface{}{"matchLabels": map[string]interface{}{"app": "server"}},
+		"portLevelMtls": map[string]interface{}{"8080": map[string]interface{}{"mode": "PERMISSIVE"}},
+	}
+	if pas[0].GetName() != "a" || !reflect.DeepEqual(pas[0].Object["spec"], want) {
+		t.Errorf("PeerAuthentication %s spec = %v, want %v", pas[0].GetName(), pas[0].Object["spec"], want)
+	}
+	if _, ok := pas[1].Object["spec"].(map[string]interface{})["selector"]; ok || pas[1].GetName() != "c" {
+		t.Errorf("PeerAuthentication %s should be namespace-wide, spec = %v", pas[1].GetName(), pas[1].Object["spec"])
+	}
+	if pas[0].GetLabels()[dapLabel] != "dap" || pas[0].GetNamespace() != "default" {
+		t.Errorf("PeerAuthentication metadata = %v/%v", pas[0].GetNamespace(), pas[0].GetLabels())
+	}
+}
+
+func TestPeerAuthenticationOverrides(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		other, strict labels.Set
+		want          bool
+	}{
+		"both namespace-wide":                   {want: true},
+		"namespace-wide over workload":          {strict: labels.Set{"app": "a"}},
+		"workload over namespace-wide":          {other: labels.Set{"app": "a"}, want: true},
+		"same workload":                         {other: labels.Set{"app": "a"}, strict: labels.Set{"app": "a"}, want: true},
+		"different workload":                    {other: labels.Set{"app": "b"}, strict: labels.Set{"app": "a"}},
+		"disjoint keys may select the same pod": {other: labels.Set{"tier": "web"}, strict: labels.Set{"app": "a"}, want: true},
+	}
+	for name, tt := range tests {
+		if got := overrides(tt.other, tt.strict); got != tt.want {
+			t.Errorf("%s: overrides = %t, want %t", name, got, tt.want)
+		}
+	}
+}
+
+func peerAuthentication(name, mode string, selector map[string]interface{}) *unstructured.Unstructured {
+	pa := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"mtls": map[string]interface{}{"mode": mode}},
+	}}
+	if selector != nil {
+		pa.Object["spec"].(map[string]interface{})["selector"] = map[string]interface{}{"matchLabels": selector}
+	}
+	pa.SetGroupVersionKind(PeerAuthenticationGVK)
+	pa.SetName(name)
+	pa.SetNamespace("default")
+	return pa
+}
+
+func TestReconcilePeerAuthentication(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "default"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:             "policy",
+				TrustDomain:      "cluster.local",
+				WorkloadSelector: map[string]string{"app": "server"},
+				PodSelectors:     map[string]string{"app": "caller"},
+			}},
+			PeerAuthentication: &peerauthv1.PeerAuthentication{},
+		},
+	}
+	rt := newReconcilerTest(t,
+		dap,
+		peerAuthentication("legacy", "PERMISSIVE", map[string]interface{}{"app": "server"}),
+		peerAuthentication("mesh-default", "PERMISSIVE", nil),
+	)
+	c := rt.c
+	recorder := rt.recorder
+
+	got := rt.reconcileDAP(dap)
+	pa := &unstructured.Unstructured{}
+	pa.SetGroupVersionKind(PeerAuthenticationGVK)
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "policy"}, pa); err != nil {
+		t.Fatalf("generated PeerAuthentication: %v", err)
+	}
+	if !metav1.IsControlledBy(pa, got) {
+		t.Error("generated PeerAuthentication is not controlled by the DAP")
+	}
+	condition := meta.FindStatusCondition(got.Status.Conditions, peerauthv1.ConditionStrictMTLS)
+	if condition == nil || condition.Status != metav1.ConditionFalse ||
+		condition.Message != "PeerAuthentications legacy allow plaintext traffic to protected workloads" {
+		t.Errorf("StrictMTLS condition = %+v, want False naming only legacy", condition)
+	}
+	select {
+	case e := <-recorder.Events:
+		if e != corev1.EventTypeWarning+" "+reasonPermissivePeerAuthentication+" "+condition.Message {
+			t.Errorf("event = %q", e)
+		}
+	default:
+		t.Error("expected a PermissivePeerAuthentication event")
+	}
+
+	got.Spec.PeerAuthentication = nil
+	if err := c.Update(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	got = rt.reconcileDAP(dap)
+	if err := c.Get(ctx, client.ObjectKeyFromObject(pa), pa); err == nil {
+		t.Error("generated PeerAuthentication survived removing spec.peerAuthentication")
+	}
+	if condition := meta.FindStatusCondition(got.Status.Conditions, peerauthv1.ConditionStrictMTLS); condition != nil {
+		t.Errorf("StrictMTLS condition = %+v, want none", condition)
+	}
+}
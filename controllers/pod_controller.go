@@ -18,72 +18,169 @@ package controllers
 
 import (
 	"context"
-	"fmt"
+	"sync"
 	"time"
 
 	v1 "github.com/aweis89/istio-dynamic-principles/api/v1"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
 // PodReconciler reconciles a Pod object.
 type PodReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// Triggers receives the DAPs whose selectors match a changed pod.
+	Triggers chan<- event.GenericEvent
+	// Principals, when set, is updated with every pod change and deletion.
+	Principals *PrincipalIndex
+	// Options configures the controller's concurrency and workqueue rate limiter.
+	Options controller.Options
+
+	// previous holds the states a pod had before it was relabelled or
+	// deleted, so DAPs that selected it are still triggered when no
+	// PrincipalIndex remembers them.
+	previous previousPods
 }
 
-const podSelectorIndex = ".spec.podSelector"
+// previousPods records superseded pod states until the pod is next reconciled.
+type previousPods struct {
+	mu   sync.Mutex
+	pods map[types.NamespacedName][]*corev1.Pod
+}
 
-func indexKey(key, val string) string {
-	return fmt.Sprintf("%s=%s", key, val)
+// remember records a state pod no longer has.
+func (p *previousPods) remember(pod *corev1.Pod) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pods == nil {
+		p.pods = map[types.NamespacedName][]*corev1.Pod{}
+	}
+	key := client.ObjectKeyFromObject(pod)
+	for _, seen := range p.pods[key] {
+		if labels.Equals(seen.Labels, pod.Labels) {
+			return
+		}
+	}
+	slim := &corev1.Pod{}
+	slim.SetNamespace(pod.Namespace)
+	slim.SetName(pod.Name)
+	slim.SetLabels(pod.Labels)
+	p.pods[key] = append(p.pods[key], slim)
 }
-func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	log := log.FromContext(ctx)
 
+// take returns and forgets the states recorded for key.
+func (p *previousPods) take(key types.NamespacedName) []*corev1.Pod {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pods := p.pods[key]
+	delete(p.pods, key)
+	return pods
+}
+
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+
+func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	previous := r.previous.take(req.NamespacedName)
 	pod := &corev1.Pod{}
 	err := r.Get(ctx, req.NamespacedName, pod)
 	if err != nil {
-		if kerrors.IsNotFound(err) {
-			return ctrl.Result{}, nil
+		if !kerrors.IsNotFound(err) {
+			r.requeuePrevious(previous)
+			return ctrl.Result{}, errors.Wrapf(err, "unable to retrieve pod")
+		}
+		if r.Principals != nil {
+			return ctrl.Result{}, r.trigger(ctx, req.NamespacedName, r.Principals.Forget(req.NamespacedName))
+		}
+		pod = nil
+	}
+
+	affected := map[types.NamespacedName]bool{}
+	if r.Principals != nil && pod != nil {
+		for _, key := range r.Principals.Observe(pod) {
+			affected[key] = true
 		}
-		return ctrl.Result{}, errors.Wrapf(err, "unable to retrieve pod")
 	}
-	podLabels := pod.GetLabels()
-	if podLabels == nil {
-		return ctrl.Result{}, nil
+	states := previous
+	if pod != nil {
+		states = append(states, pod)
 	}
-	for k, v := range podLabels {
-		log.Info("querying DAPS with labels", "labelKey", k, "labelVal", v)
-		dapList := v1.DynamicAuthorizationPolicyList{}
-		err := r.List(ctx, &dapList, client.MatchingFields{podSelectorIndex: indexKey(k, v)})
+	for _, state := range states {
+		matched, err := matchingDAPs(ctx, r, state)
 		if err != nil {
+			r.requeuePrevious(previous)
 			return ctrl.Result{}, errors.Wrapf(err, "unable to list associated DAPs")
 		}
-		for i := range dapList.Items {
-			dap := dapList.Items[i]
-			log.Info("triggering DAP", "name", dap.Name, "namespace", dap.Namespace)
-			if dap.GetAnnotations() == nil {
-				dap.SetAnnotations(map[string]string{})
-			}
-			dap.Annotations[fmt.Sprintf("trigger-reconcile-%s", pod.GetName())] = time.Now().String()
-			err := r.Update(ctx, &dap)
-			if err != nil {
-				return ctrl.Result{}, errors.Wrapf(err, "unable to update pod")
-			}
+		for _, key := range matched {
+			affected[key] = true
 		}
 	}
-	return ctrl.Result{}, nil
+	return ctrl.Result{}, r.trigger(ctx, req.NamespacedName, sortedKeys(affected))
+}
+
+// requeuePrevious keeps superseded pod states for the retry of a failed reconcile.
+func (r *PodReconciler) requeuePrevious(pods []*corev1.Pod) {
+	for _, pod := range pods {
+		r.previous.remember(pod)
+	}
+}
+
+// trigger enqueues the DAPs affected by a change to pod.
+func (r *PodReconciler) trigger(ctx context.Context, pod types.NamespacedName, daps []types.NamespacedName) error {
+	log := log.FromContext(ctx)
+	for _, key := range daps {
+		log.Info("triggering DAP", "name", key.Name, "namespace", key.Namespace)
+		pendingPodChanges.observe(key, pod, time.Now())
+		dap := &v1.DynamicAuthorizationPolicy{}
+		dap.SetNamespace(key.Namespace)
+		dap.SetName(key.Name)
+		select {
+		case r.Triggers <- event.GenericEvent{Object: dap}:
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "unable to trigger DAP %s", key)
+		}
+	}
+	return nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *PodReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	err := ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Pod{}).
+		Named("pod").
+		For(&corev1.Pod{}, builder.WithPredicates(r.rememberPrevious())).
+		WithOptions(r.Options).
 		Complete(r)
 	return errors.Wrap(err, "unable to start POD controller")
 }
+
+// rememberPrevious filters no events, remembering the labels a pod had before a
+// relabel or deletion. Without a PrincipalIndex those labels are the only way to
+// find the DAPs that used to select the pod.
+func (r *PodReconciler) rememberPrevious() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			old, ok := e.ObjectOld.(*corev1.Pod)
+			if ok && r.Principals == nil && !labels.Equals(old.Labels, e.ObjectNew.GetLabels()) {
+				r.previous.remember(old)
+			}
+			return true
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			if pod, ok := e.Object.(*corev1.Pod); ok && r.Principals == nil {
+				r.previous.remember(pod)
+			}
+			return true
+		},
+	}
+}
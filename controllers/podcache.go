@@ -0,0 +1,361 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+const (
+	defaultPodResync = 10 * time.Hour
+	// allNamespaces prefixes field index keys matching pods in every namespace, as the
+	// controller-runtime cache does.
+	allNamespaces = "__all_namespaces"
+)
+
+// SlimPod returns a copy of pod keeping only the fields the controllers read: identity,
+// labels, deletion timestamp, service account and phase.
+func SlimPod(pod *corev1.Pod) *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta: pod.TypeMeta,
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              pod.Name,
+			Namespace:         pod.Namespace,
+			UID:               pod.UID,
+			ResourceVersion:   pod.ResourceVersion,
+			Labels:            pod.Labels,
+			DeletionTimestamp: pod.DeletionTimestamp,
+		},
+		Spec:   corev1.PodSpec{ServiceAccountName: pod.Spec.ServiceAccountName},
+		Status: corev1.PodStatus{Phase: pod.Status.Phase},
+	}
+}
+
+// NewSlimPodCache returns a cache.NewCacheFunc serving pods from informers that store only
+// SlimPod copies, and every other kind from the default cache. Pods read through it lack
+// their containers, volumes and most metadata, so they must not be written back. When
+// namespaces are given, every kind is cached from those namespaces only.
+func NewSlimPodCache(namespaces ...string) cache.NewCacheFunc {
+	return func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+		newCache, watched := cache.New, namespaces
+		switch {
+		case len(namespaces) > 0:
+			newCache = cache.MultiNamespacedCacheBuilder(namespaces)
+		case opts.Namespace != "":
+			watched = []string{opts.Namespace}
+		}
+		delegate, err := newCache(config, opts)
+		if err != nil {
+			return nil, err
+		}
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to create pod clientset")
+		}
+		resync := defaultPodResync
+		if opts.Resync != nil {
+			resync = *opts.Resync
+		}
+		return &slimPodCache{
+			Cache:  delegate,
+			scheme: opts.Scheme,
+			pods:   newSlimPodInformers(clientset, watched, resync),
+		}, nil
+	}
+}
+
+// newSlimPodInformers returns a slim pod informer for each namespace, or a single informer
+// for every namespace if none are given.
+func newSlimPodInformers(clientset kubernetes.Interface, namespaces []string, resync time.Duration) slimPodInformers {
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	informers := slimPodInformers{}
+	for _, ns := range namespaces {
+		pods := clientset.CoreV1().Pods(ns)
+		informers[ns] = newSlimPodInformer(&toolscache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return pods.List(context.Background(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return pods.Watch(context.Background(), options)
+			},
+		}, resync)
+	}
+	return informers
+}
+
+// newSlimPodInformer returns an informer over lw that slims every pod before storing it.
+func newSlimPodInformer(lw toolscache.ListerWatcher, resync time.Duration) toolscache.SharedIndexInformer {
+	return toolscache.NewSharedIndexInformer(&slimListWatch{lw}, &corev1.Pod{}, resync,
+		toolscache.Indexers{toolscache.NamespaceIndex: toolscache.MetaNamespaceIndexFunc})
+}
+
+// slimListWatch slims the pods returned by the wrapped ListerWatcher.
+type slimListWatch struct {
+	toolscache.ListerWatcher
+}
+
+func (lw *slimListWatch) List(options metav1.ListOptions) (runtime.Object, error) {
+	obj, err := lw.ListerWatcher.List(options)
+	if err != nil {
+		return nil, err
+	}
+	if list, ok := obj.(*corev1.PodList); ok {
+		for i := range list.Items {
+			list.Items[i] = *SlimPod(&list.Items[i])
+		}
+	}
+	return obj, nil
+}
+
+func (lw *slimListWatch) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	w, err := lw.ListerWatcher.Watch(options)
+	if err != nil {
+		return nil, err
+	}
+	return watch.Filter(w, func(in watch.Event) (watch.Event, bool) {
+		if pod, ok := in.Object.(*corev1.Pod); ok {
+			in.Object = SlimPod(pod)
+		}
+		return in, true
+	}), nil
+}
+
+// slimPodInformers holds the slim pod informers of each watched namespace, keyed by
+// namespace or by metav1.NamespaceAll when every namespace is watched. It implements
+// cache.Informer over all of them.
+type slimPodInformers map[string]toolscache.SharedIndexInformer
+
+func (i slimPodInformers) AddEventHandler(handler toolscache.ResourceEventHandler) {
+	for _, informer := range i {
+		informer.AddEventHandler(handler)
+	}
+}
+
+func (i slimPodInformers) AddEventHandlerWithResyncPeriod(handler toolscache.ResourceEventHandler,
+	resyncPeriod time.Duration) {
+	for _, informer := range i {
+		informer.AddEventHandlerWithResyncPeriod(handler, resyncPeriod)
+	}
+}
+
+func (i slimPodInformers) AddIndexers(indexers toolscache.Indexers) error {
+	for _, informer := range i {
+		if err := informer.AddIndexers(indexers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i slimPodInformers) HasSynced() bool {
+	for _, informer := range i {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (i slimPodInformers) Run(stop <-chan struct{}) {
+	for _, informer := range i {
+		go informer.Run(stop)
+	}
+}
+
+// indexers returns the stores holding the pods of namespace, or of every watched namespace
+// if it is empty. Namespaces that are not watched have none.
+func (i slimPodInformers) indexers(namespace string) []toolscache.Indexer {
+	if informer, ok := i[metav1.NamespaceAll]; ok {
+		return []toolscache.Indexer{informer.GetIndexer()}
+	}
+	if namespace != metav1.NamespaceAll {
+		if informer, ok := i[namespace]; ok {
+			return []toolscache.Indexer{informer.GetIndexer()}
+		}
+		return nil
+	}
+	indexers := []toolscache.Indexer{}
+	for _, informer := range i {
+		indexers = append(indexers, informer.GetIndexer())
+	}
+	return indexers
+}
+
+// slimPodCache serves pods from its own informers and delegates every other kind. Pods in
+// namespaces that are not watched are reported missing rather than as errors, so policies
+// selecting them resolve to the pods the controller can see.
+type slimPodCache struct {
+	cache.Cache
+	scheme *runtime.Scheme
+	pods   slimPodInformers
+}
+
+var podGVK = corev1.SchemeGroupVersion.WithKind("Pod") // nolint:gochecknoglobals
+
+func (c *slimPodCache) isPod(obj runtime.Object) bool {
+	gvk, err := apiutil.GVKForObject(obj, c.scheme)
+	return err == nil && (gvk == podGVK || gvk == corev1.SchemeGroupVersion.WithKind("PodList"))
+}
+
+func (c *slimPodCache) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || !c.isPod(obj) {
+		return c.Cache.Get(ctx, key, obj)
+	}
+	for _, indexer := range c.pods.indexers(key.Namespace) {
+		item, exists, err := indexer.GetByKey(key.String())
+		if err != nil {
+			return errors.Wrapf(err, "unable to get pod %s from cache", key)
+		}
+		if exists {
+			item.(*corev1.Pod).DeepCopyInto(pod)
+			pod.SetGroupVersionKind(podGVK)
+			return nil
+		}
+	}
+	return kerrors.NewNotFound(corev1.Resource("pods"), key.Name)
+}
+
+func (c *slimPodCache) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	podList, ok := list.(*corev1.PodList)
+	if !ok || !c.isPod(list) {
+		return c.Cache.List(ctx, list, opts...)
+	}
+	listOpts := client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+
+	var items []interface{}
+	for _, indexer := range c.pods.indexers(listOpts.Namespace) {
+		found, err := listIndexer(indexer, listOpts)
+		if err != nil {
+			return err
+		}
+		items = append(items, found...)
+	}
+
+	selector := listOpts.LabelSelector
+	if selector == nil {
+		selector = labels.Everything()
+	}
+	podList.Items = make([]corev1.Pod, 0, len(items))
+	for _, item := range items {
+		pod := item.(*corev1.Pod)
+		if !selector.Matches(labels.Set(pod.GetLabels())) {
+			continue
+		}
+		podList.Items = append(podList.Items, *pod.DeepCopy())
+	}
+	return nil
+}
+
+// listIndexer returns the pods in indexer matching the namespace and field selector of opts.
+func listIndexer(indexer toolscache.Indexer, opts client.ListOptions) ([]interface{}, error) {
+	var items []interface{}
+	var err error
+	switch {
+	case opts.FieldSelector != nil:
+		field, val, ok := requiresExactMatch(opts.FieldSelector)
+		if !ok {
+			return nil, errors.New("field selectors on cached pods must be a single exact match")
+		}
+		ns := opts.Namespace
+		if ns == "" {
+			ns = allNamespaces
+		}
+		items, err = indexer.ByIndex(fieldIndexName(field), ns+"/"+val)
+	case opts.Namespace != "":
+		items, err = indexer.ByIndex(toolscache.NamespaceIndex, opts.Namespace)
+	default:
+		items = indexer.List()
+	}
+	return items, errors.Wrap(err, "unable to list pods from cache")
+}
+
+func requiresExactMatch(selector fields.Selector) (field, val string, ok bool) {
+	reqs := selector.Requirements()
+	if len(reqs) != 1 || reqs[0].Operator == selection.NotEquals {
+		return "", "", false
+	}
+	return reqs[0].Field, reqs[0].Value, true
+}
+
+func fieldIndexName(field string) string {
+	return "field:" + field
+}
+
+func (c *slimPodCache) GetInformer(ctx context.Context, obj client.Object) (cache.Informer, error) {
+	if c.isPod(obj) {
+		return c.pods, nil
+	}
+	return c.Cache.GetInformer(ctx, obj)
+}
+
+func (c *slimPodCache) GetInformerForKind(ctx context.Context, gvk schema.GroupVersionKind) (cache.Informer, error) {
+	if gvk == podGVK {
+		return c.pods, nil
+	}
+	return c.Cache.GetInformerForKind(ctx, gvk)
+}
+
+// IndexField indexes cached pods the way the controller-runtime cache does, keying values by
+// namespace so they can be listed with MatchingFields within or across namespaces.
+func (c *slimPodCache) IndexField(ctx context.Context, obj client.Object, field string,
+	extractValue client.IndexerFunc) error {
+	if !c.isPod(obj) {
+		return c.Cache.IndexField(ctx, obj, field, extractValue)
+	}
+	return c.pods.AddIndexers(toolscache.Indexers{fieldIndexName(field): func(item interface{}) ([]string, error) {
+		pod, ok := item.(*corev1.Pod)
+		if !ok {
+			return nil, errors.Errorf("expected a pod but got %T", item)
+		}
+		keys := []string{}
+		for _, val := range extractValue(pod) {
+			keys = append(keys, pod.GetNamespace()+"/"+val, allNamespaces+"/"+val)
+		}
+		return keys, nil
+	}})
+}
+
+func (c *slimPodCache) Start(ctx context.Context) error {
+	c.pods.Run(ctx.Done())
+	return c.Cache.Start(ctx)
+}
+
+func (c *slimPodCache) WaitForCacheSync(ctx context.Context) bool {
+	return toolscache.WaitForCacheSync(ctx.Done(), c.pods.HasSynced) && c.Cache.WaitForCacheSync(ctx)
+}
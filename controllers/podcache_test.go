@@ -0,0 +1,262 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// realisticPod returns a pod shaped like a typical meshed workload, with a sidecar,
+// environment, volumes, managed fields and status.
+func realisticPod(i int) *corev1.Pod {
+	name := fmt.Sprintf("workload-%d-7d9f8c6b5-%05d", i%500, i)
+	container := func(name string) corev1.Container {
+		env := []corev1.EnvVar{}
+		for j := 0; j < 10; j++ {
+			env = append(env, corev1.EnvVar{Name: fmt.Sprintf("ENV_%d", j), Value: fmt.Sprintf("value-%d-%d", i, j)})
+		}
+		return corev1.Container{
+			Name:  name,
+			Image: "registry.example.com/team/" + name + ":v1.2.3",
+			Args:  []string{"--port=8080", "--log-level=info"},
+			Env:   env,
+			Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP}},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("100m"),
+					corev1.ResourceMemory: resource.MustParse("128Mi"),
+				},
+			},
+			VolumeMounts: []corev1.VolumeMount{{Name: "token", MountPath: "/var/run/secrets/tokens"}},
+		}
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       fmt.Sprintf("team-%d", i%50),
+			UID:             types.UID(fmt.Sprintf("00000000-0000-0000-0000-%012d", i)),
+			ResourceVersion: fmt.Sprint(i),
+			Labels: map[string]string{
+				"app":               fmt.Sprintf("workload-%d", i%500),
+				"pod-template-hash": "7d9f8c6b5",
+				"version":           "v1",
+			},
+			Annotations: map[string]string{
+				"sidecar.istio.io/status":  `{"initContainers":["istio-init"],"containers":["istio-proxy"]}`,
+				"prometheus.io/scrape":     "true",
+				"kubectl.kubernetes.io/rc": fmt.Sprintf("restartedAt-%d", i),
+			},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "workload-7d9f8c6b5", UID: "owner",
+			}},
+			ManagedFields: []metav1.ManagedFieldsEntry{{
+				Manager:    "kube-controller-manager",
+				Operation:  metav1.ManagedFieldsOperationUpdate,
+				APIVersion: "v1",
+				FieldsType: "FieldsV1",
+				FieldsV1:   &metav1.FieldsV1{Raw: make([]byte, 2048)},
+			}},
+		},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: fmt.Sprintf("workload-%d", i%500),
+			InitContainers:     []corev1.Container{container("istio-init")},
+			Containers:         []corev1.Container{container("app"), container("istio-proxy")},
+			Volumes: []corev1.Volume{{
+				Name:         "token",
+				VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+			}},
+			NodeName: fmt.Sprintf("node-%d", i%200),
+		},
+		Status: corev1.PodStatus{
+			Phase:  corev1.PodRunning,
+			PodIP:  fmt.Sprintf("10.%d.%d.%d", i/65536%256, i/256%256, i%256),
+			HostIP: "192.168.0.1",
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+				{Type: corev1.ContainersReady, Status: corev1.ConditionTrue},
+			},
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "app", Ready: true, Image: "registry.example.com/team/app:v1.2.3", ContainerID: "containerd://app"},
+				{Name: "istio-proxy", Ready: true, Image: "istio/proxyv2:1.13.0", ContainerID: "containerd://proxy"},
+			},
+		},
+	}
+}
+
+func TestSlimPod(t *testing.T) {
+	t.Parallel()
+	pod := realisticPod(1)
+	pod.DeletionTimestamp = &metav1.Time{}
+	slim := SlimPod(pod)
+
+	if slim.Name != pod.Name || slim.Namespace != pod.Namespace || slim.Spec.ServiceAccountName != pod.Spec.ServiceAccountName ||
+		slim.Status.Phase != pod.Status.Phase || slim.DeletionTimestamp == nil || len(slim.Labels) != len(pod.Labels) {
+		t.Errorf("SlimPod dropped a field the controllers read: %+v", slim)
+	}
+	if len(slim.Spec.Containers) != 0 || len(slim.Annotations) != 0 || len(slim.ManagedFields) != 0 ||
+		len(slim.Status.ContainerStatuses) != 0 {
+		t.Errorf("SlimPod kept fields the controllers do not read: %+v", slim)
+	}
+}
+
+func TestSlimPodCache(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientset := fake.NewSimpleClientset(realisticPod(0), realisticPod(1), realisticPod(50))
+	c := startSlimPodCache(ctx, t, clientset)
+
+	pod := corev1.Pod{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(realisticPod(1)), &pod); err != nil {
+		t.Fatal(err)
+	}
+	if pod.Spec.ServiceAccountName != "workload-1" || len(pod.Spec.Containers) != 0 {
+		t.Errorf("unexpected cached pod %+v", pod)
+	}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "team-0", Name: "missing"}, &pod); !kerrors.IsNotFound(err) {
+		t.Errorf("Get of a missing pod returned %v, want NotFound", err)
+	}
+
+	tests := map[string]struct {
+		opts []client.ListOption
+		want int
+	}{
+		"all":       {nil, 3},
+		"namespace": {[]client.ListOption{client.InNamespace("team-0")}, 2},
+		"labels":    {[]client.ListOption{client.MatchingLabels{"app": "workload-1"}}, 1},
+		"field":     {[]client.ListOption{client.MatchingFields{"spec.serviceAccountName": "workload-50"}}, 1},
+		"field in namespace": {[]client.ListOption{
+			client.InNamespace("team-1"), client.MatchingFields{"spec.serviceAccountName": "workload-50"},
+		}, 0},
+	}
+	for name, tt := range tests {
+		list := corev1.PodList{}
+		if err := c.List(ctx, &list, tt.opts...); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(list.Items) != tt.want {
+			t.Errorf("%s: listed %d pods, want %d", name, len(list.Items), tt.want)
+		}
+	}
+}
+
+func TestSlimPodCacheWatchedNamespaces(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientset := fake.NewSimpleClientset(realisticPod(0), realisticPod(1), realisticPod(50))
+	c := startSlimPodCache(ctx, t, clientset, "team-0", "team-2")
+
+	pod := corev1.Pod{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(realisticPod(1)), &pod); !kerrors.IsNotFound(err) {
+		t.Errorf("Get of a pod in an unwatched namespace returned %v, want NotFound", err)
+	}
+	tests := map[string]struct {
+		opts []client.ListOption
+		want int
+	}{
+		"all watched":         {nil, 2},
+		"watched namespace":   {[]client.ListOption{client.InNamespace("team-0")}, 2},
+		"unwatched namespace": {[]client.ListOption{client.InNamespace("team-1")}, 0},
+		"field":               {[]client.ListOption{client.MatchingFields{"spec.serviceAccountName": "workload-50"}}, 1},
+		"field in unwatched namespace": {[]client.ListOption{
+			client.InNamespace("team-1"), client.MatchingFields{"spec.serviceAccountName": "workload-1"},
+		}, 0},
+	}
+	for name, tt := range tests {
+		list := corev1.PodList{}
+		if err := c.List(ctx, &list, tt.opts...); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(list.Items) != tt.want {
+			t.Errorf("%s: listed %d pods, want %d", name, len(list.Items), tt.want)
+		}
+	}
+}
+
+// startSlimPodCache returns a synced slim pod cache over clientset watching namespaces, with
+// pods indexed by service account.
+func startSlimPodCache(ctx context.Context, t *testing.T, clientset kubernetes.Interface,
+	namespaces ...string) *slimPodCache {
+	t.Helper()
+	c := &slimPodCache{
+		scheme: clientgoscheme.Scheme,
+		pods:   newSlimPodInformers(clientset, namespaces, 0),
+	}
+	err := c.IndexField(ctx, &corev1.Pod{}, "spec.serviceAccountName", func(obj client.Object) []string {
+		return []string{obj.(*corev1.Pod).Spec.ServiceAccountName}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.pods.Run(ctx.Done())
+	if !toolscache.WaitForCacheSync(ctx.Done(), c.pods.HasSynced) {
+		t.Fatal("pod cache did not sync")
+	}
+	return c
+}
+
+// BenchmarkPodCacheMemory reports the heap retained by an informer store holding 50k pods,
+// with and without slimming them first.
+func BenchmarkPodCacheMemory(b *testing.B) {
+	const pods = 50000
+	for name, transform := range map[string]func(*corev1.Pod) *corev1.Pod{
+		"full": func(pod *corev1.Pod) *corev1.Pod { return pod },
+		"slim": SlimPod,
+	} {
+		transform := transform
+		b.Run(name, func(b *testing.B) {
+			var retained uint64
+			for n := 0; n < b.N; n++ {
+				before := runtime.MemStats{}
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				store := toolscache.NewIndexer(toolscache.MetaNamespaceKeyFunc,
+					toolscache.Indexers{toolscache.NamespaceIndex: toolscache.MetaNamespaceIndexFunc})
+				for i := 0; i < pods; i++ {
+					if err := store.Add(transform(realisticPod(i))); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				after := runtime.MemStats{}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				retained = after.HeapAlloc - before.HeapAlloc
+				runtime.KeepAlive(store)
+			}
+			b.ReportMetric(float64(retained)/(1<<20), "MiB/50k-pods")
+		})
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// podContribution is a principal a pod contributes to a policy of a DAP.
+type podContribution struct {
+	dap       types.NamespacedName
+	policy    string
+	principal string
+}
+
+// indexedDAP holds the pods selected by each of a DAP's policies as of its last full sync,
+// kept current from pod events since.
+type indexedDAP struct {
+	generation   int64
+	synced       time.Time
+	policies     []peerauthv1.DynamicPolicy
+	contributors Contributors
+	// changed records the latest state of every pod that changed while a full sync was
+	// listing pods, so the changes can be replayed over the listed pods. A nil pod was deleted.
+	changed map[types.NamespacedName]*corev1.Pod
+}
+
+// PrincipalIndex maintains, for every DAP it has synced, the pods contributing each principal
+// to each policy. The reference count of a principal is the number of pods contributing it, and
+// the principal is dropped when the count reaches zero. Pod events update the index in time
+// proportional to the number of policies rather than the number of pods, and DAPs are fully
+// relisted only when their spec changes or their last full sync is older than the resync period.
+type PrincipalIndex struct {
+	mu   sync.Mutex
+	daps map[types.NamespacedName]*indexedDAP
+	pods map[types.NamespacedName][]podContribution
+}
+
+func NewPrincipalIndex() *PrincipalIndex {
+	return &PrincipalIndex{
+		daps: map[types.NamespacedName]*indexedDAP{},
+		pods: map[types.NamespacedName][]podContribution{},
+	}
+}
+
+// Contributors returns a copy of the pods selected by the DAP's policies if the index holds
+// them for its current generation and they were fully synced within resync.
+func (idx *PrincipalIndex) Contributors(dap *peerauthv1.DynamicAuthorizationPolicy, resync time.Duration,
+	now time.Time) (Contributors, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	entry, ok := idx.daps[client.ObjectKeyFromObject(dap)]
+	if !ok || entry.changed != nil || entry.generation != dap.GetGeneration() || now.Sub(entry.synced) >= resync {
+		return nil, false
+	}
+	return entry.contributors.copy(), true
+}
+
+// BeginSync starts recording pod changes for the DAP ahead of listing its pods.
+func (idx *PrincipalIndex) BeginSync(dap *peerauthv1.DynamicAuthorizationPolicy) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	key := client.ObjectKeyFromObject(dap)
+	entry, ok := idx.daps[key]
+	if !ok {
+		entry = &indexedDAP{contributors: Contributors{}}
+		idx.daps[key] = entry
+	}
+	entry.changed = map[types.NamespacedName]*corev1.Pod{}
+}
+
+// Sync replaces the DAP's entry with the pods listed since BeginSync, replays the pod changes
+// recorded meanwhile and returns a copy of the result.
+func (idx *PrincipalIndex) Sync(dap *peerauthv1.DynamicAuthorizationPolicy, selected Contributors,
+	now time.Time) Contributors {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	key := client.ObjectKeyFromObject(dap)
+	changed := map[types.NamespacedName]*corev1.Pod{}
+	if entry, ok := idx.daps[key]; ok {
+		idx.remove(key, entry)
+		if entry.changed != nil {
+			changed = entry.changed
+		}
+	}
+
+	entry := &indexedDAP{
+		generation:   dap.GetGeneration(),
+		synced:       now,
+		policies:     append([]peerauthv1.DynamicPolicy{}, dap.GetPolicies()...),
+		contributors: Contributors{},
+	}
+	idx.daps[key] = entry
+	for policy, principals := range selected {
+		for principal, pods := range principals {
+			for _, pod := range pods {
+				idx.contribute(key, entry, pod, policy, principal)
+			}
+		}
+	}
+	for podKey, pod := range changed {
+		idx.withdraw(podKey, key)
+		if pod != nil {
+			idx.observe(key, entry, pod)
+		}
+	}
+	return entry.contributors.copy()
+}
+
+// Observe updates the index with the current state of pod, returning the DAPs whose
+// contributors changed or may have changed.
+func (idx *PrincipalIndex) Observe(pod *corev1.Pod) []types.NamespacedName {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	podKey := client.ObjectKeyFromObject(pod)
+	affected := idx.withdraw(podKey, types.NamespacedName{})
+	for key, entry := range idx.daps {
+		if entry.changed != nil {
+			entry.changed[podKey] = pod.DeepCopy()
+		}
+		if idx.observe(key, entry, pod) {
+			affected[key] = true
+		}
+	}
+	return sortedKeys(affected)
+}
+
+// Forget removes a deleted pod from the index, returning the DAPs it contributed to.
+func (idx *PrincipalIndex) Forget(podKey types.NamespacedName) []types.NamespacedName {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, entry := range idx.daps {
+		if entry.changed != nil {
+			entry.changed[podKey] = nil
+		}
+	}
+	return sortedKeys(idx.withdraw(podKey, types.NamespacedName{}))
+}
+
+// Delete drops a deleted DAP from the index.
+func (idx *PrincipalIndex) Delete(key types.NamespacedName) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if entry, ok := idx.daps[key]; ok {
+		idx.remove(key, entry)
+		delete(idx.daps, key)
+	}
+}
+
+// observe adds the principals pod contributes to the entry's policies, reporting whether it
+// contributes any.
+func (idx *PrincipalIndex) observe(key types.NamespacedName, entry *indexedDAP, pod *corev1.Pod) bool {
+	contributed := false
+	for _, policy := range entry.policies {
+		if selects(policy, pod) {
+			idx.contribute(key, entry, client.ObjectKeyFromObject(pod), policy.Name, policy.Principal(*pod))
+			contributed = true
+		}
+	}
+	return contributed
+}
+
+func (idx *PrincipalIndex) contribute(key types.NamespacedName, entry *indexedDAP, pod types.NamespacedName,
+	policy, principal string) {
+	entry.contributors.add(policy, principal, pod)
+	idx.pods[pod] = append(idx.pods[pod], podContribution{dap: key, policy: policy, principal: principal})
+}
+
+// withdraw removes the contributions of pod, to only the given DAP unless it is empty,
+// returning the DAPs it contributed to.
+func (idx *PrincipalIndex) withdraw(pod, only types.NamespacedName) map[types.NamespacedName]bool {
+	affected := map[types.NamespacedName]bool{}
+	kept := []podContribution{}
+	for _, c := range idx.pods[pod] {
+		if only.Name != "" && c.dap != only {
+			kept = append(kept, c)
+			continue
+		}
+		if entry, ok := idx.daps[c.dap]; ok {
+			entry.contributors.remove(c.policy, c.principal, pod)
+			affected[c.dap] = true
+		}
+	}
+	if len(kept) == 0 {
+		delete(idx.pods, pod)
+	} else {
+		idx.pods[pod] = kept
+	}
+	return affected
+}
+
+// remove drops every contribution to the entry from the pod side of the index.
+func (idx *PrincipalIndex) remove(key types.NamespacedName, entry *indexedDAP) {
+	pods := map[types.NamespacedName]bool{}
+	for _, principals := range entry.contributors {
+		for _, contributors := range principals {
+			for _, pod := range contributors {
+				pods[pod] = true
+			}
+		}
+	}
+	for pod := range pods {
+		idx.withdraw(pod, key)
+	}
+}
+
+func sortedKeys(set map[types.NamespacedName]bool) []types.NamespacedName {
+	keys := make([]types.NamespacedName, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sortNamespacedNames(keys)
+	return keys
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func indexDAP(policies int) *peerauthv1.DynamicAuthorizationPolicy {
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "index", Generation: 1},
+	}
+	for i := 0; i < policies; i++ {
+		dap.Spec.DynamicPolicies = append(dap.Spec.DynamicPolicies, peerauthv1.DynamicPolicy{
+			Name:         fmt.Sprintf("policy-%d", i),
+			TrustDomain:  "cluster.local",
+			PodSelectors: map[string]string{"app": fmt.Sprintf("app-%d", i)},
+		})
+	}
+	return dap
+}
+
+func indexPod(name, app, sa string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "index", Labels: map[string]string{"app": app}},
+		Spec:       corev1.PodSpec{ServiceAccountName: sa},
+	}
+}
+
+func principals(c Contributors, policy string) []string {
+	out := []string{}
+	for principal := range c[policy] {
+		out = append(out, principal)
+	}
+	return peerauthv1.FromSlice(out).Difference(nil)
+}
+
+func TestPrincipalIndex(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(0, 0)
+	dap := indexDAP(1)
+	key := client.ObjectKeyFromObject(dap)
+	idx := NewPrincipalIndex()
+
+	if _, ok := idx.Contributors(dap, time.Minute, now); ok {
+		t.Fatal("unsynced DAP served from the index")
+	}
+	idx.BeginSync(dap)
+	idx.Sync(dap, Contributors{}, now)
+
+	if affected := idx.Observe(indexPod("a-1", "app-0", "a")); !reflect.DeepEqual(affected, []types.NamespacedName{key}) {
+		t.Errorf("Observe affected %v, want %v", affected, key)
+	}
+	idx.Observe(indexPod("a-2", "app-0", "a"))
+	if affected := idx.Observe(indexPod("other", "unrelated", "other")); len(affected) != 0 {
+		t.Errorf("unselected pod affected %v", affected)
+	}
+	contributors, ok := idx.Contributors(dap, time.Minute, now)
+	if !ok || !reflect.DeepEqual(principals(contributors, "policy-0"), []string{"cluster.local/ns/index/sa/a"}) {
+		t.Fatalf("contributors = %v, %v", contributors, ok)
+	}
+	if pods := contributors.Pods("policy-0", "cluster.local/ns/index/sa/a"); len(pods) != 2 {
+		t.Errorf("principal has %d contributing pods, want 2", len(pods))
+	}
+
+	idx.Forget(types.NamespacedName{Namespace: "index", Name: "a-1"})
+	contributors, _ = idx.Contributors(dap, time.Minute, now)
+	if len(principals(contributors, "policy-0")) != 1 {
+		t.Error("principal dropped while a pod still contributes it")
+	}
+	if affected := idx.Observe(indexPod("a-2", "relabelled", "a")); !reflect.DeepEqual(affected, []types.NamespacedName{key}) {
+		t.Errorf("relabelled pod affected %v, want %v", affected, key)
+	}
+	contributors, _ = idx.Contributors(dap, time.Minute, now)
+	if len(principals(contributors, "policy-0")) != 0 {
+		t.Errorf("principal kept after its last pod stopped matching: %v", contributors)
+	}
+
+	if _, ok := idx.Contributors(dap, time.Minute, now.Add(time.Minute)); ok {
+		t.Error("index served after the resync period")
+	}
+	dap.Generation++
+	if _, ok := idx.Contributors(dap, time.Minute, now); ok {
+		t.Error("index served after the spec changed")
+	}
+	idx.Delete(key)
+	if affected := idx.Observe(indexPod("a-3", "app-0", "a")); len(affected) != 0 {
+		t.Errorf("deleted DAP affected by %v", affected)
+	}
+}
+
+func TestPrincipalIndexReplaysChangesDuringSync(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(0, 0)
+	dap := indexDAP(1)
+	idx := NewPrincipalIndex()
+
+	listed := Contributors{}
+	listed.add("policy-0", "cluster.local/ns/index/sa/deleted", types.NamespacedName{Namespace: "index", Name: "deleted"})
+	idx.BeginSync(dap)
+	idx.Observe(indexPod("created", "app-0", "created"))
+	idx.Forget(types.NamespacedName{Namespace: "index", Name: "deleted"})
+	if _, ok := idx.Contributors(dap, time.Minute, now); ok {
+		t.Error("index served while a sync is listing pods")
+	}
+	got := principals(idx.Sync(dap, listed, now), "policy-0")
+	if want := []string{"cluster.local/ns/index/sa/created"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("principals after replay = %v, want %v", got, want)
+	}
+}
+
+// TestPrincipalIndexMatchesRelist applies random pod churn to the index and a fake client and
+// checks the index agrees with a full relist.
+func TestPrincipalIndexMatchesRelist(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	rnd := rand.New(rand.NewSource(1)) // nolint:gosec
+	dap := indexDAP(3)
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).Build()
+	idx := NewPrincipalIndex()
+	idx.BeginSync(dap)
+	idx.Sync(dap, Contributors{}, now)
+
+	for i := 0; i < 500; i++ {
+		pod := indexPod(fmt.Sprintf("pod-%d", rnd.Intn(40)), fmt.Sprintf("app-%d", rnd.Intn(4)),
+			fmt.Sprintf("sa-%d", rnd.Intn(5)))
+		existing := &corev1.Pod{}
+		err := c.Get(ctx, client.ObjectKeyFromObject(pod), existing)
+		switch {
+		case err != nil:
+			if err := c.Create(ctx, pod); err != nil {
+				t.Fatal(err)
+			}
+			idx.Observe(pod)
+		case rnd.Intn(2) == 0:
+			if err := c.Delete(ctx, existing); err != nil {
+				t.Fatal(err)
+			}
+			idx.Forget(client.ObjectKeyFromObject(pod))
+		default:
+			existing.Labels, existing.Spec.ServiceAccountName = pod.Labels, pod.Spec.ServiceAccountName
+			if err := c.Update(ctx, existing); err != nil {
+				t.Fatal(err)
+			}
+			idx.Observe(existing)
+		}
+
+		relisted, err := SelectPods(ctx, c, dap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexed, _ := idx.Contributors(dap, time.Minute, now)
+		for _, policy := range dap.GetPolicies() {
+			for _, principal := range principals(relisted, policy.Name) {
+				if got, want := indexed.Pods(policy.Name, principal), relisted.Pods(policy.Name, principal); !reflect.DeepEqual(got, want) {
+					t.Fatalf("step %d: %s %s indexed pods %v, relisted %v", i, policy.Name, principal, got, want)
+				}
+			}
+			if got, want := principals(indexed, policy.Name), principals(relisted, policy.Name); !reflect.DeepEqual(got, want) {
+				t.Fatalf("step %d: %s indexed %v, relisted %v", i, policy.Name, got, want)
+			}
+		}
+	}
+}
+
+// BenchmarkPrincipalComputation compares computing a DAP's principals after a pod change by
+// relisting pods with updating the principal index.
+func BenchmarkPrincipalComputation(b *testing.B) {
+	const pods, policies = 10000, 20
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	dap := indexDAP(policies)
+	objs := []client.Object{}
+	for i := 0; i < pods; i++ {
+		objs = append(objs, indexPod(fmt.Sprintf("pod-%d", i), fmt.Sprintf("app-%d", i%(policies*5)), fmt.Sprintf("sa-%d", i%100)))
+	}
+	c := fake.NewClientBuilder().WithObjects(objs...).Build()
+
+	b.Run("relist", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			selected, err := SelectPods(ctx, c, dap)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ResolveContributors(dap, nil, selected)
+		}
+	})
+	b.Run("incremental", func(b *testing.B) {
+		idx := NewPrincipalIndex()
+		selected, err := SelectPods(ctx, c, dap)
+		if err != nil {
+			b.Fatal(err)
+		}
+		idx.BeginSync(dap)
+		idx.Sync(dap, selected, now)
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			pod := objs[n%pods].(*corev1.Pod)
+			idx.Observe(pod)
+			indexed, _ := idx.Contributors(dap, time.Hour, now)
+			ResolveContributors(dap, nil, indexed)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	t.Parallel()
+	limiter := NewRateLimiter(RateLimiterOptions{
+		BaseDelay: time.Second,
+		MaxDelay:  4 * time.Second,
+		QPS:       1000,
+		Burst:     1000,
+	})
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if got := limiter.When("item"); got != want {
+			t.Errorf("failure %d: backoff = %v, want %v", i, got, want)
+		}
+	}
+	limiter.Forget("item")
+	if got := limiter.When("item"); got != time.Second {
+		t.Errorf("backoff after forget = %v, want %v", got, time.Second)
+	}
+
+	limiter = NewRateLimiter(RateLimiterOptions{BaseDelay: time.Millisecond, MaxDelay: time.Second, QPS: 1, Burst: 1})
+	limiter.When("a")
+	if got := limiter.When("b"); got < 500*time.Millisecond {
+		t.Errorf("second item beyond burst delayed %v, want about 1s", got)
+	}
+}
+
+// TestReconcileConcurrently runs pod and DAP reconciles for several DAPs in parallel, as the
+// manager does with MaxConcurrentReconciles above one, and checks every DAP converges. Run with
+// -race to detect unsynchronised shared state.
+func TestReconcileConcurrently(t *testing.T) {
+	t.Parallel()
+	const daps, podsPerDAP = 8, 10
+	ctx := context.Background()
+	objs := []client.Object{}
+	for i := 0; i < daps; i++ {
+		objs = append(objs, &peerauthv1.DynamicAuthorizationPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("dap-%d", i), Namespace: "concurrent", Generation: 1},
+			Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+				DynamicPolicies: []peerauthv1.DynamicPolicy{{
+					Name:         fmt.Sprintf("policy-%d", i),
+					TrustDomain:  "cluster.local",
+					PodSelectors: map[string]string{"app": fmt.Sprintf("app-%d", i)},
+				}},
+			},
+		})
+	}
+	// The fake client registers unstructured list kinds on first use without synchronising
+	// readers of the scheme, so register the generated kinds it lacks up front.
+	scheme := testScheme(t)
+	for _, gvk := range append(generatedKinds(), PeerAuthenticationGVK, SidecarGVK) {
+		if scheme.Recognizes(gvk) {
+			continue
+		}
+		scheme.AddKnownTypeWithName(gvk, &unstructured.Unstructured{})
+		scheme.AddKnownTypeWithName(gvk.GroupVersion().WithKind(gvk.Kind+"List"), &unstructured.UnstructuredList{})
+	}
+	c := newApplyClient(fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build())
+	triggers := make(chan event.GenericEvent, daps*podsPerDAP)
+	principals := NewPrincipalIndex()
+	podr := &PodReconciler{Client: c, Scheme: c.Scheme(), Triggers: triggers, Principals: principals}
+	dapr := &DynamicAuthorizationPolicyReconciler{
+		Client:       c,
+		Scheme:       c.Scheme(),
+		Recorder:     record.NewFakeRecorder(10 * daps * podsPerDAP),
+		Principals:   principals,
+		ResyncPeriod: time.Hour,
+	}
+
+	// The workqueue never reconciles the same key concurrently, so each DAP and each pod is
+	// reconciled by a single goroutine while different keys run in parallel.
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*daps*podsPerDAP)
+	for i := 0; i < daps; i++ {
+		for j := 0; j < podsPerDAP; j++ {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      fmt.Sprintf("pod-%d-%d", i, j),
+					Namespace: "concurrent",
+					Labels:    map[string]string{"app": fmt.Sprintf("app-%d", i)},
+				},
+				Spec: corev1.PodSpec{ServiceAccountName: fmt.Sprintf("sa-%d", j)},
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := c.Create(ctx, pod); err != nil {
+					errs <- err
+					return
+				}
+				_, err := podr.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(pod)})
+				errs <- err
+			}()
+		}
+		wg.Add(1)
+		go func(key types.NamespacedName) {
+			defer wg.Done()
+			for j := 0; j < podsPerDAP; j++ {
+				_, err := dapr.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+				errs <- err
+			}
+		}(types.NamespacedName{Namespace: "concurrent", Name: fmt.Sprintf("dap-%d", i)})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < daps; i++ {
+		key := types.NamespacedName{Namespace: "concurrent", Name: fmt.Sprintf("dap-%d", i)}
+		if _, err := dapr.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+			t.Fatal(err)
+		}
+		got := &peerauthv1.DynamicAuthorizationPolicy{}
+		if err := c.Get(ctx, key, got); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(got.Status.ServiceAccountPolicyMapping[fmt.Sprintf("policy-%d", i)]); n != podsPerDAP {
+			t.Errorf("%s has %d principals, want %d", key, n, podsPerDAP)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// managerServiceAccount is the identity the envtest manager runs as.
+var managerServiceAccount = rbacv1.Subject{ // nolint:gochecknoglobals
+	Kind:      rbacv1.ServiceAccountKind,
+	Name:      "controller-manager",
+	Namespace: "system",
+}
+
+// grantManagerRole creates the generated manager ClusterRole, binds it to managerServiceAccount
+// and returns a copy of cfg impersonating it, so the envtest manager holds exactly the
+// permissions a deployed controller does.
+func grantManagerRole(ctx context.Context, c client.Client, cfg *rest.Config) (*rest.Config, error) {
+	data, err := os.ReadFile(filepath.Join("..", "config", "rbac", "role.yaml"))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read the manager ClusterRole")
+	}
+	role := &rbacv1.ClusterRole{}
+	if err := yaml.Unmarshal(data, role); err != nil {
+		return nil, errors.Wrap(err, "unable to parse the manager ClusterRole")
+	}
+	binding := &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: role.GetName()},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: role.GetName()},
+		Subjects:   []rbacv1.Subject{managerServiceAccount},
+	}
+	for _, obj := range []client.Object{role, binding} {
+		if err := c.Create(ctx, obj); err != nil && !kerrors.IsAlreadyExists(err) {
+			return nil, errors.Wrapf(err, "unable to create %s", obj.GetName())
+		}
+	}
+
+	impersonated := rest.CopyConfig(cfg)
+	impersonated.Impersonate = rest.ImpersonationConfig{
+		UserName: "system:serviceaccount:" + managerServiceAccount.Namespace + ":" + managerServiceAccount.Name,
+	}
+	return impersonated, nil
+}
+
+var _ = Describe("Manager RBAC", func() {
+	It("runs the manager with only the generated ClusterRole", func() {
+		if useFakeClient {
+			Skip("RBAC is only enforced by a real API server")
+		}
+		c, err := client.New(managerConfig, client.Options{Scheme: scheme.Scheme})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(c.List(ctx, &corev1.PodList{})).To(Succeed())
+		err = c.List(ctx, &corev1.SecretList{})
+		Expect(kerrors.IsForbidden(err)).To(BeTrue(), "the manager is not impersonating its service account: %v", err)
+	})
+})
@@ -0,0 +1,158 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// podSelectorIndex indexes DAPs by one anchor requirement of each policy's selector. Every
+// pod a policy selects satisfies its anchor, so looking up a pod's labels returns a superset
+// of the DAPs selecting it, which matchingDAPs narrows by evaluating the full selectors.
+const podSelectorIndex = ".spec.podSelector"
+
+// anyPodKey indexes policies without a requirement a pod label must satisfy, such as empty
+// selectors or selectors made only of NotIn and DoesNotExist requirements.
+const anyPodKey = "*"
+
+// indexKey indexes policies requiring label key to equal val.
+func indexKey(key, val string) string {
+	return fmt.Sprintf("%s=%s", key, val)
+}
+
+// existsKey indexes policies requiring label key to be present. Label keys cannot contain
+// "=", so these never collide with indexKey.
+func existsKey(key string) string {
+	return key
+}
+
+// anchorKeys returns the index keys of the most selective requirement of the policy's selector.
+// Invalid selectors select nothing and are not indexed.
+func anchorKeys(policy peerauthv1.DynamicPolicy) []string {
+	selector, err := policy.Selector()
+	if err != nil {
+		return nil
+	}
+	reqs, _ := selector.Requirements()
+	var in, exists *labels.Requirement
+	for i := range reqs {
+		req := &reqs[i]
+		switch req.Operator() {
+		case selection.Equals, selection.DoubleEquals:
+			return []string{indexKey(req.Key(), req.Values().List()[0])}
+		case selection.In:
+			if in == nil || req.Values().Len() < in.Values().Len() {
+				in = req
+			}
+		case selection.Exists, selection.GreaterThan, selection.LessThan:
+			if exists == nil {
+				exists = req
+			}
+		case selection.NotIn, selection.NotEquals, selection.DoesNotExist:
+		}
+	}
+	switch {
+	case in != nil:
+		keys := []string{}
+		for _, val := range in.Values().List() {
+			keys = append(keys, indexKey(in.Key(), val))
+		}
+		return keys
+	case exists != nil:
+		return []string{existsKey(exists.Key())}
+	default:
+		return []string{anyPodKey}
+	}
+}
+
+// podSelectorIndexKeys returns the podSelectorIndex keys of every policy of the DAP.
+func podSelectorIndexKeys(dap *peerauthv1.DynamicAuthorizationPolicy) []string {
+	keys := map[string]bool{}
+	for _, policy := range dap.GetPolicies() {
+		for _, key := range anchorKeys(policy) {
+			keys[key] = true
+		}
+	}
+	out := make([]string, 0, len(keys))
+	for key := range keys {
+		out = append(out, key)
+	}
+	return out
+}
+
+// podIndexKeys returns the podSelectorIndex keys under which DAPs selecting pod may be indexed.
+func podIndexKeys(pod *corev1.Pod) []string {
+	keys := []string{anyPodKey}
+	for key, val := range pod.GetLabels() {
+		keys = append(keys, indexKey(key, val), existsKey(key))
+	}
+	return keys
+}
+
+// selects reports whether policy selects pod, matching DynamicPolicy.ListPods.
+func selects(policy peerauthv1.DynamicPolicy, pod *corev1.Pod) bool {
+	selector, err := policy.Selector()
+	if err != nil || !selector.Matches(labels.Set(pod.GetLabels())) {
+		return false
+	}
+	if len(policy.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range policy.Namespaces {
+		if ns == pod.GetNamespace() {
+			return true
+		}
+	}
+	return false
+}
+
+// dapSelects reports whether any of the DAP's policies selects pod.
+func dapSelects(dap *peerauthv1.DynamicAuthorizationPolicy, pod *corev1.Pod) bool {
+	for _, policy := range dap.GetPolicies() {
+		if selects(policy, pod) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchingDAPs returns the DAPs with a policy selecting pod.
+func matchingDAPs(ctx context.Context, c client.Reader, pod *corev1.Pod) ([]types.NamespacedName, error) {
+	matched := map[types.NamespacedName]bool{}
+	for _, key := range podIndexKeys(pod) {
+		daps := peerauthv1.DynamicAuthorizationPolicyList{}
+		if err := c.List(ctx, &daps, client.MatchingFields{podSelectorIndex: key}); err != nil {
+			return nil, errors.Wrapf(err, "unable to list DAPs indexed by %s", key)
+		}
+		for i := range daps.Items {
+			dap := &daps.Items[i]
+			if key := client.ObjectKeyFromObject(dap); !matched[key] && dapSelects(dap, pod) {
+				matched[key] = true
+			}
+		}
+	}
+	return sortedKeys(matched), nil
+}
@@ -0,0 +1,311 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// indexedReader lists DAPs by podSelectorIndex the way the manager's cache does.
+type indexedReader []peerauthv1.DynamicAuthorizationPolicy
+
+func (r indexedReader) Get(context.Context, client.ObjectKey, client.Object) error {
+	return errors.New("not implemented")
+}
+
+func (r indexedReader) List(_ context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	_, key, ok := requiresExactMatch(listOpts.FieldSelector)
+	if !ok {
+		return errors.New("expected a single exact field match")
+	}
+	daps := list.(*peerauthv1.DynamicAuthorizationPolicyList)
+	for i := range r {
+		for _, indexed := range podSelectorIndexKeys(&r[i]) {
+			if indexed == key {
+				daps.Items = append(daps.Items, r[i])
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func TestSelectorIndex(t *testing.T) {
+	t.Parallel()
+	expr := func(key string, op metav1.LabelSelectorOperator, values ...string) metav1.LabelSelectorRequirement {
+		return metav1.LabelSelectorRequirement{Key: key, Operator: op, Values: values}
+	}
+	tests := map[string]struct {
+		policy peerauthv1.DynamicPolicy
+		labels map[string]string
+		want   bool
+	}{
+		"multi-label selector, all labels match": {
+			policy: peerauthv1.DynamicPolicy{PodSelectors: map[string]string{"app": "a", "tier": "web"}},
+			labels: map[string]string{"app": "a", "tier": "web", "extra": "x"},
+			want:   true,
+		},
+		"multi-label selector, one label matches": {
+			policy: peerauthv1.DynamicPolicy{PodSelectors: map[string]string{"app": "a", "tier": "web"}},
+			labels: map[string]string{"app": "a"},
+		},
+		"multi-label selector, other label matches": {
+			policy: peerauthv1.DynamicPolicy{PodSelectors: map[string]string{"app": "a", "tier": "web"}},
+			labels: map[string]string{"tier": "web", "app": "b"},
+		},
+		"In matches any value": {
+			policy: peerauthv1.DynamicPolicy{PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+				expr("app", metav1.LabelSelectorOpIn, "a", "b"),
+			}},
+			labels: map[string]string{"app": "b"},
+			want:   true,
+		},
+		"In with no matching value": {
+			policy: peerauthv1.DynamicPolicy{PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+				expr("app", metav1.LabelSelectorOpIn, "a", "b"),
+			}},
+			labels: map[string]string{"app": "c"},
+		},
+		"Exists": {
+			policy: peerauthv1.DynamicPolicy{PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+				expr("canary", metav1.LabelSelectorOpExists),
+			}},
+			labels: map[string]string{"canary": "true"},
+			want:   true,
+		},
+		"Exists with label missing": {
+			policy: peerauthv1.DynamicPolicy{PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+				expr("canary", metav1.LabelSelectorOpExists),
+			}},
+			labels: map[string]string{"app": "a"},
+		},
+		"NotIn only matches pods without the label": {
+			policy: peerauthv1.DynamicPolicy{PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+				expr("env", metav1.LabelSelectorOpNotIn, "prod"),
+			}},
+			labels: map[string]string{"app": "a"},
+			want:   true,
+		},
+		"NotIn excluded value": {
+			policy: peerauthv1.DynamicPolicy{PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+				expr("env", metav1.LabelSelectorOpNotIn, "prod"),
+			}},
+			labels: map[string]string{"env": "prod"},
+		},
+		"DoesNotExist matches unlabelled pods": {
+			policy: peerauthv1.DynamicPolicy{PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+				expr("legacy", metav1.LabelSelectorOpDoesNotExist),
+			}},
+			labels: nil,
+			want:   true,
+		},
+		"labels and expressions": {
+			policy: peerauthv1.DynamicPolicy{
+				PodSelectors: map[string]string{"app": "a"},
+				PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+					expr("version", metav1.LabelSelectorOpIn, "v1", "v2"),
+				},
+			},
+			labels: map[string]string{"app": "a", "version": "v2"},
+			want:   true,
+		},
+		"labels match but expression does not": {
+			policy: peerauthv1.DynamicPolicy{
+				PodSelectors: map[string]string{"app": "a"},
+				PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+					expr("version", metav1.LabelSelectorOpIn, "v1", "v2"),
+				},
+			},
+			labels: map[string]string{"app": "a", "version": "v3"},
+		},
+		"empty selector matches every pod": {
+			policy: peerauthv1.DynamicPolicy{},
+			labels: map[string]string{"app": "a"},
+			want:   true,
+		},
+		"namespace outside the policy's namespaces": {
+			policy: peerauthv1.DynamicPolicy{PodSelectors: map[string]string{"app": "a"}, Namespaces: []string{"other"}},
+			labels: map[string]string{"app": "a"},
+		},
+		"invalid selector matches nothing": {
+			policy: peerauthv1.DynamicPolicy{PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+				expr("app", metav1.LabelSelectorOpIn),
+			}},
+			labels: map[string]string{"app": "a"},
+		},
+	}
+	for name, tt := range tests {
+		tt.policy.Name = "policy"
+		dap := peerauthv1.DynamicAuthorizationPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "default"},
+			Spec:       peerauthv1.DynamicAuthorizationPolicySpec{DynamicPolicies: []peerauthv1.DynamicPolicy{tt.policy}},
+		}
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", Labels: tt.labels}}
+
+		matched, err := matchingDAPs(context.Background(), indexedReader{dap}, pod)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		switch {
+		case tt.want && len(matched) == 0:
+			t.Errorf("%s: false negative, index keys %v, pod keys %v", name, podSelectorIndexKeys(&dap), podIndexKeys(pod))
+		case !tt.want && len(matched) != 0:
+			t.Errorf("%s: false positive", name)
+		}
+	}
+}
+
+func TestAnchorKeys(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		policy peerauthv1.DynamicPolicy
+		want   []string
+	}{
+		"equality preferred over In": {
+			policy: peerauthv1.DynamicPolicy{
+				PodSelectors: map[string]string{"tier": "web"},
+				PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"a", "b"}},
+				},
+			},
+			want: []string{"tier=web"},
+		},
+		"In indexes each value": {
+			policy: peerauthv1.DynamicPolicy{PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"b", "a"}},
+			}},
+			want: []string{"app=a", "app=b"},
+		},
+		"Exists indexes the key": {
+			policy: peerauthv1.DynamicPolicy{PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "canary", Operator: metav1.LabelSelectorOpExists},
+			}},
+			want: []string{"canary"},
+		},
+		"only negative requirements": {
+			policy: peerauthv1.DynamicPolicy{PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "env", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"prod"}},
+			}},
+			want: []string{anyPodKey},
+		},
+	}
+	for name, tt := range tests {
+		got := anchorKeys(tt.policy)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: anchorKeys = %v, want %v", name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: anchorKeys = %v, want %v", name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestPodReconcilerTriggersPreviousSelectors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "relabel"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name: "policy", TrustDomain: "cluster.local", PodSelectors: map[string]string{"app": "api"},
+			}},
+		},
+	}
+	old := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "api-1", Namespace: "relabel", Labels: map[string]string{"app": "api"}}}
+	relabelled := old.DeepCopy()
+	relabelled.Labels = map[string]string{"app": "web"}
+
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(dap, relabelled).Build()
+	triggers := make(chan event.GenericEvent, 10)
+	r := &PodReconciler{Client: c, Scheme: c.Scheme(), Triggers: triggers}
+	remember := r.rememberPrevious()
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(old)}
+
+	triggered := func(step string) []types.NamespacedName {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		var keys []types.NamespacedName
+		for len(triggers) > 0 {
+			keys = append(keys, client.ObjectKeyFromObject((<-triggers).Object))
+		}
+		return keys
+	}
+	want := []types.NamespacedName{client.ObjectKeyFromObject(dap)}
+
+	remember.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: relabelled})
+	if got := triggered("relabel"); !reflect.DeepEqual(got, want) {
+		t.Errorf("relabel triggered %v, want %v", got, want)
+	}
+	if got := triggered("resync"); len(got) != 0 {
+		t.Errorf("resync after relabel triggered %v, want nothing", got)
+	}
+
+	if err := c.Delete(ctx, relabelled); err != nil {
+		t.Fatal(err)
+	}
+	remember.Delete(event.DeleteEvent{Object: old})
+	if got := triggered("delete"); !reflect.DeepEqual(got, want) {
+		t.Errorf("delete triggered %v, want %v", got, want)
+	}
+}
+
+func TestSetupWithManager(t *testing.T) {
+	t.Parallel()
+	// Registering controllers needs no API server, only the scheme's kinds.
+	scheme := testScheme(t)
+	mapper := meta.NewDefaultRESTMapper(nil)
+	for gvk := range scheme.AllKnownTypes() {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+	mgr, err := ctrl.NewManager(&rest.Config{Host: "http://127.0.0.1:0"}, ctrl.Options{
+		Scheme:             scheme,
+		MetricsBindAddress: "0",
+		MapperProvider:     func(*rest.Config) (meta.RESTMapper, error) { return mapper, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &PodReconciler{Client: mgr.GetClient(), Scheme: mgr.GetScheme()}
+	if err := r.SetupWithManager(mgr); err != nil {
+		t.Errorf("pod controller not registered: %v", err)
+	}
+	dapReconciler := &DynamicAuthorizationPolicyReconciler{Client: mgr.GetClient(), Scheme: mgr.GetScheme()}
+	if err := dapReconciler.SetupWithManager(mgr); err != nil {
+		t.Errorf("DAP controller not registered: %v", err)
+	}
+}
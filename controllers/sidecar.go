@@ -0,0 +1,470 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// sidecarEgressLabel is set on the Sidecars generated for callers. A caller workload's Sidecar
+// is shared by every DAP granting it egress, so it carries no dapLabel.
+const sidecarEgressLabel = "peerauth.aweis.io/sidecar-egress"
+
+// sidecarGrantsAnnotation lists, comma-separated and sorted, the namespace/name of the DAPs
+// granting egress through a generated Sidecar.
+const sidecarGrantsAnnotation = "peerauth.aweis.io/granted-by"
+
+// clusterDomain is the DNS domain of the Service hosts in generated Sidecars.
+const clusterDomain = "cluster.local"
+
+// defaultMeshNamespace is the namespace generated Sidecars keep egress to when no mesh
+// namespaces are configured, Istio's default control plane and root namespace.
+const defaultMeshNamespace = "istio-system"
+
+// SidecarGVK is the Istio Sidecar kind generated for a DAP's callers when it sets
+// spec.sidecarEgress.
+var SidecarGVK = schema.GroupVersionKind{ // nolint:gochecknoglobals
+	Group:   "networking.istio.io",
+	Version: "v1beta1",
+	Kind:    "Sidecar",
+}
+
+// sidecarWorkload identifies the callers a Sidecar is generated for.
+type sidecarWorkload struct {
+	namespace, selector string
+}
+
+// key returns the key of the workload's Sidecar, named after its selector.
+func (w sidecarWorkload) key() client.ObjectKey {
+	sum := sha256.Sum256([]byte(w.selector))
+	return client.ObjectKey{Namespace: w.namespace, Name: "dap-egress-" + hex.EncodeToString(sum[:])[:10]}
+}
+
+// sidecarGrant holds the egress hosts granted to a caller workload and the DAPs granting them.
+type sidecarGrant struct {
+	selector labels.Set
+	hosts    map[string]bool
+	daps     map[string]bool
+}
+
+// sidecarGrants collects the egress granted to caller workloads by one or more DAPs.
+type sidecarGrants map[sidecarWorkload]*sidecarGrant
+
+// add records the egress the DAP grants the callers of its policies' principals in sapm, in the
+// namespaces the tenancy policy lets it select pods from.
+func (g sidecarGrants) add(dap *peerauthv1.DynamicAuthorizationPolicy, sapm peerauthv1.ServiceAccountPolicyMapping,
+	services []corev1.Service, tenancy *TenancyPolicy) {
+	if dap.Spec.SidecarEgress == nil || !dap.HasBackend(peerauthv1.BackendIstio) {
+		return
+	}
+	for _, policy := range dap.GetPolicies() {
+		if len(policy.PodSelectors) == 0 || len(policy.PodSelectorExpressions) > 0 {
+			continue
+		}
+		for _, namespace := range principalNamespaces(sapm[policy.Name]) {
+			if !tenancy.Allows(dap.GetNamespace(), namespace) {
+				continue
+			}
+			w := sidecarWorkload{namespace: namespace, selector: policy.PodSelectors.String()}
+			grant, ok := g[w]
+			if !ok {
+				grant = &sidecarGrant{selector: policy.PodSelectors, hosts: map[string]bool{}, daps: map[string]bool{}}
+				g[w] = grant
+			}
+			grant.daps[client.ObjectKeyFromObject(dap).String()] = true
+			for _, host := range protectedHosts(dap.GetNamespace(), policy.WorkloadSelector, services) {
+				grant.hosts[host] = true
+			}
+			for _, host := range dap.Spec.SidecarEgress.Hosts {
+				grant.hosts[host] = true
+			}
+		}
+	}
+}
+
+// workloads returns the workloads granted egress, sorted by namespace and selector.
+func (g sidecarGrants) workloads() []sidecarWorkload {
+	workloads := map[sidecarWorkload]bool{}
+	for w := range g {
+		workloads[w] = true
+	}
+	return sortedWorkloads(workloads)
+}
+
+// sidecar builds the Sidecar of a granted workload. Besides the granted hosts, the callers keep
+// reaching their own namespace and the defaults, the hosts of their namespace-wide Sidecar.
+func (g sidecarGrants) sidecar(w sidecarWorkload, defaults []string) *unstructured.Unstructured {
+	grant := g[w]
+	hosts := map[string]bool{"./*": true}
+	for host := range grant.hosts {
+		hosts[host] = true
+	}
+	for _, host := range defaults {
+		hosts[host] = true
+	}
+	egressHosts := []interface{}{}
+	for _, host := range sortedStrings(hosts) {
+		egressHosts = append(egressHosts, host)
+	}
+	workloadLabels := map[string]interface{}{}
+	for k, v := range grant.selector {
+		workloadLabels[k] = v
+	}
+
+	sidecar := &unstructured.Unstructured{}
+	sidecar.SetGroupVersionKind(SidecarGVK)
+	key := w.key()
+	sidecar.SetName(key.Name)
+	sidecar.SetNamespace(key.Namespace)
+	sidecar.SetLabels(map[string]string{sidecarEgressLabel: "true"})
+	sidecar.SetAnnotations(map[string]string{sidecarGrantsAnnotation: strings.Join(sortedStrings(grant.daps), ",")})
+	sidecar.Object["spec"] = map[string]interface{}{
+		"workloadSelector": map[string]interface{}{"labels": workloadLabels},
+		"egress":           []interface{}{map[string]interface{}{"hosts": egressHosts}},
+	}
+	return sidecar
+}
+
+// Sidecars builds, for each namespace with principals granted by the DAP's policies, a Sidecar
+// limiting the callers' egress to their own namespace, istio-system and the hosts of the
+// protected services, as if no other DAP granted them egress. Policies selecting callers with the same PodSelectors
+// share a Sidecar.
+func Sidecars(dap *peerauthv1.DynamicAuthorizationPolicy, sapm peerauthv1.ServiceAccountPolicyMapping,
+	services []corev1.Service) []*unstructured.Unstructured {
+	grants := sidecarGrants{}
+	grants.add(dap, sapm, services, nil)
+	sidecars := []*unstructured.Unstructured{}
+	for _, w := range grants.workloads() {
+		sidecars = append(sidecars, grants.sidecar(w, meshHosts(nil)))
+	}
+	return sidecars
+}
+
+// meshHosts returns the egress hosts of the mesh namespaces, defaulting to istio-system.
+func meshHosts(namespaces []string) []string {
+	if len(namespaces) == 0 {
+		namespaces = []string{defaultMeshNamespace}
+	}
+	hosts := []string{}
+	for _, namespace := range namespaces {
+		hosts = append(hosts, namespace+"/*")
+	}
+	return hosts
+}
+
+// protectedHosts returns the hosts of the Services in namespace whose selectors select the
+// workloads matching workloadSelector, or every host in the namespace when it is empty.
+func protectedHosts(namespace string, workloadSelector labels.Set, services []corev1.Service) []string {
+	if len(workloadSelector) == 0 {
+		return []string{namespace + "/*"}
+	}
+	hosts := []string{}
+	for _, svc := range services {
+		if svc.GetNamespace() != namespace || len(svc.Spec.Selector) == 0 ||
+			!labels.SelectorFromSet(svc.Spec.Selector).Matches(workloadSelector) {
+			continue
+		}
+		hosts = append(hosts, fmt.Sprintf("%s/%s.%s.svc.%s", namespace, svc.GetName(), namespace, clusterDomain))
+	}
+	return hosts
+}
+
+// principalNamespaces returns the sorted namespaces of the service accounts in principals.
+func principalNamespaces(principals peerauthv1.HashSet) []string {
+	namespaces := map[string]bool{}
+	for _, principal := range principals.Slice() {
+		parts := strings.Split(principal, "/")
+		if len(parts) >= 5 && parts[len(parts)-4] == "ns" {
+			namespaces[parts[len(parts)-3]] = true
+		}
+	}
+	return sortedStrings(namespaces)
+}
+
+func sortedStrings(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sidecarGrantedBy returns the DAPs a generated Sidecar grants egress for.
+func sidecarGrantedBy(sidecar client.Object) []string {
+	granted := sidecar.GetAnnotations()[sidecarGrantsAnnotation]
+	if granted == "" {
+		return nil
+	}
+	return strings.Split(granted, ",")
+}
+
+// grantsEgressFor reports whether a generated Sidecar grants egress for the DAP with key.
+func grantsEgressFor(sidecar client.Object, key string) bool {
+	for _, granted := range sidecarGrantedBy(sidecar) {
+		if granted == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sidecarSelector returns the workload labels a Sidecar selects, empty for namespace-wide ones.
+func sidecarSelector(sidecar *unstructured.Unstructured) labels.Set {
+	selector, _, _ := unstructured.NestedStringMap(sidecar.Object, "spec", "workloadSelector", "labels")
+	return selector
+}
+
+// sidecarHosts returns the egress hosts of every egress listener of a Sidecar.
+func sidecarHosts(sidecar *unstructured.Unstructured) []string {
+	hosts := []string{}
+	egress, _, _ := unstructured.NestedSlice(sidecar.Object, "spec", "egress")
+	for _, listener := range egress {
+		listener, ok := listener.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		listenerHosts, _, _ := unstructured.NestedStringSlice(listener, "hosts")
+		hosts = append(hosts, listenerHosts...)
+	}
+	return hosts
+}
+
+//+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+//+kubebuilder:rbac:groups=networking.istio.io,resources=sidecars,verbs=get;list;watch;create;update;patch;delete
+
+// planSidecars returns the writes reconciling the Sidecars of the callers the DAP grants egress,
+// or granted it before, with the egress every DAP grants them, and the Sidecars that keep
+// Sidecars from being generated for the DAP's callers: user-authored ones and those generated
+// for other DAPs' callers. A deleted DAP, or any DAP while SidecarEgress is off, grants none.
+func (r *DynamicAuthorizationPolicyReconciler) planSidecars(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy, tenancy *TenancyPolicy, sapm peerauthv1.ServiceAccountPolicyMapping,
+) ([]authorizationPolicyChange, []string, error) {
+	key := client.ObjectKeyFromObject(dap).String()
+	grants := sidecarGrants{}
+	if dap.GetDeletionTimestamp().IsZero() && r.SidecarEgress {
+		if err := r.addSidecarGrants(ctx, grants, dap, sapm, tenancy); err != nil {
+			return nil, nil, err
+		}
+	}
+	// Only a DAP that set sidecarEgress, as recorded by its condition, can have Sidecars to
+	// remove, so others do not list a kind that may not be installed.
+	if len(grants) == 0 && meta.FindStatusCondition(dap.Status.Conditions, peerauthv1.ConditionSidecarEgress) == nil {
+		return nil, nil, nil
+	}
+	previous, err := r.generatedSidecars(ctx, dap)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(grants) == 0 && len(previous) == 0 {
+		return nil, nil, nil
+	}
+
+	workloads := map[sidecarWorkload]bool{}
+	for w := range grants {
+		workloads[w] = true
+	}
+	for i := range previous {
+		workloads[sidecarWorkload{namespace: previous[i].GetNamespace(), selector: sidecarSelector(&previous[i]).String()}] = true
+	}
+	// Other DAPs granting the same callers egress keep their hosts in the shared Sidecars.
+	daps := &peerauthv1.DynamicAuthorizationPolicyList{}
+	if err := r.List(ctx, daps); err != nil {
+		return nil, nil, errors.Wrap(err, "unable to list DynamicAuthorizationPolicies")
+	}
+	for i := range daps.Items {
+		other := &daps.Items[i]
+		if client.ObjectKeyFromObject(other).String() == key || !other.GetDeletionTimestamp().IsZero() || other.IsDryRun() ||
+			!r.SidecarEgress {
+			continue
+		}
+		if err := r.addSidecarGrants(ctx, grants, other, other.Status.ServiceAccountPolicyMapping, tenancy); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	changes, conflicts := []authorizationPolicyChange{}, []string{}
+	inNamespace := map[string][]unstructured.Unstructured{}
+	for _, w := range sortedWorkloads(workloads) {
+		if _, ok := inNamespace[w.namespace]; !ok {
+			if inNamespace[w.namespace], err = r.listSidecars(ctx, w.namespace, nil); err != nil {
+				return nil, nil, err
+			}
+		}
+		var existing *unstructured.Unstructured
+		defaults, overlapping := meshHosts(r.MeshNamespaces), []string{}
+		for i := range inNamespace[w.namespace] {
+			sidecar := &inNamespace[w.namespace][i]
+			selector := sidecarSelector(sidecar)
+			switch {
+			case sidecar.GetName() == w.key().Name:
+				existing = sidecar
+				if sidecar.GetLabels()[sidecarEgressLabel] == "" {
+					overlapping = append(overlapping, client.ObjectKeyFromObject(sidecar).String())
+				}
+			case sidecar.GetLabels()[sidecarEgressLabel] != "" && grantsEgressFor(sidecar, key):
+				// Sidecars generated for the DAP's other callers are reconciled along with these.
+			case len(selector) == 0:
+				defaults = append(defaults, sidecarHosts(sidecar)...)
+			case grants[w] != nil && !labels.Conflicts(selector, grants[w].selector):
+				overlapping = append(overlapping, client.ObjectKeyFromObject(sidecar).String())
+			}
+		}
+		grant := grants[w]
+		if grant != nil && grant.daps[key] {
+			conflicts = append(conflicts, overlapping...)
+		}
+		if existing != nil && existing.GetLabels()[sidecarEgressLabel] == "" {
+			continue
+		}
+
+		var desired *unstructured.Unstructured
+		if grant != nil && len(overlapping) == 0 {
+			desired = grants.sidecar(w, defaults)
+		}
+		switch {
+		case desired == nil && existing != nil:
+			changes = append(changes, authorizationPolicyChange{action: peerauthv1.ChangeDelete, existing: existing})
+		case desired == nil:
+		case existing == nil:
+			changes = append(changes, authorizationPolicyChange{action: peerauthv1.ChangeCreate, desired: desired})
+		case generatedFieldsDiffer(existing, desired):
+			diff := drift(existing, desired)
+			changes = append(changes, authorizationPolicyChange{
+				action: peerauthv1.ChangeUpdate, desired: desired, existing: existing, drifted: diff != "", drift: diff,
+			})
+		}
+	}
+	return changes, conflicts, nil
+}
+
+// addSidecarGrants adds the egress the DAP grants its callers to grants.
+func (r *DynamicAuthorizationPolicyReconciler) addSidecarGrants(ctx context.Context, grants sidecarGrants,
+	dap *peerauthv1.DynamicAuthorizationPolicy, sapm peerauthv1.ServiceAccountPolicyMapping, tenancy *TenancyPolicy) error {
+	if dap.Spec.SidecarEgress == nil || !dap.HasBackend(peerauthv1.BackendIstio) {
+		return nil
+	}
+	services := &corev1.ServiceList{}
+	if err := r.List(ctx, services, client.InNamespace(dap.GetNamespace())); err != nil {
+		return errors.Wrapf(err, "unable to list Services protected by DynamicAuthorizationPolicy %s",
+			client.ObjectKeyFromObject(dap))
+	}
+	grants.add(dap, sapm, services.Items, tenancy)
+	return nil
+}
+
+func sortedWorkloads(workloads map[sidecarWorkload]bool) []sidecarWorkload {
+	sorted := make([]sidecarWorkload, 0, len(workloads))
+	for w := range workloads {
+		sorted = append(sorted, w)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].namespace != sorted[j].namespace {
+			return sorted[i].namespace < sorted[j].namespace
+		}
+		return sorted[i].selector < sorted[j].selector
+	})
+	return sorted
+}
+
+// listSidecars lists the Sidecars in namespace matching labels. A cluster without Istio has none.
+func (r *DynamicAuthorizationPolicyReconciler) listSidecars(ctx context.Context, namespace string,
+	matching client.MatchingLabels) ([]unstructured.Unstructured, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(SidecarGVK.GroupVersion().WithKind(SidecarGVK.Kind + "List"))
+	err := r.List(ctx, list, client.InNamespace(namespace), matching)
+	if meta.IsNoMatchError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list Sidecars")
+	}
+	return list.Items, nil
+}
+
+// generatedSidecars lists the generated Sidecars granting egress for the DAP. They are listed
+// per watched namespace when the controller is restricted to namespaces, as it may not list
+// cluster-wide.
+func (r *DynamicAuthorizationPolicyReconciler) generatedSidecars(ctx context.Context,
+	dap *peerauthv1.DynamicAuthorizationPolicy) ([]unstructured.Unstructured, error) {
+	namespaces := r.WatchNamespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	key := client.ObjectKeyFromObject(dap).String()
+	sidecars := []unstructured.Unstructured{}
+	for _, namespace := range namespaces {
+		generated, err := r.listSidecars(ctx, namespace, client.MatchingLabels{sidecarEgressLabel: "true"})
+		if err != nil {
+			return nil, err
+		}
+		for i := range generated {
+			if grantsEgressFor(&generated[i], key) {
+				sidecars = append(sidecars, generated[i])
+			}
+		}
+	}
+	return sidecars, nil
+}
+
+// recordSidecarOverlaps sets the SidecarEgress condition when the DAP grants egress, emitting a
+// warning Event when Sidecars overlapping its callers' appear or change.
+func (r *DynamicAuthorizationPolicyReconciler) recordSidecarOverlaps(dap *peerauthv1.DynamicAuthorizationPolicy,
+	overlapping []string) {
+	if dap.Spec.SidecarEgress == nil || !dap.HasBackend(peerauthv1.BackendIstio) {
+		meta.RemoveStatusCondition(&dap.Status.Conditions, peerauthv1.ConditionSidecarEgress)
+		return
+	}
+	condition := metav1.Condition{
+		Type:               peerauthv1.ConditionSidecarEgress,
+		Status:             metav1.ConditionTrue,
+		Reason:             reasonSidecarEgress,
+		Message:            "no other Sidecar selects callers granted egress",
+		ObservedGeneration: dap.GetGeneration(),
+	}
+	switch {
+	case !r.SidecarEgress:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = reasonSidecarEgressDisabled
+		condition.Message = "Sidecars are not generated unless the controller's SidecarEgress feature gate is enabled"
+	case len(overlapping) > 0:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = reasonSidecarOverlap
+		condition.Message = fmt.Sprintf("Sidecars %s select callers granted egress, which get no generated Sidecar",
+			strings.Join(overlapping, ", "))
+		if previous := meta.FindStatusCondition(dap.Status.Conditions, condition.Type); previous == nil ||
+			previous.Message != condition.Message {
+			r.Recorder.Event(dap, corev1.EventTypeWarning, reasonSidecarOverlap, condition.Message)
+		}
+	}
+	meta.SetStatusCondition(&dap.Status.Conditions, condition)
+}
@@ -0,0 +1,387 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func service(name string, selector map[string]string) corev1.Service {
+	return corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "server"},
+		Spec:       corev1.ServiceSpec{Selector: selector},
+	}
+}
+
+func TestSidecars(t *testing.T) {
+	t.Parallel()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{
+				{Name: "api", PodSelectors: map[string]string{"app": "caller"}, WorkloadSelector: map[string]string{"app": "api"}},
+				{Name: "web", PodSelectors: map[string]string{"app": "caller"}, WorkloadSelector: map[string]string{"app": "web"}},
+				{Name: "all", PodSelectors: map[string]string{"app": "batch"}},
+				{Name: "expr", PodSelectors: map[string]string{"app": "caller"}, PodSelectorExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "tier", Operator: metav1.LabelSelectorOpExists},
+				}},
+				{Name: "everyone"},
+			},
+		},
+	}
+	sapm := peerauthv1.ServiceAccountPolicyMapping{
+		"api":      peerauthv1.HashSet{"cluster.local/ns/a/sa/caller": true, "cluster.local/ns/b/sa/caller": true},
+		"web":      peerauthv1.HashSet{"cluster.local/ns/a/sa/caller": true},
+		"all":      peerauthv1.HashSet{"cluster.local/ns/a/sa/batch": true},
+		"expr":     peerauthv1.HashSet{"cluster.local/ns/a/sa/caller": true},
+		"everyone": peerauthv1.HashSet{"cluster.local/ns/a/sa/caller": true},
+	}
+	services := []corev1.Service{
+		service("api", map[string]string{"app": "api"}),
+		service("web", map[string]string{"app": "web"}),
+		service("headless", nil),
+	}
+	if sidecars := Sidecars(dap, sapm, services); len(sidecars) != 0 {
+		t.Fatalf("Sidecars without spec.sidecarEgress = %v, want none", sidecars)
+	}
+
+	dap.Spec.SidecarEgress = &peerauthv1.SidecarEgress{Hosts: []string{"istio-system/*"}}
+	got := map[string]interface{}{}
+	for _, sidecar := range Sidecars(dap, sapm, services) {
+		if sidecar.GetLabels()[sidecarEgressLabel] != "true" || sidecar.GetAnnotations()[sidecarGrantsAnnotation] != "server/dap" {
+			t.Errorf("Sidecar %s labels = %v, annotations = %v", client.ObjectKeyFromObject(sidecar),
+				sidecar.GetLabels(), sidecar.GetAnnotations())
+		}
+		egress, _, _ := unstructured.NestedSlice(sidecar.Object, "spec", "egress")
+		got[client.ObjectKeyFromObject(sidecar).String()] = egress[0].(map[string]interface{})["hosts"]
+	}
+	caller := func(namespace, app string) string {
+		return sidecarWorkload{namespace: namespace, selector: "app=" + app}.key().String()
+	}
+	want := map[string]interface{}{
+		caller("a", "caller"): []interface{}{"./*", "istio-system/*", "server/api.server.svc.cluster.local", "server/web.server.svc.cluster.local"},
+		caller("b", "caller"): []interface{}{"./*", "istio-system/*", "server/api.server.svc.cluster.local"},
+		caller("a", "batch"):  []interface{}{"./*", "istio-system/*", "server/*"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Sidecar egress hosts = %v, want %v", got, want)
+	}
+}
+
+func TestReconcileSidecars(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: "client", Labels: map[string]string{"app": "caller"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	api := service("api", map[string]string{"app": "api"})
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:             "policy",
+				TrustDomain:      "cluster.local",
+				PodSelectors:     map[string]string{"app": "caller"},
+				WorkloadSelector: map[string]string{"app": "api"},
+			}},
+			SidecarEgress: &peerauthv1.SidecarEgress{},
+		},
+	}
+	rt := newReconcilerTest(t, dap, caller, &api)
+	c := rt.c
+	rt.SidecarEgress = true
+
+	rt.reconcileDAP(dap)
+	sidecar := &unstructured.Unstructured{}
+	sidecar.SetGroupVersionKind(SidecarGVK)
+	key := sidecarWorkload{namespace: "client", selector: "app=caller"}.key()
+	if err := c.Get(ctx, key, sidecar); err != nil {
+		t.Fatalf("generated Sidecar: %v", err)
+	}
+	workloadLabels, _, _ := unstructured.NestedStringMap(sidecar.Object, "spec", "workloadSelector", "labels")
+	if !reflect.DeepEqual(workloadLabels, map[string]string{"app": "caller"}) {
+		t.Errorf("Sidecar workload labels = %v", workloadLabels)
+	}
+
+	got := &peerauthv1.DynamicAuthorizationPolicy{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(dap), got); err != nil {
+		t.Fatal(err)
+	}
+	got.Spec.SidecarEgress = nil
+	if err := c.Update(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	rt.reconcileDAP(dap)
+	if err := c.Get(ctx, key, sidecar); err == nil {
+		t.Error("generated Sidecar survived removing spec.sidecarEgress")
+	}
+}
+
+func TestDryRunPlansPeerAuthenticationsAndSidecars(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: "client", Labels: map[string]string{"app": "caller"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	api := service("api", map[string]string{"app": "api"})
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			Mode: peerauthv1.ModeDryRun,
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:             "policy",
+				TrustDomain:      "cluster.local",
+				PodSelectors:     map[string]string{"app": "caller"},
+				WorkloadSelector: map[string]string{"app": "api"},
+			}},
+			PeerAuthentication: &peerauthv1.PeerAuthentication{},
+			SidecarEgress:      &peerauthv1.SidecarEgress{},
+		},
+	}
+	rt := newReconcilerTest(t, dap, caller, &api)
+	c := rt.c
+	rt.SidecarEgress = true
+	if _, err := rt.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(dap)}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := &peerauthv1.DynamicAuthorizationPolicy{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(dap), got); err != nil {
+		t.Fatal(err)
+	}
+	sidecarName := sidecarWorkload{namespace: "client", selector: "app=caller"}.key().Name
+	want := []peerauthv1.IntendedChange{
+		{
+			APIVersion: "security.istio.io/v1beta1", Kind: "AuthorizationPolicy", Name: "policy", Action: peerauthv1.ChangeCreate,
+			AddedPrincipals: []string{"cluster.local/ns/client/sa/caller"},
+		},
+		{APIVersion: "security.istio.io/v1beta1", Kind: "PeerAuthentication", Name: "policy", Action: peerauthv1.ChangeCreate},
+		{
+			APIVersion: "networking.istio.io/v1beta1", Kind: "Sidecar", Name: sidecarName, Namespace: "client",
+			Action: peerauthv1.ChangeCreate,
+		},
+	}
+	if !reflect.DeepEqual(got.Status.IntendedChanges, want) {
+		t.Errorf("intended changes = %+v, want %+v", got.Status.IntendedChanges, want)
+	}
+	sidecar := &unstructured.Unstructured{}
+	sidecar.SetGroupVersionKind(SidecarGVK)
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "client", Name: sidecarName}, sidecar); err == nil {
+		t.Error("dry run generated a Sidecar")
+	}
+}
+
+func TestSidecarGrantsTenancy(t *testing.T) {
+	t.Parallel()
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{Name: "api", PodSelectors: map[string]string{"app": "caller"}}},
+			SidecarEgress:   &peerauthv1.SidecarEgress{},
+		},
+	}
+	sapm := peerauthv1.ServiceAccountPolicyMapping{
+		"api": peerauthv1.HashSet{"cluster.local/ns/a/sa/caller": true, "cluster.local/ns/b/sa/caller": true},
+	}
+	grants := sidecarGrants{}
+	grants.add(dap, sapm, nil, &TenancyPolicy{Namespaces: map[string][]string{"server": {"a"}}})
+	want := []sidecarWorkload{{namespace: "a", selector: "app=caller"}}
+	if got := grants.workloads(); !reflect.DeepEqual(got, want) {
+		t.Errorf("workloads granted egress = %v, want %v", got, want)
+	}
+}
+
+func TestReconcileSharedSidecars(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: "client", Labels: map[string]string{"app": "caller"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	api := service("api", map[string]string{"app": "api"})
+	web := corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "web"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "web"}},
+	}
+	newDAP := func(namespace, workload string) *peerauthv1.DynamicAuthorizationPolicy {
+		return &peerauthv1.DynamicAuthorizationPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: namespace},
+			Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+				DynamicPolicies: []peerauthv1.DynamicPolicy{{
+					Name:             "policy",
+					TrustDomain:      "cluster.local",
+					PodSelectors:     map[string]string{"app": "caller"},
+					WorkloadSelector: map[string]string{"app": workload},
+				}},
+				SidecarEgress: &peerauthv1.SidecarEgress{},
+			},
+		}
+	}
+	server, frontend := newDAP("server", "api"), newDAP("web", "web")
+	defaults := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"egress": []interface{}{map[string]interface{}{"hosts": []interface{}{"istio-system/*"}}}},
+	}}
+	defaults.SetGroupVersionKind(SidecarGVK)
+	defaults.SetName("default")
+	defaults.SetNamespace("client")
+	rt := newReconcilerTest(t, server, frontend, caller, &api, &web, defaults)
+	c := rt.c
+	rt.SidecarEgress = true
+	key := sidecarWorkload{namespace: "client", selector: "app=caller"}.key()
+	egress := func() ([]string, string) {
+		t.Helper()
+		sidecar := &unstructured.Unstructured{}
+		sidecar.SetGroupVersionKind(SidecarGVK)
+		if err := c.Get(ctx, key, sidecar); err != nil {
+			return nil, ""
+		}
+		return sidecarHosts(sidecar), sidecar.GetAnnotations()[sidecarGrantsAnnotation]
+	}
+
+	rt.reconcileDAP(server)
+	rt.reconcileDAP(frontend)
+	hosts, granted := egress()
+	wantHosts := []string{"./*", "istio-system/*", "server/api.server.svc.cluster.local", "web/web.web.svc.cluster.local"}
+	if !reflect.DeepEqual(hosts, wantHosts) || granted != "server/dap,web/dap" {
+		t.Errorf("shared Sidecar hosts = %v granted by %q, want %v granted by both DAPs", hosts, granted, wantHosts)
+	}
+
+	got := rt.reconcileDAP(frontend)
+	got.Spec.SidecarEgress = nil
+	if err := c.Update(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	rt.reconcileDAP(got)
+	hosts, granted = egress()
+	wantHosts = []string{"./*", "istio-system/*", "server/api.server.svc.cluster.local"}
+	if !reflect.DeepEqual(hosts, wantHosts) || granted != "server/dap" {
+		t.Errorf("Sidecar hosts after a DAP stopped granting egress = %v granted by %q, want %v", hosts, granted, wantHosts)
+	}
+
+	user := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"workloadSelector": map[string]interface{}{"labels": map[string]interface{}{"app": "caller", "tier": "gold"}},
+		},
+	}}
+	user.SetGroupVersionKind(SidecarGVK)
+	user.SetName("caller")
+	user.SetNamespace("client")
+	if err := c.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	status := rt.reconcileDAP(server).Status
+	if hosts, _ := egress(); hosts != nil {
+		t.Errorf("generated Sidecar %v kept alongside a user-authored Sidecar for its callers", hosts)
+	}
+	condition := meta.FindStatusCondition(status.Conditions, peerauthv1.ConditionSidecarEgress)
+	if condition == nil || condition.Status != metav1.ConditionFalse || !strings.Contains(condition.Message, "client/caller") {
+		t.Errorf("SidecarEgress condition = %+v, want False naming client/caller", condition)
+	}
+}
+
+func TestReconcileSidecarsOverlappingOtherDAPs(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "caller", Namespace: "client", Labels: map[string]string{"app": "caller", "tier": "web"},
+		},
+		Spec: corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	newDAP := func(namespace string, podSelectors map[string]string) *peerauthv1.DynamicAuthorizationPolicy {
+		return &peerauthv1.DynamicAuthorizationPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: namespace},
+			Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+				DynamicPolicies: []peerauthv1.DynamicPolicy{{Name: "policy", PodSelectors: podSelectors}},
+				SidecarEgress:   &peerauthv1.SidecarEgress{},
+			},
+		}
+	}
+	server := newDAP("server", map[string]string{"app": "caller"})
+	web := newDAP("web", map[string]string{"app": "caller", "tier": "web"})
+	rt := newReconcilerTest(t, server, web, caller)
+	c := rt.c
+	rt.SidecarEgress = true
+
+	rt.reconcileDAP(server)
+	generated := sidecarWorkload{namespace: "client", selector: "app=caller"}.key()
+	status := rt.reconcileDAP(web).Status
+	sidecar := &unstructured.Unstructured{}
+	sidecar.SetGroupVersionKind(SidecarGVK)
+	if err := c.Get(ctx, sidecarWorkload{namespace: "client", selector: "app=caller,tier=web"}.key(), sidecar); err == nil {
+		t.Error("a second generated Sidecar selects callers another DAP's Sidecar selects")
+	}
+	condition := meta.FindStatusCondition(status.Conditions, peerauthv1.ConditionSidecarEgress)
+	if condition == nil || condition.Reason != reasonSidecarOverlap || !strings.Contains(condition.Message, generated.String()) {
+		t.Errorf("SidecarEgress condition = %+v, want an overlap naming %s", condition, generated)
+	}
+}
+
+func TestReconcileSidecarEgressOptIn(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	caller := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: "client", Labels: map[string]string{"app": "caller"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+	}
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "server"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{Name: "policy", PodSelectors: map[string]string{"app": "caller"}}},
+			SidecarEgress:   &peerauthv1.SidecarEgress{},
+		},
+	}
+	rt := newReconcilerTest(t, dap, caller)
+	c := rt.c
+	rt.SidecarEgress = true
+	rt.MeshNamespaces = []string{"istio-system", "mesh-root"}
+
+	rt.reconcileDAP(dap)
+	key := sidecarWorkload{namespace: "client", selector: "app=caller"}.key()
+	sidecar := &unstructured.Unstructured{}
+	sidecar.SetGroupVersionKind(SidecarGVK)
+	if err := c.Get(ctx, key, sidecar); err != nil {
+		t.Fatalf("generated Sidecar: %v", err)
+	}
+	if hosts, want := sidecarHosts(sidecar), []string{"./*", "istio-system/*", "mesh-root/*", "server/*"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("Sidecar hosts = %v, want %v", hosts, want)
+	}
+
+	// Turning the feature gate off removes the Sidecars already generated.
+	rt.SidecarEgress = false
+	status := rt.reconcileDAP(dap).Status
+	if err := c.Get(ctx, key, sidecar); err == nil {
+		t.Error("generated Sidecar survived disabling SidecarEgress")
+	}
+	condition := meta.FindStatusCondition(status.Conditions, peerauthv1.ConditionSidecarEgress)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != reasonSidecarEgressDisabled {
+		t.Errorf("SidecarEgress condition = %+v, want False with %s", condition, reasonSidecarEgressDisabled)
+	}
+}
@@ -31,6 +31,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
@@ -50,6 +51,8 @@ var (
 	ctx           context.Context
 	cancel        context.CancelFunc
 	useFakeClient bool
+	// managerConfig impersonates the service account bound to the generated manager ClusterRole.
+	managerConfig *rest.Config
 )
 
 func TestAPIs(t *testing.T) {
@@ -72,11 +75,14 @@ var _ = BeforeSuite(func() {
 	//+kubebuilder:scaffold:scheme
 
 	if useFakeClient {
-		k8sClient = fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+		k8sClient = newApplyClient(fake.NewClientBuilder().WithScheme(scheme.Scheme).Build())
 	} else {
 		By("bootstrapping test environment")
 		testEnv = &envtest.Environment{
-			CRDDirectoryPaths:     []string{filepath.Join("..", "config", "crd", "bases")},
+			CRDDirectoryPaths: []string{
+				filepath.Join("..", "config", "crd", "bases"),
+				filepath.Join("..", "hack", "crds"),
+			},
 			ErrorIfCRDPathMissing: true,
 		}
 
@@ -93,20 +99,27 @@ var _ = BeforeSuite(func() {
 		Expect(err).NotTo(HaveOccurred())
 		Expect(k8sClient).NotTo(BeNil())
 
-		k8sManager, err := ctrl.NewManager(cfg, ctrl.Options{
+		By("running the manager with the generated ClusterRole")
+		managerConfig, err = grantManagerRole(ctx, k8sClient, cfg)
+		Expect(err).NotTo(HaveOccurred())
+
+		k8sManager, err := ctrl.NewManager(managerConfig, ctrl.Options{
 			Scheme: scheme.Scheme,
 		})
 		Expect(err).ToNot(HaveOccurred())
 
+		podTriggers := make(chan event.GenericEvent)
 		err = (&DynamicAuthorizationPolicyReconciler{
-			Client: k8sManager.GetClient(),
-			Scheme: k8sManager.GetScheme(),
+			Client:      k8sManager.GetClient(),
+			Scheme:      k8sManager.GetScheme(),
+			PodTriggers: podTriggers,
 		}).SetupWithManager(k8sManager)
 		Expect(err).ToNot(HaveOccurred())
 
 		err = (&PodReconciler{
-			Client: k8sManager.GetClient(),
-			Scheme: k8sManager.GetScheme(),
+			Client:   k8sManager.GetClient(),
+			Scheme:   k8sManager.GetScheme(),
+			Triggers: podTriggers,
 		}).SetupWithManager(k8sManager)
 		Expect(err).ToNot(HaveOccurred())
 
@@ -0,0 +1,141 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// TenancyConfigKey is the ConfigMap key holding the tenancy policy.
+const TenancyConfigKey = "tenancy.yaml"
+
+// anyNamespace allows a DAP to select pods from every namespace.
+const anyNamespace = "*"
+
+// TenancyPolicy maps DAP namespaces to the namespaces their policies may select pods from.
+// A DAP may always select pods from its own namespace.
+type TenancyPolicy struct {
+	// Namespaces lists the allowed source namespaces for DAPs in each namespace.
+	Namespaces map[string][]string `json:"namespaces,omitempty"`
+	// Default applies to DAPs in namespaces missing from Namespaces.
+	Default []string `json:"default,omitempty"`
+}
+
+// Allows reports whether a DAP in dapNamespace may select pods from namespace.
+// A nil policy allows every namespace.
+func (t *TenancyPolicy) Allows(dapNamespace, namespace string) bool {
+	if t == nil || dapNamespace == namespace {
+		return true
+	}
+	allowed, ok := t.Namespaces[dapNamespace]
+	if !ok {
+		allowed = t.Default
+	}
+	for _, ns := range allowed {
+		if ns == anyNamespace || ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Violations returns, per policy, the namespaces listed by the DAP that it may not select pods from.
+func (t *TenancyPolicy) Violations(dap *peerauthv1.DynamicAuthorizationPolicy) map[string][]string {
+	violations := map[string][]string{}
+	for _, policy := range dap.GetPolicies() {
+		for _, ns := range policy.Namespaces {
+			if !t.Allows(dap.GetNamespace(), ns) {
+				violations[policy.Name] = append(violations[policy.Name], ns)
+			}
+		}
+	}
+	return violations
+}
+
+// violationsMessage describes violations in policy order.
+func violationsMessage(dap *peerauthv1.DynamicAuthorizationPolicy, violations map[string][]string) string {
+	msgs := []string{}
+	for _, policy := range dap.GetPolicies() {
+		if namespaces, ok := violations[policy.Name]; ok {
+			msgs = append(msgs, fmt.Sprintf("policy %s may not select pods from namespaces %s",
+				policy.Name, strings.Join(namespaces, ", ")))
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// recordTenancyViolations sets the NamespacesAllowed condition, emitting a warning Event when
+// the DAP starts violating the tenancy policy or the violations change.
+func (r *DynamicAuthorizationPolicyReconciler) recordTenancyViolations(dap *peerauthv1.DynamicAuthorizationPolicy,
+	violations map[string][]string) {
+	condition := metav1.Condition{
+		Type:               peerauthv1.ConditionNamespacesAllowed,
+		Status:             metav1.ConditionTrue,
+		Reason:             reasonNamespacesAllowed,
+		Message:            "all policies select pods from allowed namespaces",
+		ObservedGeneration: dap.GetGeneration(),
+	}
+	if len(violations) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = reasonNamespaceNotAllowed
+		condition.Message = violationsMessage(dap, violations)
+		if previous := meta.FindStatusCondition(dap.Status.Conditions, condition.Type); previous == nil ||
+			previous.Message != condition.Message {
+			r.Recorder.Event(dap, corev1.EventTypeWarning, reasonNamespaceNotAllowed, condition.Message)
+		}
+	}
+	meta.SetStatusCondition(&dap.Status.Conditions, condition)
+}
+
+// TenancySource loads the tenancy policy from a ConfigMap on every use, so edits take effect
+// without restarting the controller.
+type TenancySource struct {
+	Reader    client.Reader
+	ConfigMap types.NamespacedName
+}
+
+// Load returns the current tenancy policy. A nil source returns a nil policy, allowing every
+// namespace, while a missing ConfigMap restricts every DAP to its own namespace.
+func (s *TenancySource) Load(ctx context.Context) (*TenancyPolicy, error) {
+	if s == nil {
+		return nil, nil
+	}
+	cm := corev1.ConfigMap{}
+	if err := s.Reader.Get(ctx, s.ConfigMap, &cm); err != nil {
+		if kerrors.IsNotFound(err) {
+			return &TenancyPolicy{}, nil
+		}
+		return nil, errors.Wrapf(err, "unable to get tenancy ConfigMap %s", s.ConfigMap)
+	}
+	policy := &TenancyPolicy{}
+	if err := yaml.UnmarshalStrict([]byte(cm.Data[TenancyConfigKey]), policy); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse %s in tenancy ConfigMap %s", TenancyConfigKey, s.ConfigMap)
+	}
+	return policy, nil
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const testTenancy = `
+namespaces:
+  team-a: [shared]
+  platform: ["*"]
+`
+
+func testScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := peerauthv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testTenancySource(objs ...client.Object) *TenancySource {
+	return &TenancySource{
+		Reader:    fake.NewClientBuilder().WithObjects(objs...).Build(),
+		ConfigMap: types.NamespacedName{Namespace: "system", Name: "tenancy"},
+	}
+}
+
+func tenancyConfigMap(data string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "system", Name: "tenancy"},
+		Data:       map[string]string{TenancyConfigKey: data},
+	}
+}
+
+func TestTenancyPolicyAllows(t *testing.T) {
+	t.Parallel()
+	tenancy, err := testTenancySource(tenancyConfigMap(testTenancy)).Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, err := testTenancySource().Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		tenancy      *TenancyPolicy
+		dapNamespace string
+		namespace    string
+		want         bool
+	}{
+		"no tenancy policy":      {nil, "team-a", "team-b", true},
+		"own namespace":          {tenancy, "team-b", "team-b", true},
+		"listed namespace":       {tenancy, "team-a", "shared", true},
+		"unlisted namespace":     {tenancy, "team-a", "team-b", false},
+		"wildcard":               {tenancy, "platform", "team-b", true},
+		"unknown DAP namespace":  {tenancy, "team-b", "shared", false},
+		"missing ConfigMap":      {missing, "team-a", "shared", false},
+		"missing ConfigMap self": {missing, "team-a", "team-a", true},
+	}
+	for name, tt := range tests {
+		if got := tt.tenancy.Allows(tt.dapNamespace, tt.namespace); got != tt.want {
+			t.Errorf("%s: Allows(%q, %q) = %v, want %v", name, tt.dapNamespace, tt.namespace, got, tt.want)
+		}
+	}
+}
+
+func tenancyDAP(namespaces ...string) *peerauthv1.DynamicAuthorizationPolicy {
+	return &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "team-a"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:         "policy",
+				TrustDomain:  "cluster.local",
+				PodSelectors: map[string]string{"app": "caller"},
+				Namespaces:   namespaces,
+			}},
+		},
+	}
+}
+
+func TestDynamicAuthorizationPolicyValidator(t *testing.T) {
+	t.Parallel()
+	validator := &DynamicAuthorizationPolicyValidator{Tenancy: testTenancySource(tenancyConfigMap(testTenancy))}
+	ctx := context.Background()
+
+	if err := validator.ValidateCreate(ctx, tenancyDAP("team-a", "shared")); err != nil {
+		t.Errorf("allowed namespaces rejected: %v", err)
+	}
+	if err := validator.ValidateCreate(ctx, tenancyDAP()); err != nil {
+		t.Errorf("DAP without namespaces rejected: %v", err)
+	}
+	if err := validator.ValidateUpdate(ctx, tenancyDAP(), tenancyDAP("shared", "team-b")); err == nil {
+		t.Error("expected namespace team-b to be rejected")
+	}
+	if err := (&DynamicAuthorizationPolicyValidator{}).ValidateCreate(ctx, tenancyDAP("team-b")); err != nil {
+		t.Errorf("rejected without a tenancy policy: %v", err)
+	}
+
+	// A DAP listing a namespace the tenancy policy no longer allows can still be written.
+	disallowed := tenancyDAP("shared", "team-b")
+	withStatus := disallowed.DeepCopy()
+	withStatus.Finalizers = nil
+	withStatus.Status.Backends = []peerauthv1.Backend{peerauthv1.BackendIstio}
+	if err := validator.ValidateUpdate(ctx, disallowed, withStatus); err != nil {
+		t.Errorf("finalizer and status update rejected: %v", err)
+	}
+	edited := disallowed.DeepCopy()
+	edited.Spec.DynamicPolicies[0].PodSelectors = map[string]string{"app": "other"}
+	if err := validator.ValidateUpdate(ctx, disallowed, edited); err != nil {
+		t.Errorf("edit keeping a previously listed namespace rejected: %v", err)
+	}
+	deleting := edited.DeepCopy()
+	deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	deleting.Spec.DynamicPolicies[0].Namespaces = append(deleting.Spec.DynamicPolicies[0].Namespaces, "team-c")
+	if err := validator.ValidateUpdate(ctx, disallowed, deleting); err != nil {
+		t.Errorf("update of a deleting DAP rejected: %v", err)
+	}
+	added := disallowed.DeepCopy()
+	added.Spec.DynamicPolicies[0].Namespaces = append(added.Spec.DynamicPolicies[0].Namespaces, "team-c")
+	if err := validator.ValidateUpdate(ctx, disallowed, added); err == nil {
+		t.Error("expected newly added namespace team-c to be rejected")
+	}
+}
+
+func TestReconcileTenancyViolation(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	pod := func(namespace string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: namespace, Labels: map[string]string{"app": "caller"}},
+			Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+		}
+	}
+	dap := tenancyDAP()
+	rt := newReconcilerTest(t, dap, pod("team-a"), pod("shared"), pod("team-b"))
+	c := rt.c
+	recorder := rt.recorder
+	rt.Tenancy = testTenancySource(tenancyConfigMap(testTenancy))
+
+	got := rt.reconcileDAP(dap)
+	if principals := got.Status.ServiceAccountPolicyMapping["policy"]; len(principals) != 2 ||
+		principals.Get("cluster.local/ns/team-b/sa/caller") {
+		t.Errorf("unexpected principals %v", principals)
+	}
+	if !meta.IsStatusConditionTrue(got.Status.Conditions, peerauthv1.ConditionNamespacesAllowed) {
+		t.Errorf("expected %s condition to be true: %+v", peerauthv1.ConditionNamespacesAllowed, got.Status.Conditions)
+	}
+
+	got.Spec.DynamicPolicies[0].Namespaces = []string{"team-b"}
+	if err := c.Update(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	got = rt.reconcileDAP(dap)
+	if len(got.Status.ServiceAccountPolicyMapping["policy"]) != 0 {
+		t.Errorf("principals from a disallowed namespace were granted: %v", got.Status.ServiceAccountPolicyMapping)
+	}
+	condition := meta.FindStatusCondition(got.Status.Conditions, peerauthv1.ConditionNamespacesAllowed)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != reasonNamespaceNotAllowed {
+		t.Errorf("unexpected %s condition %+v", peerauthv1.ConditionNamespacesAllowed, condition)
+	}
+	found := false
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; event == "Warning NamespaceNotAllowed "+condition.Message {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected a NamespaceNotAllowed warning event")
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=list
+
+// ResolveWatchNamespaces returns the sorted union of namespaces and the namespaces whose labels
+// match selector, if it is not nil. It fails if a selector is given and nothing is watched, as
+// an empty set would watch every namespace.
+func ResolveWatchNamespaces(ctx context.Context, c client.Reader, namespaces []string,
+	selector labels.Selector) ([]string, error) {
+	watched := peerauthv1.FromSlice(namespaces)
+	if selector != nil {
+		list := corev1.NamespaceList{}
+		if err := c.List(ctx, &list, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, errors.Wrap(err, "unable to list namespaces to watch")
+		}
+		for _, ns := range list.Items {
+			watched.Add(ns.GetName())
+		}
+		if len(watched) == 0 {
+			return nil, errors.Errorf("no namespaces match the watch namespace selector %q", selector)
+		}
+	}
+	return watched.Slice(), nil
+}
+
+// unwatchedNamespaces returns, for each of the DAP's policies, the namespaces it lists that
+// are not in watched. Every namespace is watched when watched is empty.
+func unwatchedNamespaces(dap *peerauthv1.DynamicAuthorizationPolicy, watched []string) map[string][]string {
+	unwatched := map[string][]string{}
+	if len(watched) == 0 {
+		return unwatched
+	}
+	set := peerauthv1.FromSlice(watched)
+	for _, policy := range dap.GetPolicies() {
+		for _, ns := range policy.Namespaces {
+			if !set.Get(ns) {
+				unwatched[policy.Name] = append(unwatched[policy.Name], ns)
+			}
+		}
+	}
+	return unwatched
+}
+
+// recordUnwatchedNamespaces sets the NamespacesWatched condition, emitting a warning Event when
+// the DAP starts selecting pods from namespaces the controller does not watch or they change.
+func (r *DynamicAuthorizationPolicyReconciler) recordUnwatchedNamespaces(dap *peerauthv1.DynamicAuthorizationPolicy,
+	unwatched map[string][]string) {
+	condition := metav1.Condition{
+		Type:               peerauthv1.ConditionNamespacesWatched,
+		Status:             metav1.ConditionTrue,
+		Reason:             reasonNamespacesWatched,
+		Message:            "all policies select pods from watched namespaces",
+		ObservedGeneration: dap.GetGeneration(),
+	}
+	if len(unwatched) > 0 {
+		msgs := []string{}
+		for _, policy := range dap.GetPolicies() {
+			if namespaces, ok := unwatched[policy.Name]; ok {
+				msgs = append(msgs, fmt.Sprintf("policy %s selects pods from namespaces %s, which are not watched",
+					policy.Name, strings.Join(namespaces, ", ")))
+			}
+		}
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = reasonNamespaceNotWatched
+		condition.Message = strings.Join(msgs, "; ")
+		if previous := meta.FindStatusCondition(dap.Status.Conditions, condition.Type); previous == nil ||
+			previous.Message != condition.Message {
+			r.Recorder.Event(dap, corev1.EventTypeWarning, reasonNamespaceNotWatched, condition.Message)
+		}
+	}
+	meta.SetStatusCondition(&dap.Status.Conditions, condition)
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// podCacheClient reads pods from a slim pod cache, as the manager's client does.
+type podCacheClient struct {
+	client.Client
+	pods *slimPodCache
+}
+
+func (c podCacheClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if _, ok := obj.(*corev1.Pod); ok {
+		return c.pods.Get(ctx, key, obj)
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c podCacheClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if _, ok := list.(*corev1.PodList); ok {
+		return c.pods.List(ctx, list, opts...)
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestResolveWatchNamespaces(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	namespace := func(name string, l map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: l}}
+	}
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(
+		namespace("team-a", map[string]string{"mesh": "dap"}),
+		namespace("team-b", map[string]string{"mesh": "dap"}),
+		namespace("other", nil),
+	).Build()
+	tests := map[string]struct {
+		namespaces []string
+		selector   string
+		want       []string
+		wantErr    bool
+	}{
+		"list only":             {namespaces: []string{"b", "a"}, want: []string{"a", "b"}},
+		"selector":              {selector: "mesh=dap", want: []string{"team-a", "team-b"}},
+		"list and selector":     {namespaces: []string{"other", "team-a"}, selector: "mesh=dap", want: []string{"other", "team-a", "team-b"}},
+		"selector matches none": {selector: "mesh=none", wantErr: true},
+		"nothing":               {want: []string{}},
+	}
+	for name, tt := range tests {
+		var selector labels.Selector
+		if tt.selector != "" {
+			var err error
+			if selector, err = labels.Parse(tt.selector); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := ResolveWatchNamespaces(ctx, c, tt.namespaces, selector)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %t", name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: namespaces = %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func TestReconcileUnwatchedNamespace(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pod := func(namespace string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "caller", Namespace: namespace, Labels: map[string]string{"app": "caller"}},
+			Spec:       corev1.PodSpec{ServiceAccountName: "caller"},
+		}
+	}
+	dap := &peerauthv1.DynamicAuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "dap", Namespace: "team-a"},
+		Spec: peerauthv1.DynamicAuthorizationPolicySpec{
+			DynamicPolicies: []peerauthv1.DynamicPolicy{{
+				Name:         "policy",
+				TrustDomain:  "cluster.local",
+				PodSelectors: map[string]string{"app": "caller"},
+				Namespaces:   []string{"team-a", "team-b"},
+			}},
+		},
+	}
+	pods := startSlimPodCache(ctx, t, kubefake.NewSimpleClientset(pod("team-a"), pod("team-b")), "team-a")
+	c := podCacheClient{Client: newApplyClient(fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(dap).Build()), pods: pods}
+	recorder := record.NewFakeRecorder(10)
+	r := &DynamicAuthorizationPolicyReconciler{
+		Client:          c,
+		Scheme:          c.Scheme(),
+		Recorder:        recorder,
+		WatchNamespaces: []string{"team-a"},
+	}
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(dap)}); err != nil {
+		t.Fatal(err)
+	}
+	got := &peerauthv1.DynamicAuthorizationPolicy{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(dap), got); err != nil {
+		t.Fatal(err)
+	}
+	if principals := got.Status.ServiceAccountPolicyMapping["policy"].Slice(); !reflect.DeepEqual(principals,
+		[]string{"cluster.local/ns/team-a/sa/caller"}) {
+		t.Errorf("principals = %v, want only those from the watched namespace", principals)
+	}
+	condition := meta.FindStatusCondition(got.Status.Conditions, peerauthv1.ConditionNamespacesWatched)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != reasonNamespaceNotWatched {
+		t.Fatalf("unexpected %s condition %+v", peerauthv1.ConditionNamespacesWatched, condition)
+	}
+	found := false
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; event == "Warning NamespaceNotWatched "+condition.Message {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected a NamespaceNotWatched warning event")
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command namespaced-rbac converts the manager ClusterRole generated by controller-gen into a
+// Role and RoleBinding in each namespace the controller is restricted to with
+// --watch-namespaces, for clusters that do not grant the controller cluster-wide access.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// clusterScoped are the resources a Role cannot grant.
+var clusterScoped = map[string]bool{ // nolint:gochecknoglobals
+	"namespaces": true,
+}
+
+func main() {
+	var namespaces string
+	var name string
+	var serviceAccount string
+	var serviceAccountNamespace string
+	flag.StringVar(&namespaces, "namespaces", "", "A comma separated list of namespaces to create Roles in.")
+	flag.StringVar(&name, "name", "istio-dynamic-principles-manager-role", "The name of each Role and RoleBinding.")
+	flag.StringVar(&serviceAccount, "service-account", "istio-dynamic-principles-controller-manager",
+		"The service account of the controller.")
+	flag.StringVar(&serviceAccountNamespace, "service-account-namespace", "istio-dynamic-principles-system",
+		"The namespace of the controller's service account.")
+	flag.Parse()
+	if flag.NArg() != 1 || namespaces == "" {
+		fmt.Fprintln(os.Stderr, "usage: namespaced-rbac --namespaces=a,b config/rbac/role.yaml")
+		os.Exit(2)
+	}
+
+	out, err := run(flag.Arg(0), strings.Split(namespaces, ","), name,
+		rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: serviceAccount, Namespace: serviceAccountNamespace})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print(out)
+}
+
+func run(path string, namespaces []string, name string, subject rbacv1.Subject) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to read %s", path)
+	}
+	role := rbacv1.ClusterRole{}
+	if err := yaml.UnmarshalStrict(data, &role); err != nil {
+		return "", errors.Wrapf(err, "unable to parse ClusterRole %s", path)
+	}
+	docs := []string{}
+	for _, obj := range namespacedRBAC(role, namespaces, name, subject) {
+		doc, err := yaml.Marshal(obj)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to marshal RBAC")
+		}
+		docs = append(docs, "---\n"+string(doc))
+	}
+	return strings.Join(docs, ""), nil
+}
+
+// namespacedRBAC returns a Role with the namespaced rules of role, and a RoleBinding of it to
+// subject, in each namespace.
+func namespacedRBAC(role rbacv1.ClusterRole, namespaces []string, name string, subject rbacv1.Subject) []interface{} {
+	rules := []rbacv1.PolicyRule{}
+	for _, rule := range role.Rules {
+		resources := []string{}
+		for _, resource := range rule.Resources {
+			if !clusterScoped[resource] {
+				resources = append(resources, resource)
+			}
+		}
+		if len(resources) > 0 {
+			rule.Resources = resources
+			rules = append(rules, rule)
+		}
+	}
+
+	objs := []interface{}{}
+	for _, ns := range namespaces {
+		if ns = strings.TrimSpace(ns); ns == "" {
+			continue
+		}
+		meta := metav1.ObjectMeta{Name: name, Namespace: ns}
+		objs = append(objs,
+			rbacv1.Role{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+				ObjectMeta: meta,
+				Rules:      rules,
+			},
+			rbacv1.RoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+				ObjectMeta: meta,
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: name},
+				Subjects:   []rbacv1.Subject{subject},
+			},
+		)
+	}
+	return objs
+}
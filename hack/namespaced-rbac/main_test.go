@@ -0,0 +1,51 @@
+/*
+Copyright 2022 Aaron Weisberg.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+func TestNamespacedRBAC(t *testing.T) {
+	t.Parallel()
+	role := rbacv1.ClusterRole{Rules: []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"pods", "namespaces"}, Verbs: []string{"list"}},
+		{APIGroups: []string{""}, Resources: []string{"namespaces"}, Verbs: []string{"get"}},
+	}}
+	subject := rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "manager", Namespace: "system"}
+
+	objs := namespacedRBAC(role, []string{"team-a", " ", "team-b"}, "manager-role", subject)
+	if len(objs) != 4 {
+		t.Fatalf("got %d objects, want a Role and RoleBinding in 2 namespaces", len(objs))
+	}
+	r := objs[2].(rbacv1.Role)
+	if r.Namespace != "team-b" || r.Name != "manager-role" {
+		t.Errorf("Role %s/%s, want team-b/manager-role", r.Namespace, r.Name)
+	}
+	want := []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"list"}}}
+	if !reflect.DeepEqual(r.Rules, want) {
+		t.Errorf("rules = %+v, want cluster-scoped resources dropped: %+v", r.Rules, want)
+	}
+	binding := objs[3].(rbacv1.RoleBinding)
+	if binding.RoleRef.Kind != "Role" || binding.RoleRef.Name != "manager-role" ||
+		!reflect.DeepEqual(binding.Subjects, []rbacv1.Subject{subject}) {
+		t.Errorf("unexpected RoleBinding %+v", binding)
+	}
+}
@@ -17,20 +17,31 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/cache"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	configv1alpha1 "github.com/aweis89/istio-dynamic-principles/api/config/v1alpha1"
 	peerauthv1 "github.com/aweis89/istio-dynamic-principles/api/v1"
 	"github.com/aweis89/istio-dynamic-principles/controllers"
 	//+kubebuilder:scaffold:imports
@@ -45,18 +56,83 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(peerauthv1.AddToScheme(scheme))
+	utilruntime.Must(configv1alpha1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
 func main() {
+	var configFile string
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var dryRun bool
+	var auditLog string
+	var auditWebhook string
+	var tenancyConfigMap string
+	var maxPrincipals int
+	var debounceWindow time.Duration
+	var resyncPeriod time.Duration
+	var dapConcurrency int
+	var podConcurrency int
+	var defaultTrustDomain string
+	var watchNamespaces string
+	var watchNamespaceSelector string
+	var meshNamespaces string
+	featureGates := controllers.FeatureGates{}
+	rateLimiter := controllers.DefaultRateLimiterOptions()
+	flag.StringVar(&configFile, "config", "",
+		"Load the manager configuration from this file. Flags given on the command line override its values.")
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Compute generated AuthorizationPolicies for every DynamicAuthorizationPolicy and record the "+
+			"intended changes in status and Events without writing them.")
+	flag.StringVar(&auditLog, "audit-log", "",
+		"Append a JSON line for every principal granted or revoked to this file, or to stdout if set to \"-\".")
+	flag.StringVar(&auditWebhook, "audit-webhook", "",
+		"POST audit records for every principal granted or revoked to this URL.")
+	flag.StringVar(&tenancyConfigMap, "tenancy-configmap", "",
+		"Restrict the namespaces each DynamicAuthorizationPolicy may select pods from using the "+
+			"tenancy policy in this namespace/name ConfigMap.")
+	flag.IntVar(&maxPrincipals, "max-principals", 0,
+		"Keep the last-known-good principals of any policy selecting more than this many, unless the "+
+			"policy sets its own maxPrincipals. Zero means unlimited.")
+	flag.DurationVar(&debounceWindow, "status-debounce-window", time.Second,
+		"Write the status of a DynamicAuthorizationPolicy at most once per window when reconciles are "+
+			"triggered by pod changes rather than spec changes.")
+	flag.DurationVar(&resyncPeriod, "principal-resync-period", 10*time.Minute,
+		"Keep the principals of each DynamicAuthorizationPolicy current from pod events, relisting its pods "+
+			"only when its spec changes or at this interval. Zero relists pods on every reconcile.")
+	flag.IntVar(&dapConcurrency, "dap-max-concurrent-reconciles", 0,
+		"The maximum number of DynamicAuthorizationPolicies reconciled concurrently. Defaults to the "+
+			"configuration file's groupKindConcurrency, or 1.")
+	flag.IntVar(&podConcurrency, "pod-max-concurrent-reconciles", 0,
+		"The maximum number of pods reconciled concurrently. Defaults to the configuration file's "+
+			"groupKindConcurrency, or 1.")
+	flag.StringVar(&defaultTrustDomain, "default-trust-domain", peerauthv1.DefaultTrustDomain,
+		"The trust domain used in the principals of policies that do not set one.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"A comma separated list of namespaces to watch pods and DynamicAuthorizationPolicies in, "+
+			"instead of the whole cluster.")
+	flag.StringVar(&watchNamespaceSelector, "watch-namespace-selector", "",
+		"Also watch the namespaces whose labels match this selector when the manager starts.")
+	flag.StringVar(&meshNamespaces, "mesh-namespaces", "istio-system",
+		"Namespaces, comma separated, every generated Sidecar keeps egress to, such as the Istio control plane and "+
+			"mesh root namespaces.")
+	flag.Var(featureGates, "feature-gates",
+		"A comma separated list of name=bool pairs enabling or disabling optional features: "+
+			controllers.DefaultFeatureGates().String()+".")
+	flag.DurationVar(&rateLimiter.BaseDelay, "rate-limiter-base-delay", rateLimiter.BaseDelay,
+		"The initial delay before retrying a failed reconcile, doubled on every further failure.")
+	flag.DurationVar(&rateLimiter.MaxDelay, "rate-limiter-max-delay", rateLimiter.MaxDelay,
+		"The maximum delay before retrying a failed reconcile.")
+	flag.Float64Var(&rateLimiter.QPS, "rate-limiter-qps", rateLimiter.QPS,
+		"The overall rate at which each controller's workqueue admits requeued items.")
+	flag.IntVar(&rateLimiter.Burst, "rate-limiter-burst", rateLimiter.Burst,
+		"The number of requeued items each controller's workqueue admits above rate-limiter-qps in a burst.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -65,29 +141,191 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "ff937905.aweis.io",
-	})
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	options := ctrl.Options{Scheme: scheme}
+	config := configv1alpha1.ManagerConfig{}
+	if configFile != "" {
+		var err error
+		options, err = options.AndFrom(ctrl.ConfigFile().AtPath(configFile).OfKind(&config))
+		if err != nil {
+			setupLog.Error(err, "unable to load the config file", "config", configFile)
+			os.Exit(1)
+		}
+	}
+	if set["metrics-bind-address"] || options.MetricsBindAddress == "" {
+		options.MetricsBindAddress = metricsAddr
+	}
+	if set["health-probe-bind-address"] || options.HealthProbeBindAddress == "" {
+		options.HealthProbeBindAddress = probeAddr
+	}
+	if set["leader-elect"] {
+		options.LeaderElection = enableLeaderElection
+	}
+	if options.LeaderElectionID == "" {
+		options.LeaderElectionID = "ff937905.aweis.io"
+	}
+	if options.Port == 0 {
+		options.Port = 9443
+	}
+
+	namespaces := config.WatchNamespaces
+	if set["watch-namespaces"] {
+		namespaces = nil
+		for _, ns := range strings.Split(watchNamespaces, ",") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				namespaces = append(namespaces, ns)
+			}
+		}
+	}
+	var namespaceSelector labels.Selector
+	switch {
+	case set["watch-namespace-selector"]:
+		selector, err := labels.Parse(watchNamespaceSelector)
+		if err != nil {
+			setupLog.Error(err, "invalid watch namespace selector")
+			os.Exit(1)
+		}
+		namespaceSelector = selector
+	case config.WatchNamespaceSelector != nil:
+		selector, err := metav1.LabelSelectorAsSelector(config.WatchNamespaceSelector)
+		if err != nil {
+			setupLog.Error(err, "invalid watch namespace selector in the config file", "config", configFile)
+			os.Exit(1)
+		}
+		namespaceSelector = selector
+	}
+	restConfig := ctrl.GetConfigOrDie()
+	if namespaceSelector != nil {
+		c, err := client.New(restConfig, client.Options{Scheme: scheme})
+		if err != nil {
+			setupLog.Error(err, "unable to create client")
+			os.Exit(1)
+		}
+		namespaces, err = controllers.ResolveWatchNamespaces(context.Background(), c, namespaces, namespaceSelector)
+		if err != nil {
+			setupLog.Error(err, "unable to resolve watched namespaces")
+			os.Exit(1)
+		}
+	}
+	if len(namespaces) == 0 && options.Namespace != "" {
+		namespaces = []string{options.Namespace}
+	}
+	if len(namespaces) > 0 {
+		setupLog.Info("watching namespaces", "namespaces", namespaces)
+	}
+	options.NewCache = controllers.NewSlimPodCache(namespaces...)
+
+	if !set["dry-run"] {
+		dryRun = config.DryRun
+	}
+	if !set["default-trust-domain"] && config.DefaultTrustDomain != "" {
+		defaultTrustDomain = config.DefaultTrustDomain
+	}
+	peerauthv1.DefaultTrustDomain = defaultTrustDomain
+	features := controllers.DefaultFeatureGates()
+	if err := features.Merge(config.FeatureGates); err != nil {
+		setupLog.Error(err, "invalid feature gates in the config file", "config", configFile)
+		os.Exit(1)
+	}
+	if err := features.Merge(featureGates); err != nil {
+		setupLog.Error(err, "invalid feature gates")
+		os.Exit(1)
+	}
+
+	mgr, err := ctrl.NewManager(restConfig, options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	auditSinks := controllers.MultiAuditSink{}
+	if auditLog != "" {
+		sink, err := controllers.NewFileAuditSink(auditLog)
+		if err != nil {
+			setupLog.Error(err, "unable to open audit log")
+			os.Exit(1)
+		}
+		auditSinks = append(auditSinks, sink)
+	}
+	if auditWebhook != "" {
+		sink := controllers.NewWebhookAuditSink(auditWebhook)
+		if err := mgr.Add(sink); err != nil {
+			setupLog.Error(err, "unable to start audit webhook retries")
+			os.Exit(1)
+		}
+		auditSinks = append(auditSinks, sink)
+	}
+	var auditSink controllers.AuditSink
+	if len(auditSinks) > 0 {
+		auditSink = auditSinks
+	}
+
+	var tenancy *controllers.TenancySource
+	if tenancyConfigMap != "" {
+		namespace, name, err := cache.SplitMetaNamespaceKey(tenancyConfigMap)
+		if err != nil || namespace == "" {
+			setupLog.Error(err, "tenancy ConfigMap must be given as namespace/name", "tenancy-configmap", tenancyConfigMap)
+			os.Exit(1)
+		}
+		tenancy = &controllers.TenancySource{
+			Reader:    mgr.GetAPIReader(),
+			ConfigMap: types.NamespacedName{Namespace: namespace, Name: name},
+		}
+	}
+
+	meshNamespaceList := []string{}
+	for _, ns := range strings.Split(meshNamespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			meshNamespaceList = append(meshNamespaceList, ns)
+		}
+	}
+
+	podTriggers := make(chan event.GenericEvent)
+	var principals *controllers.PrincipalIndex
+	if resyncPeriod > 0 && features.Enabled(controllers.FeaturePrincipalIndex) {
+		principals = controllers.NewPrincipalIndex()
+	}
 	if err = (&controllers.DynamicAuthorizationPolicyReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:          mgr.GetClient(),
+		Scheme:          mgr.GetScheme(),
+		Audit:           auditSink,
+		DryRun:          dryRun,
+		Tenancy:         tenancy,
+		MaxPrincipals:   maxPrincipals,
+		DebounceWindow:  debounceWindow,
+		PodTriggers:     podTriggers,
+		Principals:      principals,
+		ResyncPeriod:    resyncPeriod,
+		WatchNamespaces: namespaces,
+		SidecarEgress:   features.Enabled(controllers.FeatureSidecarEgress),
+		MeshNamespaces:  meshNamespaceList,
+		Options: controller.Options{
+			MaxConcurrentReconciles: dapConcurrency,
+			RateLimiter:             controllers.NewRateLimiter(rateLimiter),
+		},
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DynamicAuthorizationPolicy")
 		os.Exit(1)
 	}
+	if features.Enabled(controllers.FeatureValidatingWebhook) && os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&controllers.DynamicAuthorizationPolicyValidator{
+			Tenancy: tenancy,
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "DynamicAuthorizationPolicy")
+			os.Exit(1)
+		}
+	}
 	if err = (&controllers.PodReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		Triggers:   podTriggers,
+		Principals: principals,
+		Options: controller.Options{
+			MaxConcurrentReconciles: podConcurrency,
+			RateLimiter:             controllers.NewRateLimiter(rateLimiter),
+		},
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Pod")
 		os.Exit(1)